@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// cacheCmd groups the commands for inspecting the package cache
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect the package cache",
+	Long: `This subcommand is an entry point for inspecting the packages pkgr has
+downloaded or built, which are kept in a directory for each repository named
+by the repository and a hash of its URL.
+
+Use the 'list' subcommand to list every package in the cache, and the 'info'
+subcommand to show the cached files for one package. Use 'pkgr clean cache'
+to remove packages from the cache.`,
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+}
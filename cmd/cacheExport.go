@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+	"github.com/metrumresearchgroup/pkgr/rcmd"
+)
+
+var exportOut string
+var exportRepos []string
+var exportRVersions []string
+var exportPlan bool
+
+var cacheExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the cached binaries as an archive",
+	Long: `Write the binary packages in the cache to a zstandard-compressed tar archive,
+which 'pkgr cache import' adds to the cache on another machine, so binaries
+built once, such as in a CI job, can be shared with other runners.
+
+The archive holds a manifest listing each binary along with its SHA256
+checksum and, for binaries built by pkgr, the platform they were built on.
+
+By default every binary is exported. The --repos, --r-versions and --plan
+options limit the binaries exported to those of the given repositories, the
+given versions of R, or the packages the plan for the current configuration
+installs.`,
+	Example: `  # Export every cached binary
+  pkgr cache export --out cache.tar.zst
+  # Export the binaries for R 4.3 of the packages the current plan installs
+  pkgr cache export --out cache.tar.zst --r-versions 4.3 --plan`,
+	RunE: rCacheExport,
+}
+
+func init() {
+	cacheExportCmd.Flags().StringVar(&exportOut, "out", "", "path of the archive to write, eg cache.tar.zst")
+	cacheExportCmd.Flags().StringSliceVar(&exportRepos, "repos", nil, "export only the binaries of these repositories, by name or cache directory")
+	cacheExportCmd.Flags().StringSliceVar(&exportRVersions, "r-versions", nil, "export only the binaries for these versions of R, eg 4.2,4.3")
+	cacheExportCmd.Flags().BoolVar(&exportPlan, "plan", false, "export only the binaries of the packages the plan for the current configuration installs")
+	cacheExportCmd.MarkFlagRequired("out")
+	cacheCmd.AddCommand(cacheExportCmd)
+}
+
+// cacheManifestName is the name of the manifest, the first file in an archive of the cache
+const cacheManifestName = "pkgr-cache-manifest.json"
+
+// cacheManifestVersion is the version of the format of the manifest
+const cacheManifestVersion = 1
+
+// cacheManifest lists the files in an archive of the cache
+type cacheManifest struct {
+	Version     int                 `json:"version"`
+	PkgrVersion string              `json:"pkgr_version"`
+	Created     time.Time           `json:"created"`
+	Repos       []cachedRepo        `json:"repos"`
+	Files       []cacheManifestFile `json:"files"`
+}
+
+// cacheManifestFile is a binary in an archive of the cache
+type cacheManifestFile struct {
+	// Path is the path of the file in the cache and the archive, with forward slashes
+	Path     string    `json:"path"`
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	RVersion string    `json:"r_version"`
+	Dir      string    `json:"dir"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Origin   string    `json:"origin,omitempty"`
+	Modified time.Time `json:"modified"`
+	// Platform is the platform a binary built by pkgr was built on
+	Platform *cran.BinaryPlatform `json:"platform,omitempty"`
+}
+
+// cacheExportFilter limits the binaries exported
+type cacheExportFilter struct {
+	// Repos are repository names or cache directories
+	Repos     []string
+	RVersions []string
+	// Packages holds the cache directory, package and version of each package
+	// to export, if set
+	Packages map[string]bool
+}
+
+func rCacheExport(cmd *cobra.Command, args []string) error {
+	cachePath := userCache(cfg.Cache)
+	filter := cacheExportFilter{Repos: exportRepos, RVersions: exportRVersions}
+	if exportPlan {
+		rs := rcmd.NewRSettings(cfg.RPath)
+		rv := rcmd.GetRVersion(&rs)
+		_, installPlan, _ := planInstall(rv, rs.Platform, false)
+		filter.Packages = make(map[string]bool)
+		for _, d := range installPlan.PackageDownloads {
+			filter.Packages[planPackageKey(cran.RepoURLHash(d.Config.Repo), d.Package.Package, d.Package.Version)] = true
+		}
+	}
+	listing := listCache(fs, cachePath, cran.OpenCacheIndex(fs, cachePath), configuredRepos())
+	manifest, err := exportCache(fs, cachePath, listing, filter, exportOut)
+	if err != nil {
+		log.WithField("out", exportOut).Fatal(err)
+	}
+	log.WithFields(log.Fields{
+		"out":      exportOut,
+		"binaries": len(manifest.Files),
+	}).Info("exported cache")
+	return nil
+}
+
+func planPackageKey(dir string, pkg string, version string) string {
+	return dir + "/" + pkg + "/" + version
+}
+
+// keep tells if a binary passes the filter
+func (f cacheExportFilter) keep(a cachedArtifact) bool {
+	if a.Type != "binary" {
+		return false
+	}
+	if len(f.Repos) > 0 && !stringInSlice(a.Repo, f.Repos) && !stringInSlice(a.Dir, f.Repos) {
+		return false
+	}
+	if len(f.RVersions) > 0 && !stringInSlice(a.RVersion, f.RVersions) {
+		return false
+	}
+	if f.Packages != nil && !f.Packages[planPackageKey(a.Dir, a.Package, a.Version)] {
+		return false
+	}
+	return true
+}
+
+// exportCache writes the binaries in the cache that pass the filter to a
+// zstandard-compressed tar archive, the manifest first, returning the manifest.
+// The archive is written alongside out and renamed once complete.
+func exportCache(fs afero.Fs, cacheDirectory string, listing cacheListing, filter cacheExportFilter, out string) (cacheManifest, error) {
+	manifest := cacheManifest{
+		Version:     cacheManifestVersion,
+		PkgrVersion: VERSION,
+		Created:     time.Now().UTC(),
+		Repos:       []cachedRepo{},
+		Files:       []cacheManifestFile{},
+	}
+	dirs := make(map[string]bool)
+	for _, a := range listing.Packages {
+		if !filter.keep(a) {
+			continue
+		}
+		rel, err := filepath.Rel(cacheDirectory, a.Path)
+		if err != nil {
+			return manifest, err
+		}
+		f := cacheManifestFile{
+			Path:     filepath.ToSlash(rel),
+			Package:  a.Package,
+			Version:  a.Version,
+			RVersion: a.RVersion,
+			Dir:      a.Dir,
+		}
+		if a.Origin != "unknown" {
+			f.Origin = a.Origin
+		}
+		fi, err := fs.Stat(a.Path)
+		if err != nil {
+			return manifest, err
+		}
+		f.Size, f.Modified = fi.Size(), fi.ModTime().UTC()
+		if f.SHA256, err = sha256File(fs, a.Path); err != nil {
+			return manifest, err
+		}
+		if platform, err := cran.ReadPlatformFile(fs, a.Path); err == nil {
+			f.Platform = &platform
+		}
+		manifest.Files = append(manifest.Files, f)
+		dirs[a.Dir] = true
+	}
+	for _, r := range listing.Repos {
+		if dirs[r.Dir] {
+			manifest.Repos = append(manifest.Repos, r)
+		}
+	}
+
+	err := fsutil.WriteFileAtomic(fs, out, 0644, func(w io.Writer) error {
+		return writeCacheArchive(fs, w, cacheDirectory, manifest)
+	})
+	return manifest, err
+}
+
+func writeCacheArchive(fs afero.Fs, w io.Writer, cacheDirectory string, manifest cacheManifest) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    cacheManifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: manifest.Created,
+	})
+	if err == nil {
+		_, err = tw.Write(b)
+	}
+	for _, f := range manifest.Files {
+		if err != nil {
+			break
+		}
+		err = addArchiveFile(fs, tw, filepath.Join(cacheDirectory, filepath.FromSlash(f.Path)), f)
+	}
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func addArchiveFile(fs afero.Fs, tw *tar.Writer, path string, f cacheManifestFile) error {
+	in, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:    f.Path,
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: f.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	// the file must not have changed since its checksum was taken
+	n, err := io.Copy(tw, io.LimitReader(in, f.Size))
+	if err == nil && n != f.Size {
+		err = fmt.Errorf("%s changed while it was exported", f.Path)
+	}
+	return err
+}
+
+// sha256File provides the SHA256 checksum of a file, in hex
+func sha256File(fs afero.Fs, path string) (string, error) {
+	in, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validCachePath tells if a path in a manifest is the path of a binary in the
+// cache, so an archive can only write to its place for binaries
+func validCachePath(f cacheManifestFile) bool {
+	if f.Path == "" || strings.HasPrefix(f.Path, "/") || strings.Contains(f.Path, "\\") {
+		return false
+	}
+	parts := strings.Split(f.Path, "/")
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return false
+		}
+	}
+	if len(parts) != 4 && len(parts) != 5 {
+		return false
+	}
+	if parts[0] != f.Dir || !repoDirPattern.MatchString(parts[0]) || parts[1] != "binary" || parts[2] != f.RVersion {
+		return false
+	}
+	// a binary built by pkgr is in the directory for the platform it was built on
+	if len(parts) == 5 && (f.Platform == nil || parts[3] != f.Platform.Key()) {
+		return false
+	}
+	pkg, version, ok := parsePackageFileName(parts[len(parts)-1])
+	return ok && pkg == f.Package && version == f.Version
+}
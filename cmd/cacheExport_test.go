@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+func TestExportImportCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cranRepo := cran.RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	cranDir := cran.RepoURLHash(cranRepo)
+	platform := cran.BinaryPlatform{OS: "linux", Distro: "ubuntu", DistroVersion: "22.04", Arch: "amd64", RPlatform: "x86_64-pc-linux-gnu"}
+	built := filepath.Join("/cache", cranDir, "binary", "4.3", platform.Key(), "R6_2.5.1_R_x86_64-pc-linux-gnu.tar.gz")
+	downloaded := filepath.Join("/cache", cranDir, "binary", "4.2", "R6_2.5.1.tgz")
+	require.NoError(t, afero.WriteFile(fs, built, []byte("built binary"), 0644))
+	require.NoError(t, cran.WritePlatformFile(fs, built, platform))
+	require.NoError(t, afero.WriteFile(fs, downloaded, []byte("downloaded binary"), 0644))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join("/cache", cranDir, "src", "R6_2.5.1.tar.gz"), []byte("source"), 0644))
+	index := cran.OpenCacheIndex(fs, "/cache")
+	index.RecordRepo(cranRepo)
+	index.Record(built, cran.OriginBuilt)
+	index.Record(downloaded, cran.OriginDownloaded)
+	require.NoError(t, index.Save())
+
+	listing := listCache(fs, "/cache", cran.OpenCacheIndex(fs, "/cache"), nil)
+	manifest, err := exportCache(fs, "/cache", listing, cacheExportFilter{}, "/out/cache.tar.zst")
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 2)
+	assert.Equal(t, []cachedRepo{{Dir: cranDir, Repo: "CRAN", URL: "https://cran.example.com"}}, manifest.Repos)
+
+	imported := cran.OpenCacheIndex(fs, "/other")
+	result, err := importCache(fs, "/out/cache.tar.zst", "/other", imported)
+	require.NoError(t, err)
+	require.NoError(t, imported.Save())
+	assert.Equal(t, cacheImportResult{Added: 2}, result)
+
+	for _, path := range []string{built, downloaded} {
+		want, _ := afero.ReadFile(fs, path)
+		rel, _ := filepath.Rel("/cache", path)
+		got, err := afero.ReadFile(fs, filepath.Join("/other", rel))
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	rel, _ := filepath.Rel("/cache", built)
+	importedPlatform, err := cran.ReadPlatformFile(fs, filepath.Join("/other", rel))
+	require.NoError(t, err)
+	assert.Equal(t, platform, importedPlatform)
+	exists, _ := afero.Exists(fs, filepath.Join("/other", cranDir, "src", "R6_2.5.1.tar.gz"))
+	assert.False(t, exists, "source packages are not exported")
+
+	reopened := cran.OpenCacheIndex(fs, "/other")
+	assert.Equal(t, cran.OriginBuilt, reopened.Origin(filepath.Join("/other", rel)))
+	url, found := reopened.RepoURL(cranDir)
+	assert.True(t, found)
+	assert.Equal(t, "https://cran.example.com", url)
+
+	// importing again keeps the binaries already in the cache
+	result, err = importCache(fs, "/out/cache.tar.zst", "/other", reopened)
+	require.NoError(t, err)
+	assert.Equal(t, cacheImportResult{Kept: 2}, result)
+}
+
+func TestExportCacheFilter(t *testing.T) {
+	listing := cacheListing{Packages: []cachedArtifact{
+		{Package: "R6", Version: "2.5.1", Type: "src", Repo: "CRAN", Dir: "CRAN-0123456789ab"},
+		{Package: "R6", Version: "2.5.1", Type: "binary", RVersion: "4.2", Repo: "CRAN", Dir: "CRAN-0123456789ab"},
+		{Package: "R6", Version: "2.5.1", Type: "binary", RVersion: "4.3", Repo: "CRAN", Dir: "CRAN-0123456789ab"},
+		{Package: "glue", Version: "1.6.2", Type: "binary", RVersion: "4.3", Repo: "MPN", Dir: "MPN-ba9876543210"},
+	}}
+	tests := []struct {
+		name   string
+		filter cacheExportFilter
+		want   []int
+	}{
+		{"all binaries", cacheExportFilter{}, []int{1, 2, 3}},
+		{"repo name", cacheExportFilter{Repos: []string{"MPN"}}, []int{3}},
+		{"repo directory", cacheExportFilter{Repos: []string{"CRAN-0123456789ab"}}, []int{1, 2}},
+		{"R version", cacheExportFilter{RVersions: []string{"4.3"}}, []int{2, 3}},
+		{"plan", cacheExportFilter{Packages: map[string]bool{planPackageKey("MPN-ba9876543210", "glue", "1.6.2"): true}}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for i, a := range listing.Packages {
+				if tt.filter.keep(a) {
+					got = append(got, i)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// writeTestArchive writes an archive of the cache with the manifest and files given
+func writeTestArchive(t *testing.T, fs afero.Fs, path string, manifest cacheManifest, files map[string][]byte) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	tw := tar.NewWriter(zw)
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: cacheManifestName, Mode: 0644, Size: int64(len(b))}))
+	_, err = tw.Write(b)
+	require.NoError(t, err)
+	for _, f := range manifest.Files {
+		content, found := files[f.Path]
+		if !found {
+			continue
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.Path, Mode: 0644, Size: int64(len(content))}))
+		_, err = tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	require.NoError(t, afero.WriteFile(fs, path, buf.Bytes(), 0644))
+}
+
+func testManifestFile(path string, content []byte, modified time.Time) cacheManifestFile {
+	sum := sha256.Sum256(content)
+	return cacheManifestFile{
+		Path:     path,
+		Package:  "R6",
+		Version:  "2.5.1",
+		RVersion: "4.3",
+		Dir:      "CRAN-0123456789ab",
+		Size:     int64(len(content)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Origin:   cran.OriginDownloaded,
+		Modified: modified,
+	}
+}
+
+func TestImportCacheRejectsInvalidArchives(t *testing.T) {
+	const path = "CRAN-0123456789ab/binary/4.3/R6_2.5.1.tgz"
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	content := []byte("binary")
+	valid := testManifestFile(path, content, modified)
+	tampered := valid
+	tampered.SHA256 = hex.EncodeToString(make([]byte, 32))
+	traversal := testManifestFile("CRAN-0123456789ab/binary/4.3/../../../etc/R6_2.5.1.tgz", content, modified)
+	platformDir := testManifestFile("CRAN-0123456789ab/binary/4.3/ubuntu-22.04_x86_64-pc-linux-gnu/R6_2.5.1.tgz", content, modified)
+
+	tests := []struct {
+		name     string
+		manifest cacheManifest
+		files    map[string][]byte
+		wantErr  string
+	}{
+		{"checksum", cacheManifest{Version: 1, Files: []cacheManifestFile{tampered}}, map[string][]byte{path: content}, "does not match the checksum"},
+		{"path traversal", cacheManifest{Version: 1, Files: []cacheManifestFile{traversal}}, map[string][]byte{traversal.Path: content}, "invalid manifest"},
+		{"platform missing", cacheManifest{Version: 1, Files: []cacheManifestFile{platformDir}}, map[string][]byte{platformDir.Path: content}, "invalid manifest"},
+		{"file missing", cacheManifest{Version: 1, Files: []cacheManifestFile{valid}}, nil, "missing"},
+		{"manifest version", cacheManifest{Version: 2, Files: []cacheManifestFile{valid}}, map[string][]byte{path: content}, "unsupported manifest version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			writeTestArchive(t, fs, "/cache.tar.zst", tt.manifest, tt.files)
+			_, err := importCache(fs, "/cache.tar.zst", "/cache", cran.OpenCacheIndex(fs, "/cache"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+			exists, _ := afero.Exists(fs, filepath.Join("/cache", filepath.FromSlash(path)))
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestImportCacheAddsNothingFromAlteredArchive(t *testing.T) {
+	const first = "CRAN-0123456789ab/binary/4.3/R6_2.5.1.tgz"
+	const second = "CRAN-0123456789ab/binary/4.3/glue_1.6.2.tgz"
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	content := []byte("binary")
+	tampered := testManifestFile(second, content, modified)
+	tampered.Package, tampered.Version = "glue", "1.6.2"
+	tampered.SHA256 = hex.EncodeToString(make([]byte, 32))
+	manifest := cacheManifest{
+		Version: 1,
+		Repos:   []cachedRepo{{Dir: "CRAN-0123456789ab", Repo: "CRAN", URL: "https://cran.example.com"}},
+		Files:   []cacheManifestFile{testManifestFile(first, content, modified), tampered},
+	}
+	fs := afero.NewMemMapFs()
+	writeTestArchive(t, fs, "/cache.tar.zst", manifest, map[string][]byte{first: content, second: content})
+
+	index := cran.OpenCacheIndex(fs, "/cache")
+	_, err := importCache(fs, "/cache.tar.zst", "/cache", index)
+	require.Error(t, err)
+	require.NoError(t, index.Save())
+
+	// the binary before the altered one is not added either
+	exists, _ := afero.Exists(fs, filepath.Join("/cache", filepath.FromSlash(first)))
+	assert.False(t, exists)
+	_, recorded := cran.OpenCacheIndex(fs, "/cache").LastUsed(filepath.Join("/cache", filepath.FromSlash(first)))
+	assert.False(t, recorded)
+	entries, _ := afero.ReadDir(fs, "/cache")
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), "pkgr-import", "the staging directory is removed")
+	}
+}
+
+func TestImportCacheKeepsNewerBinaries(t *testing.T) {
+	const path = "CRAN-0123456789ab/binary/4.3/R6_2.5.1.tgz"
+	exported := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	content := []byte("exported binary")
+	dest := filepath.Join("/cache", filepath.FromSlash(path))
+
+	tests := []struct {
+		name     string
+		local    time.Time
+		want     string
+		wantTime time.Time
+		result   cacheImportResult
+	}{
+		{"newer local binary kept", exported.Add(time.Hour), "local binary", exported.Add(time.Hour), cacheImportResult{Kept: 1}},
+		{"same age local binary kept", exported, "local binary", exported, cacheImportResult{Kept: 1}},
+		{"older local binary replaced", exported.Add(-time.Hour), "exported binary", exported, cacheImportResult{Replaced: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, dest, []byte("local binary"), 0644))
+			require.NoError(t, fs.Chtimes(dest, tt.local, tt.local))
+			writeTestArchive(t, fs, "/cache.tar.zst", cacheManifest{Version: 1, Files: []cacheManifestFile{testManifestFile(path, content, exported)}}, map[string][]byte{path: content})
+
+			result, err := importCache(fs, "/cache.tar.zst", "/cache", cran.OpenCacheIndex(fs, "/cache"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.result, result)
+			got, _ := afero.ReadFile(fs, dest)
+			assert.Equal(t, tt.want, string(got))
+			fi, err := fs.Stat(dest)
+			require.NoError(t, err)
+			assert.True(t, tt.wantTime.Equal(fi.ModTime()))
+		})
+	}
+}
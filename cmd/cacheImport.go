@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+var cacheImportCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import binaries exported from another cache",
+	Long: `Add the binaries in an archive written by 'pkgr cache export' to the cache.
+
+The manifest of the archive is validated, and each binary is checked against
+the size and SHA256 checksum the manifest lists before any is added, so
+nothing is added from an archive that is incomplete or has been altered.
+
+Binaries are added in the place they had in the exported cache. A binary
+already in the cache is kept, unless the one in the archive was written more
+recently. Binaries built by pkgr keep the record of the platform they were
+built on, and are only installed on that platform.`,
+	Example: `  # Add the binaries exported by another runner to the cache
+  pkgr cache import cache.tar.zst`,
+	Args: cobra.ExactArgs(1),
+	RunE: rCacheImport,
+}
+
+func init() {
+	cacheCmd.AddCommand(cacheImportCmd)
+}
+
+// cacheImportResult summarizes the binaries imported to the cache
+type cacheImportResult struct {
+	Added    int
+	Replaced int
+	Kept     int
+}
+
+func rCacheImport(cmd *cobra.Command, args []string) error {
+	cachePath := userCache(cfg.Cache)
+	index := cran.OpenCacheIndex(fs, cachePath)
+	result, err := importCache(fs, args[0], cachePath, index)
+	if saveErr := index.Save(); saveErr != nil {
+		log.WithField("error", saveErr).Warn("could not save cache index")
+	}
+	if err != nil {
+		log.WithField("archive", args[0]).Fatal(err)
+	}
+	log.WithFields(log.Fields{
+		"archive":  args[0],
+		"added":    result.Added,
+		"replaced": result.Replaced,
+		"kept":     result.Kept,
+	}).Info("imported cache")
+	return nil
+}
+
+// importCache adds the binaries in an archive of a cache to the cache in
+// cacheDirectory. Every binary is first written to a staging directory in the
+// cache and checked against the manifest, so nothing is added from an archive
+// that is incomplete or altered. Each is then moved to its place under the lock
+// for it. A binary already in the cache is only replaced by one written more
+// recently.
+func importCache(fs afero.Fs, archive string, cacheDirectory string, index *cran.CacheIndex) (cacheImportResult, error) {
+	var result cacheImportResult
+	in, err := fs.Open(archive)
+	if err != nil {
+		return result, err
+	}
+	defer in.Close()
+	zr, err := zstd.NewReader(in)
+	if err != nil {
+		return result, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	manifest, err := readCacheManifest(tr)
+	if err != nil {
+		return result, err
+	}
+	files := make(map[string]cacheManifestFile)
+	for _, f := range manifest.Files {
+		if !validCachePath(f) {
+			return result, fmt.Errorf("invalid manifest: %s is not the path of a binary in the cache", f.Path)
+		}
+		files[f.Path] = f
+	}
+
+	if err := fs.MkdirAll(cacheDirectory, 0777); err != nil {
+		return result, err
+	}
+	// in the cache, so binaries are moved from it to their place by a rename
+	staging, err := afero.TempDir(fs, cacheDirectory, "pkgr-import")
+	if err != nil {
+		return result, err
+	}
+	defer fs.RemoveAll(staging)
+	staged := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		f, listed := files[hdr.Name]
+		if _, found := staged[hdr.Name]; !listed || found {
+			return result, fmt.Errorf("invalid archive: %s is not listed in the manifest", hdr.Name)
+		}
+		path := filepath.Join(staging, strconv.Itoa(len(staged)))
+		if err := stageCacheFile(fs, tr, path, f); err != nil {
+			return result, err
+		}
+		staged[hdr.Name] = path
+	}
+	if len(staged) != len(files) {
+		return result, fmt.Errorf("invalid archive: %d of the %d files in the manifest are missing", len(files)-len(staged), len(files))
+	}
+
+	for _, r := range manifest.Repos {
+		index.RecordRepoURL(r.Dir, r.URL)
+	}
+	for _, f := range manifest.Files {
+		added, replaced, err := placeCacheFile(fs, staged[f.Path], cacheDirectory, f)
+		if err != nil {
+			return result, err
+		}
+		path := filepath.Join(cacheDirectory, filepath.FromSlash(f.Path))
+		switch {
+		case added:
+			result.Added++
+			index.Record(path, f.Origin)
+		case replaced:
+			result.Replaced++
+			index.Record(path, f.Origin)
+		default:
+			result.Kept++
+		}
+	}
+	return result, nil
+}
+
+func readCacheManifest(tr *tar.Reader) (cacheManifest, error) {
+	var manifest cacheManifest
+	hdr, err := tr.Next()
+	if err != nil {
+		return manifest, fmt.Errorf("invalid archive: %w", err)
+	}
+	if hdr.Name != cacheManifestName {
+		return manifest, fmt.Errorf("invalid archive: the first file is %s rather than the manifest", hdr.Name)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != cacheManifestVersion {
+		return manifest, fmt.Errorf("unsupported manifest version %d, this version of pkgr reads version %d", manifest.Version, cacheManifestVersion)
+	}
+	return manifest, nil
+}
+
+// stageCacheFile writes a binary from the archive to the staging directory,
+// checking it against the size and checksum in the manifest
+func stageCacheFile(fs afero.Fs, r io.Reader, path string, f cacheManifestFile) error {
+	out, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (n != f.Size || hex.EncodeToString(h.Sum(nil)) != f.SHA256) {
+		err = fmt.Errorf("%s does not match the checksum in the manifest", f.Path)
+	}
+	if err == nil {
+		err = fs.Chtimes(path, f.Modified, f.Modified)
+	}
+	return err
+}
+
+// placeCacheFile moves a staged binary to its place in the cache, unless a
+// binary at least as recent is already there
+func placeCacheFile(fs afero.Fs, staged string, cacheDirectory string, f cacheManifestFile) (added bool, replaced bool, err error) {
+	dest := filepath.Join(cacheDirectory, filepath.FromSlash(f.Path))
+	if err := fs.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return false, false, err
+	}
+	lock, err := cran.LockFile(fs, dest)
+	if err != nil {
+		return false, false, err
+	}
+	defer lock.Unlock()
+	existing, statErr := fs.Stat(dest)
+	if statErr == nil && !f.Modified.After(existing.ModTime()) {
+		log.WithField("file", dest).Debug("keeping binary already in the cache")
+		return false, false, nil
+	}
+	if err := fs.Rename(staged, dest); err != nil {
+		return false, false, err
+	}
+	if f.Platform != nil {
+		if err := cran.WritePlatformFile(fs, dest, *f.Platform); err != nil {
+			return false, false, err
+		}
+	} else {
+		fs.Remove(dest + cran.PlatformFileSuffix)
+	}
+	log.WithField("file", dest).Debug("imported binary")
+	return statErr != nil, statErr == nil, nil
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+var cacheInfoCmd = &cobra.Command{
+	Use:   "info <package>",
+	Short: "Show the cached files for a package",
+	Long: `Show every file in the cache for a package: each version, as source and
+as binaries for each version of R, from each repository, along with its size,
+where it came from, when it was last used and its path.`,
+	Example: `  # Show the cached files for R6
+  pkgr cache info R6`,
+	Args: cobra.ExactArgs(1),
+	RunE: rCacheInfo,
+}
+
+func init() {
+	cacheInfoCmd.Flags().BoolVar(&cacheJSON, "json", false, "print the files as JSON")
+	cacheCmd.AddCommand(cacheInfoCmd)
+}
+
+func rCacheInfo(cmd *cobra.Command, args []string) error {
+	cachePath := userCache(cfg.Cache)
+	listing := packageCacheListing(listCache(fs, cachePath, cran.OpenCacheIndex(fs, cachePath), configuredRepos()), args[0])
+	if len(listing.Packages) == 0 && !cacheJSON {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is not in the cache\n", args[0])
+		return nil
+	}
+	return printCacheListing(cmd.OutOrStdout(), listing, cacheJSON, true)
+}
+
+// packageCacheListing limits a listing of the cache to the files of a package,
+// and the repositories they came from
+func packageCacheListing(listing cacheListing, pkg string) cacheListing {
+	result := cacheListing{Repos: []cachedRepo{}, Packages: []cachedArtifact{}}
+	dirs := make(map[string]bool)
+	for _, a := range listing.Packages {
+		if a.Package == pkg {
+			result.Packages = append(result.Packages, a)
+			dirs[a.Dir] = true
+		}
+	}
+	for _, r := range listing.Repos {
+		if dirs[r.Dir] {
+			result.Repos = append(result.Repos, r)
+		}
+	}
+	return result
+}
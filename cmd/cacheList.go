@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+var cacheJSON bool
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the packages in the cache",
+	Long: `List every package in the cache, along with the repository it came from,
+its type, its size, where it came from and when it was last used.
+
+Source packages have the type src. Binary packages have the type binary and
+the version of R they are for, and came either from their repository
+(downloaded) or from building the source package while installing it (built).
+Binaries built by pkgr are also listed with the platform they were built on,
+the Linux distribution and version or operating system along with the R
+platform, and are only installed on that platform.
+Binaries cached before pkgr recorded where they came from are listed as
+unknown.
+
+Each directory of the cache is named by its repository and a hash of the
+repository URL, and is listed along with the URL it holds the packages of.`,
+	Example: `  # List the packages in the cache
+  pkgr cache list
+  # List the packages in the cache as JSON
+  pkgr cache list --json`,
+	RunE: rCacheList,
+}
+
+func init() {
+	cacheListCmd.Flags().BoolVar(&cacheJSON, "json", false, "print the packages as JSON")
+	cacheCmd.AddCommand(cacheListCmd)
+}
+
+// cachedRepo is a directory of the cache, which holds the packages of a repository
+type cachedRepo struct {
+	Dir  string `json:"dir"`
+	Repo string `json:"repo"`
+	URL  string `json:"url"`
+}
+
+// cachedArtifact is a package file in the cache
+type cachedArtifact struct {
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Type     string `json:"type"`
+	RVersion string `json:"r_version,omitempty"`
+	// Platform is the platform a binary built by pkgr was built on
+	Platform string    `json:"platform,omitempty"`
+	Repo     string    `json:"repo"`
+	Dir      string    `json:"dir"`
+	Size     int64     `json:"size"`
+	Origin   string    `json:"origin"`
+	LastUsed time.Time `json:"last_used"`
+	Path     string    `json:"path"`
+}
+
+// cacheListing is the contents of the cache
+type cacheListing struct {
+	Repos    []cachedRepo     `json:"repos"`
+	Packages []cachedArtifact `json:"packages"`
+}
+
+func rCacheList(cmd *cobra.Command, args []string) error {
+	cachePath := userCache(cfg.Cache)
+	listing := listCache(fs, cachePath, cran.OpenCacheIndex(fs, cachePath), configuredRepos())
+	return printCacheListing(cmd.OutOrStdout(), listing, cacheJSON, false)
+}
+
+// configuredRepos provides the repositories of the configuration, whose URLs
+// name the directories of the cache that the cache index has no record of
+func configuredRepos() []cran.RepoURL {
+	var repos []cran.RepoURL
+	for _, r := range cfg.Repos {
+		for nm, url := range r {
+			repos = append(repos, cran.RepoURL{Name: nm, URL: url})
+		}
+	}
+	return repos
+}
+
+// repoDirPattern matches the name of a directory of the cache, which is the
+// repository name and the start of the hash of its URL
+var repoDirPattern = regexp.MustCompile(`^(.+)-[0-9a-f]{12}$`)
+
+// listCache lists the packages in each repository directory of the cache, sorted
+// by package, version, type and version of R
+func listCache(fs afero.Fs, cacheDirectory string, index *cran.CacheIndex, configured []cran.RepoURL) cacheListing {
+	listing := cacheListing{Repos: []cachedRepo{}, Packages: []cachedArtifact{}}
+	byHash := make(map[string]cran.RepoURL)
+	for _, r := range configured {
+		byHash[cran.RepoURLHash(r)] = r
+	}
+	repoDirs, _ := afero.ReadDir(fs, cacheDirectory)
+	for _, d := range repoDirs {
+		m := repoDirPattern.FindStringSubmatch(d.Name())
+		if !d.IsDir() || m == nil {
+			continue
+		}
+		repo := cachedRepo{Dir: d.Name(), Repo: m[1]}
+		if url, found := index.RepoURL(d.Name()); found {
+			repo.URL = url
+		} else if r, found := byHash[d.Name()]; found {
+			repo.URL = cran.MaskURL(r.URL)
+		}
+		listing.Repos = append(listing.Repos, repo)
+	}
+	for _, p := range listCachedPackages(fs, cacheDirectory, index, nil, []string{"src", "binary"}) {
+		rel, err := filepath.Rel(cacheDirectory, p.Path)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		pkg, version, ok := parsePackageFileName(parts[len(parts)-1])
+		if !ok || repoDirPattern.FindStringSubmatch(parts[0]) == nil {
+			continue
+		}
+		a := cachedArtifact{
+			Package:  pkg,
+			Version:  version,
+			Type:     parts[1],
+			Repo:     repoDirPattern.FindStringSubmatch(parts[0])[1],
+			Dir:      parts[0],
+			Size:     p.Size,
+			Origin:   cran.OriginDownloaded,
+			LastUsed: p.LastUsed,
+			Path:     p.Path,
+		}
+		if a.Type == "binary" {
+			a.RVersion = parts[2]
+			if len(parts) > 4 {
+				a.Platform = parts[3]
+			}
+			a.Origin = index.Origin(p.Path)
+			if a.Origin == "" {
+				a.Origin = "unknown"
+			}
+		}
+		listing.Packages = append(listing.Packages, a)
+	}
+	sort.SliceStable(listing.Packages, func(i, j int) bool {
+		a, b := listing.Packages[i], listing.Packages[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Version != b.Version {
+			return desc.CompareVersionStrings(a.Version, b.Version) < 0
+		}
+		if a.Type != b.Type {
+			return a.Type > b.Type
+		}
+		if a.RVersion != b.RVersion {
+			return a.RVersion < b.RVersion
+		}
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		return a.Dir < b.Dir
+	})
+	return listing
+}
+
+// parsePackageFileName provides the package and version of a source or binary
+// package file, such as R6_2.5.1.tar.gz, R6_2.5.1.tgz, R6_2.5.1.zip or
+// R6_2.5.1_R_x86_64-pc-linux-gnu.tar.gz
+func parsePackageFileName(name string) (string, string, bool) {
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(name, ext), "_")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", false
+		}
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// printCacheListing prints the repositories and packages in the cache, with the
+// path to each package file if withPaths
+func printCacheListing(w io.Writer, listing cacheListing, asJSON bool, withPaths bool) error {
+	if asJSON {
+		b, err := JsonMarshal(listing)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTORY\tREPO\tURL")
+	for _, r := range listing.Repos {
+		url := r.URL
+		if url == "" {
+			url = "unknown"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Dir, r.Repo, url)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	header := "PACKAGE\tVERSION\tTYPE\tR\tPLATFORM\tREPO\tSIZE\tORIGIN\tLAST USED"
+	if withPaths {
+		header += "\tPATH"
+	}
+	fmt.Fprintln(tw, header)
+	for _, a := range listing.Packages {
+		rVersion := a.RVersion
+		if rVersion == "" {
+			rVersion = "-"
+		}
+		platform := a.Platform
+		if platform == "" {
+			platform = "-"
+		}
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", a.Package, a.Version, a.Type, rVersion, platform, a.Repo, formatSize(a.Size), a.Origin, a.LastUsed.Format("2006-01-02"))
+		if withPaths {
+			line += "\t" + a.Path
+		}
+		fmt.Fprintln(tw, line)
+	}
+	return tw.Flush()
+}
+
+// formatSize formats a number of bytes in the largest unit of at least one
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	s := float64(size)
+	i := 0
+	for s >= 1024 && i < len(units)-1 {
+		s /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", s, units[i])
+}
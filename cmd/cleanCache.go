@@ -16,13 +16,19 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 
 	"github.com/dpastoor/goutils"
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/rcmd"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -31,6 +37,10 @@ import (
 var srcOnly bool
 var binariesOnly bool
 var reposToClear string
+var verifyCache bool
+var olderThan string
+var maxCacheSize string
+var keepReferenced bool
 
 // cacheCmd represents the cache command
 var cleanCacheCmd = &cobra.Command{
@@ -43,9 +53,36 @@ is specified.
 By default, files for all repositories are deleted unless specific
 repositories are specified via the --repos option. Note that the value must
 match the directory name in the cache, including the unique ID that is
-appended to the repository name.`,
+appended to the repository name.
+
+If --verify is passed, nothing is deleted wholesale. Instead, cached source
+tarballs, and binaries downloaded for the version of R in use, are checked
+against the checksums in the repository package databases, and any that do
+not match are removed so they will be downloaded again. Files that are no
+longer listed by their repository, and binaries built by pkgr, are skipped.
+
+If --older-than, --max-size or --keep-referenced is passed, individual
+packages are removed rather than whole folders, by when they were last
+downloaded or installed from the cache:
+
+  --older-than removes packages not used for the given time, such as 90d,
+  12w or 36h.
+  --max-size then removes the packages used least recently until the
+  packages in the cache take up no more than the given size, such as 20GB.
+  --keep-referenced keeps the packages the plan for the current pkgr.yml
+  installs, whatever their age. Passed alone, every other package is
+  removed.
+
+The --repos, --src-only and --binaries-only options limit the packages
+considered.`,
 	Example: `  # Clean binary files for all repos
   pkgr clean cache --binaries-only
+  # Remove cached source tarballs that do not match their repository checksum
+  pkgr clean cache --verify
+  # Remove packages not used for 90 days, keeping those the current plan installs
+  pkgr clean cache --older-than 90d --keep-referenced
+  # Remove the packages used least recently until the cache is within 20GB
+  pkgr clean cache --max-size 20GB
   # Clean binaries files for MPN-889df4238bae repo
   pkgr clean cache --repos=MPN-889df4238bae --binaries-only`,
 	RunE: cache,
@@ -56,15 +93,368 @@ func init() {
 	cleanCacheCmd.Flags().BoolVar(&srcOnly, "src-only", false, "clean only source files from the cache")
 	cleanCacheCmd.Flags().BoolVar(&binariesOnly, "binaries-only", false, "clean only binary files from the cache")
 	cleanCacheCmd.Flags().StringVar(&reposToClear, "repos", "ALL", "comma-separated list of repositories to be cleaned. Defaults to all.")
+	cleanCacheCmd.Flags().BoolVar(&verifyCache, "verify", false, "remove only cached source tarballs and downloaded binaries that fail checksum verification")
+	cleanCacheCmd.Flags().StringVar(&olderThan, "older-than", "", "remove only packages not used for this long, such as 90d")
+	cleanCacheCmd.Flags().StringVar(&maxCacheSize, "max-size", "", "remove the packages used least recently until the cache is within this size, such as 20GB")
+	cleanCacheCmd.Flags().BoolVar(&keepReferenced, "keep-referenced", false, "keep the packages the plan for the current configuration installs")
 
 	CleanCmd.AddCommand(cleanCacheCmd)
 }
 
 func cache(cmd *cobra.Command, args []string) error {
+	if verifyCache {
+		return verifyCachedPackages()
+	}
+	if olderThan != "" || maxCacheSize != "" || keepReferenced {
+		return evictCachedPackages()
+	}
 	cleanCacheFolders()
 	return nil
 }
 
+// cacheVerification summarizes a checksum verification of the cache
+type cacheVerification struct {
+	Checked int
+	Removed int
+	Skipped int
+}
+
+// verifyCachedPackages re-checks the cached source tarballs and downloaded
+// binaries for the configured repositories against the repository checksums
+func verifyCachedPackages() error {
+	var repos []string
+	if reposToClear != "ALL" {
+		repos = strings.Split(reposToClear, ",")
+	}
+	rs := rcmd.NewRSettings(cfg.RPath)
+	pkgNexus := newPkgNexus(rs.Version, rs.Platform)
+	cachePath := userCache(cfg.Cache)
+	result := verifyCacheFiles(fs, cachePath, cran.OpenCacheIndex(fs, cachePath), pkgNexus.Db, repos, rs.Version)
+	log.WithFields(log.Fields{
+		"cache dir": cachePath,
+		"checked":   result.Checked,
+		"removed":   result.Removed,
+		"skipped":   result.Skipped,
+	}).Info("finished verifying cached packages")
+	return nil
+}
+
+// verifyCacheFiles checks each cached source tarball of the given repositories,
+// and each binary downloaded for the version of R, optionally limited to the
+// named cache directories, removing those that do not match the checksum in
+// the package database. Files the package database has no entry for, and
+// binaries built by pkgr, are skipped.
+func verifyCacheFiles(fs afero.Fs, cacheDirectory string, index *cran.CacheIndex, dbs []*cran.RepoDb, repos []string, rv cran.RVersion) cacheVerification {
+	var result cacheVerification
+	for _, db := range dbs {
+		if db == nil {
+			continue
+		}
+		repoFolder := cran.RepoURLHash(db.Repo)
+		if len(repos) > 0 && !stringInSlice(repoFolder, repos) {
+			continue
+		}
+		// the path in the cache of each package the repository lists
+		byPath := make(map[string]desc.Desc)
+		for _, st := range []cran.SourceType{cran.Source, cran.Binary} {
+			for _, versions := range db.DescriptionsBySourceType[st] {
+				for _, pd := range versions {
+					d := cran.PkgDl{Package: pd, Config: cran.PkgConfig{Repo: db.Repo, Type: st}}
+					byPath[cran.CachePath(d, cacheDirectory, rv)] = pd
+				}
+			}
+		}
+		for _, dir := range []string{
+			filepath.Join(cacheDirectory, repoFolder, "src"),
+			filepath.Join(cacheDirectory, repoFolder, "binary", rv.ToString()),
+		} {
+			files, err := afero.ReadDir(fs, dir)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				path := filepath.Join(dir, f.Name())
+				pd, known := byPath[path]
+				if !known || index.Origin(path) == cran.OriginBuilt {
+					log.WithFields(log.Fields{
+						"repo": db.Repo.Name,
+						"file": path,
+					}).Debug("no repository checksum for cached file, skipping")
+					result.Skipped++
+					continue
+				}
+				result.Checked++
+				err := cran.VerifyFile(fs, path, pd)
+				if err == nil {
+					continue
+				}
+				log.WithFields(log.Fields{
+					"repo":  db.Repo.Name,
+					"file":  path,
+					"error": err,
+				}).Warn("removing cached package that failed verification")
+				if removeCachedFile(fs, path) {
+					result.Removed++
+				}
+			}
+		}
+	}
+	return result
+}
+
+// removeCachedFile removes a package from the cache under its lock, unless
+// another process is using it
+func removeCachedFile(fs afero.Fs, path string) bool {
+	lock, err := cran.TryLockFile(fs, path)
+	if err != nil {
+		log.WithField("file", path).Error(err)
+		return false
+	}
+	if lock == nil {
+		log.WithField("file", path).Debug("skipping package in use by another process")
+		return false
+	}
+	defer lock.Unlock()
+	if err := fs.Remove(path); err != nil {
+		log.WithField("file", path).Error(err)
+		return false
+	}
+	return true
+}
+
+// cacheEviction controls which cached packages are removed
+type cacheEviction struct {
+	// Repos limits the packages to those of the named cache directories
+	Repos []string
+	// Subfolders are the folders of each repository considered, src and/or binary
+	Subfolders []string
+	// OlderThan removes packages not used for this long, if set
+	OlderThan time.Duration
+	// MaxSize removes the packages used least recently until the packages
+	// considered take up no more than this many bytes, if set
+	MaxSize int64
+	// Keep holds the paths of packages that are never removed. When neither
+	// OlderThan or MaxSize are set, every other package is removed.
+	Keep map[string]bool
+	Now  time.Time
+}
+
+// cacheEvictionResult summarizes the packages removed from the cache
+type cacheEvictionResult struct {
+	Removed   int
+	Freed     int64
+	Remaining int
+	Size      int64
+}
+
+// cachedPackage is a package file in the cache
+type cachedPackage struct {
+	Path     string
+	Size     int64
+	LastUsed time.Time
+}
+
+// evictCachedPackages removes packages from the cache by the time they were
+// last used and the size of the cache
+func evictCachedPackages() error {
+	ev := cacheEviction{Now: time.Now()}
+	if reposToClear != "ALL" {
+		ev.Repos = strings.Split(reposToClear, ",")
+	}
+	switch {
+	case srcOnly && binariesOnly:
+		return errors.New("invalid argument combination -- cannot combine srcOnly and binaryOnly flags")
+	case srcOnly:
+		ev.Subfolders = []string{"src"}
+	case binariesOnly:
+		ev.Subfolders = []string{"binary"}
+	default:
+		ev.Subfolders = []string{"src", "binary"}
+	}
+	var err error
+	if ev.OlderThan, err = parseAge(olderThan); err != nil {
+		return err
+	}
+	if ev.MaxSize, err = cran.ParseSize(maxCacheSize); err != nil {
+		return err
+	}
+	cachePath := userCache(cfg.Cache)
+	packageCache := rcmd.NewPackageCache(cachePath, false)
+	if keepReferenced {
+		rs := rcmd.NewRSettings(cfg.RPath)
+		rv := rcmd.GetRVersion(&rs)
+		packageCache.Platform = cran.CurrentBinaryPlatform(rs.Platform)
+		_, installPlan, _ := planInstall(rv, rs.Platform, false)
+		ev.Keep = make(map[string]bool)
+		for _, d := range installPlan.PackageDownloads {
+			ev.Keep[cran.CachePath(d, packageCache.BaseDir, rv)] = true
+			ev.Keep[packageCache.BinaryPath(d, rs)] = true
+		}
+	}
+	index := cran.OpenCacheIndex(fs, packageCache.BaseDir)
+	result := evictCacheFiles(fs, packageCache.BaseDir, index, ev)
+	if err := index.Save(); err != nil {
+		log.WithField("error", err).Warn("could not save cache index")
+	}
+	log.WithFields(log.Fields{
+		"cache dir": cachePath,
+		"removed":   result.Removed,
+		"freed":     fmt.Sprintf("%.2f MB", float64(result.Freed)/(1024*1024)),
+		"remaining": result.Remaining,
+		"size":      fmt.Sprintf("%.2f MB", float64(result.Size)/(1024*1024)),
+	}).Info("finished removing cached packages")
+	return nil
+}
+
+// evictCacheFiles removes the cached packages in cacheDirectory that have not
+// been used for ev.OlderThan, then those used least recently until the rest fit
+// in ev.MaxSize. A package the index has no record of was last used when its
+// file was last written to.
+func evictCacheFiles(fs afero.Fs, cacheDirectory string, index *cran.CacheIndex, ev cacheEviction) cacheEvictionResult {
+	var result cacheEvictionResult
+	pkgs := listCachedPackages(fs, cacheDirectory, index, ev.Repos, ev.Subfolders)
+	// those used least recently first
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].LastUsed.Before(pkgs[j].LastUsed)
+	})
+	for _, p := range pkgs {
+		result.Size += p.Size
+	}
+	remove := func(p cachedPackage, reason string) bool {
+		log.WithFields(log.Fields{
+			"file":      p.Path,
+			"last used": p.LastUsed.Format(time.RFC3339),
+		}).Debug(reason)
+		// held while removing, so a process about to use the package waits for it
+		if !removeCachedFile(fs, p.Path) {
+			return false
+		}
+		fs.Remove(p.Path + cran.PlatformFileSuffix)
+		result.Removed++
+		result.Freed += p.Size
+		result.Size -= p.Size
+		return true
+	}
+	var kept []cachedPackage
+	for _, p := range pkgs {
+		switch {
+		case ev.Keep[p.Path]:
+		case ev.OlderThan > 0 && ev.Now.Sub(p.LastUsed) > ev.OlderThan:
+			if remove(p, "removing package not used recently") {
+				continue
+			}
+		case ev.OlderThan == 0 && ev.MaxSize == 0 && ev.Keep != nil:
+			if remove(p, "removing package not referenced by the plan") {
+				continue
+			}
+		}
+		kept = append(kept, p)
+	}
+	result.Remaining = len(kept)
+	if ev.MaxSize > 0 {
+		for _, p := range kept {
+			if result.Size <= ev.MaxSize {
+				break
+			}
+			if ev.Keep[p.Path] {
+				continue
+			}
+			if remove(p, "removing package used least recently") {
+				result.Remaining--
+			}
+		}
+		if result.Size > ev.MaxSize {
+			log.WithFields(log.Fields{
+				"size":     result.Size,
+				"max size": ev.MaxSize,
+			}).Warn("packages referenced by the plan take up more than the maximum size of the cache")
+		}
+	}
+	return result
+}
+
+// listCachedPackages lists the package files in the given subfolders of the
+// repositories in the cache, optionally limited to the named cache directories.
+// Partial downloads and locks are left to be resumed or cleaned up by the next
+// download.
+func listCachedPackages(fs afero.Fs, cacheDirectory string, index *cran.CacheIndex, repos []string, subfolders []string) []cachedPackage {
+	var pkgs []cachedPackage
+	add := func(dir string) {
+		files, err := afero.ReadDir(fs, dir)
+		if err != nil {
+			return
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasSuffix(f.Name(), ".part") || strings.HasSuffix(f.Name(), ".tmp") || strings.HasSuffix(f.Name(), ".lock") || strings.HasSuffix(f.Name(), cran.PlatformFileSuffix) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			lastUsed, found := index.LastUsed(path)
+			if !found {
+				lastUsed = f.ModTime()
+			}
+			pkgs = append(pkgs, cachedPackage{Path: path, Size: f.Size(), LastUsed: lastUsed})
+		}
+	}
+	repoDirs, err := afero.ReadDir(fs, cacheDirectory)
+	if err != nil {
+		return nil
+	}
+	for _, repoDir := range repoDirs {
+		if !repoDir.IsDir() || (len(repos) > 0 && !stringInSlice(repoDir.Name(), repos)) {
+			continue
+		}
+		for _, subfolder := range subfolders {
+			dir := filepath.Join(cacheDirectory, repoDir.Name(), subfolder)
+			if subfolder != "binary" {
+				add(dir)
+				continue
+			}
+			// binaries are kept in a folder for each version of R, with those
+			// built by pkgr in a folder for the platform they were built on
+			versions, err := afero.ReadDir(fs, dir)
+			if err != nil {
+				continue
+			}
+			for _, v := range versions {
+				if !v.IsDir() {
+					continue
+				}
+				add(filepath.Join(dir, v.Name()))
+				platforms, _ := afero.ReadDir(fs, filepath.Join(dir, v.Name()))
+				for _, p := range platforms {
+					if p.IsDir() {
+						add(filepath.Join(dir, v.Name(), p.Name()))
+					}
+				}
+			}
+		}
+	}
+	return pkgs
+}
+
+// parseAge parses a duration such as 90d or 12w, as well as any duration
+// time.ParseDuration accepts, such as 36h. An empty string is no duration.
+func parseAge(age string) (time.Duration, error) {
+	s := strings.TrimSpace(age)
+	if s == "" {
+		return 0, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64); strings.HasSuffix(s, suffix) && err == nil && n >= 0 {
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected a duration such as 90d, 12w or 36h", age)
+	}
+	return d, nil
+}
+
 func cleanCacheFolders() error {
 	cachePath := userCache(cfg.Cache)
 	var repos []string // make empty
@@ -1,11 +1,19 @@
 package cmd
 
 import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
 	"github.com/metrumresearchgroup/pkgr/testhelper"
 	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 type CleanCacheSuite struct {
@@ -104,3 +112,171 @@ func (suite *CleanCacheSuite) TestCleanCache_DeletesSpecificRepos() {
 	suite.False(afero.Exists(suite.FileSystemOs, repo3)) //r_validated should be deleted
 
 }
+
+func TestVerifyCacheFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	good := []byte("good tarball")
+	goodSum := fmt.Sprintf("%x", md5.Sum(good))
+	repo := cran.RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	rv := cran.RVersion{Major: 4, Minor: 3, Patch: 1}
+	db := &cran.RepoDb{
+		Repo: repo,
+		DescriptionsBySourceType: map[cran.SourceType]map[string][]desc.Desc{
+			cran.Source: {
+				"R6":    {{Package: "R6", Version: "2.5.1", MD5sum: goodSum}},
+				"rlang": {{Package: "rlang", Version: "1.1.1", MD5sum: goodSum}},
+			},
+			cran.Binary: {
+				"R6":   {{Package: "R6", Version: "2.5.1", MD5sum: goodSum}},
+				"glue": {{Package: "glue", Version: "1.6.2", MD5sum: goodSum}},
+				"cli":  {{Package: "cli", Version: "3.6.1", MD5sum: goodSum}},
+			},
+		},
+	}
+	binaryPath := func(pkg, version string) string {
+		d := cran.PkgDl{Package: desc.Desc{Package: pkg, Version: version}, Config: cran.PkgConfig{Repo: repo, Type: cran.Binary}}
+		return cran.CachePath(d, "/cache", rv)
+	}
+	srcDir := filepath.Join("/cache", cran.RepoURLHash(repo), "src")
+	files := map[string][]byte{
+		filepath.Join(srcDir, "R6_2.5.1.tar.gz"):    good,
+		filepath.Join(srcDir, "rlang_1.1.1.tar.gz"): []byte("truncated"),
+		filepath.Join(srcDir, "rlang_0.4.0.tar.gz"): []byte("unlisted"),
+		binaryPath("R6", "2.5.1"):                   good,
+		binaryPath("glue", "1.6.2"):                 []byte("truncated"),
+		// built by pkgr, so not the binary the repository lists
+		binaryPath("cli", "3.6.1"): []byte("built"),
+		// for another version of R, whose binaries the database does not list
+		filepath.Join("/cache", cran.RepoURLHash(repo), "binary", "4.2", filepath.Base(binaryPath("glue", "1.6.2"))): []byte("truncated"),
+	}
+	for path, content := range files {
+		require.NoError(t, afero.WriteFile(fs, path, content, 0644))
+	}
+	index := cran.OpenCacheIndex(fs, "/cache")
+	index.Record(binaryPath("cli", "3.6.1"), cran.OriginBuilt)
+
+	assert.Equal(t, cacheVerification{}, verifyCacheFiles(fs, "/cache", index, []*cran.RepoDb{db}, []string{"other-repo"}, rv))
+
+	result := verifyCacheFiles(fs, "/cache", index, []*cran.RepoDb{db}, nil, rv)
+	assert.Equal(t, cacheVerification{Checked: 4, Removed: 2, Skipped: 2}, result)
+	removed := map[string]bool{
+		filepath.Join(srcDir, "rlang_1.1.1.tar.gz"): true,
+		binaryPath("glue", "1.6.2"):                 true,
+	}
+	for path := range files {
+		found, _ := afero.Exists(fs, path)
+		assert.Equal(t, !removed[path], found, path)
+	}
+}
+
+func TestEvictCacheFiles(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	src := filepath.Join("/cache", "CRAN-abc", "src")
+	bin := filepath.Join("/cache", "CRAN-abc", "binary", "4.2")
+	// 100 bytes each, by the days since they were last used
+	files := map[string]time.Duration{
+		filepath.Join(src, "R6_2.5.1.tar.gz"):                        200 * day,
+		filepath.Join(src, "cli_3.6.1.tar.gz"):                       100 * day,
+		filepath.Join(src, "glue_1.6.2.tar.gz"):                      10 * day,
+		filepath.Join(bin, "glue_1.6.2_R_x86_64.tar.gz"):             5 * day,
+		filepath.Join(src, "rlang_1.0.6.tar.gz.part"):                300 * day,
+		filepath.Join("/cache", "MPN-def", "src", "R6_2.4.0.tar.gz"): 300 * day,
+	}
+	setup := func(t *testing.T) (afero.Fs, *cran.CacheIndex) {
+		fs := afero.NewMemMapFs()
+		lastUsed := make(map[string]time.Time)
+		for path, age := range files {
+			require.NoError(t, afero.WriteFile(fs, path, make([]byte, 100), 0644))
+			// the index is the record of use, so written long ago
+			old := now.Add(-400 * day)
+			require.NoError(t, fs.Chtimes(path, old, old))
+			if age != 300*day {
+				rel, _ := filepath.Rel("/cache", path)
+				lastUsed[filepath.ToSlash(rel)] = now.Add(-age)
+			}
+		}
+		b, err := json.Marshal(map[string]interface{}{"last_used": lastUsed})
+		require.NoError(t, err)
+		require.NoError(t, afero.WriteFile(fs, filepath.Join("/cache", cran.CacheIndexFile), b, 0644))
+		return fs, cran.OpenCacheIndex(fs, "/cache")
+	}
+	remaining := func(fs afero.Fs) []string {
+		var left []string
+		for path := range files {
+			if exists, _ := afero.Exists(fs, path); exists {
+				left = append(left, filepath.Base(path))
+			}
+		}
+		return left
+	}
+	all := []string{"src", "binary"}
+
+	t.Run("older than", func(t *testing.T) {
+		fs, index := setup(t)
+		result := evictCacheFiles(fs, "/cache", index, cacheEviction{Repos: []string{"CRAN-abc"}, Subfolders: all, OlderThan: 90 * day, Now: now})
+		assert.Equal(t, cacheEvictionResult{Removed: 2, Freed: 200, Remaining: 2, Size: 200}, result)
+		assert.ElementsMatch(t, []string{"glue_1.6.2.tar.gz", "glue_1.6.2_R_x86_64.tar.gz", "rlang_1.0.6.tar.gz.part", "R6_2.4.0.tar.gz"}, remaining(fs))
+		// the locks taken while removing are released
+		locked, _ := afero.Exists(fs, filepath.Join(src, "cli_3.6.1.tar.gz.lock"))
+		assert.False(t, locked)
+	})
+	t.Run("max size removes those used least recently", func(t *testing.T) {
+		fs, index := setup(t)
+		result := evictCacheFiles(fs, "/cache", index, cacheEviction{Subfolders: all, MaxSize: 250, Now: now})
+		assert.Equal(t, cacheEvictionResult{Removed: 3, Freed: 300, Remaining: 2, Size: 200}, result)
+		assert.ElementsMatch(t, []string{"glue_1.6.2.tar.gz", "glue_1.6.2_R_x86_64.tar.gz", "rlang_1.0.6.tar.gz.part"}, remaining(fs))
+	})
+	t.Run("keeps referenced packages", func(t *testing.T) {
+		fs, index := setup(t)
+		keep := map[string]bool{filepath.Join(src, "R6_2.5.1.tar.gz"): true}
+		result := evictCacheFiles(fs, "/cache", index, cacheEviction{Subfolders: []string{"src"}, OlderThan: 90 * day, MaxSize: 150, Keep: keep, Now: now})
+		assert.Equal(t, cacheEvictionResult{Removed: 3, Freed: 300, Remaining: 1, Size: 100}, result)
+		assert.ElementsMatch(t, []string{"R6_2.5.1.tar.gz", "glue_1.6.2_R_x86_64.tar.gz", "rlang_1.0.6.tar.gz.part"}, remaining(fs))
+	})
+	t.Run("skips packages locked by another process", func(t *testing.T) {
+		fs, index := setup(t)
+		require.NoError(t, afero.WriteFile(fs, filepath.Join(src, "R6_2.5.1.tar.gz.lock"), []byte("123@host\n"), 0644))
+		result := evictCacheFiles(fs, "/cache", index, cacheEviction{Subfolders: all, OlderThan: 90 * day, Now: now})
+		assert.Equal(t, 2, result.Removed)
+		assert.Contains(t, remaining(fs), "R6_2.5.1.tar.gz")
+		locked, _ := afero.Exists(fs, filepath.Join(src, "R6_2.5.1.tar.gz.lock"))
+		assert.True(t, locked, "the lock of the other process is left")
+	})
+	t.Run("keeps only referenced packages when passed alone", func(t *testing.T) {
+		fs, index := setup(t)
+		keep := map[string]bool{filepath.Join(bin, "glue_1.6.2_R_x86_64.tar.gz"): true}
+		result := evictCacheFiles(fs, "/cache", index, cacheEviction{Subfolders: all, Keep: keep, Now: now})
+		assert.Equal(t, 4, result.Removed)
+		assert.ElementsMatch(t, []string{"glue_1.6.2_R_x86_64.tar.gz", "rlang_1.0.6.tar.gz.part"}, remaining(fs))
+	})
+}
+
+func TestParseAge(t *testing.T) {
+	for in, expected := range map[string]time.Duration{
+		"":    0,
+		"90d": 90 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+	} {
+		d, err := parseAge(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expected, d, in)
+	}
+	for _, in := range []string{"soon", "-3d", "d"} {
+		_, err := parseAge(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestEvictCacheFilesRemovesPlatformFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	bpath := filepath.Join("/cache", "CRAN-abc", "binary", "4.3", "ubuntu-22.04_x86_64-pc-linux-gnu", "R6_2.5.1_R_x86_64-pc-linux-gnu.tar.gz")
+	require.NoError(t, afero.WriteFile(fs, bpath, make([]byte, 100), 0644))
+	require.NoError(t, afero.WriteFile(fs, bpath+cran.PlatformFileSuffix, []byte("{}"), 0644))
+
+	result := evictCacheFiles(fs, "/cache", cran.OpenCacheIndex(fs, "/cache"), cacheEviction{Subfolders: []string{"binary"}, MaxSize: 1, Now: time.Now()})
+	assert.Equal(t, cacheEvictionResult{Removed: 1, Freed: 100}, result, "the platform file is not counted as a package")
+	files, _ := afero.ReadDir(fs, filepath.Dir(bpath))
+	assert.Empty(t, files)
+}
@@ -18,6 +18,7 @@ import (
 	"strings"
 
 	"github.com/metrumresearchgroup/pkgr/configlib"
+	"github.com/metrumresearchgroup/pkgr/cran"
 
 	"github.com/metrumresearchgroup/pkgr/rcmd"
 	log "github.com/sirupsen/logrus"
@@ -65,6 +66,12 @@ func cleanPackageDatabases(pkgdbs string) error {
 				pkgdbsToClear = append(pkgdbsToClear, key)
 			}
 		}
+		if biocEnabled() {
+			// only the names are needed, which are the same for every release
+			for _, r := range cran.BiocRepos("", "") {
+				pkgdbsToClear = append(pkgdbsToClear, r.Name)
+			}
+		}
 	} else {
 		pkgdbsToClear = strings.Split(pkgdbs, ",")
 	}
@@ -86,7 +93,7 @@ func removePackageDatabases(pkgdbsToClear []string, cfg configlib.PkgrConfig) er
 
 	rs := rcmd.NewRSettings(cfg.RPath)
 
-	pkgNexus, _, _ := planInstall(rs.Version, false)
+	pkgNexus, _, _ := planInstall(rs.Version, rs.Platform, false)
 	repoDatabases := pkgNexus.Db
 
 	for _, dbToClear := range pkgdbsToClear {
@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -43,11 +44,11 @@ func rDebug(cmd *cobra.Command, args []string) error {
 	// defer f.Close()
 	fmt.Println("------viper-------")
 	as := viper.AllSettings()
-	fmt.Println(as)
+	fmt.Println(maskSettings(as))
 	fmt.Println("subs:")
 	if viper.Sub("Customizations") != nil {
 		fmt.Println(viper.Sub("Customizations").AllSettings()["packages"])
-		fmt.Println(viper.Sub("Customizations").AllSettings()["repos"])
+		fmt.Println(maskSettings(viper.Sub("Customizations").AllSettings()["repos"]))
 	}
 	fmt.Println("------config-------")
 	prettyPrint(cfg)
@@ -57,3 +58,30 @@ func rDebug(cmd *cobra.Command, args []string) error {
 func init() {
 	RootCmd.AddCommand(debugCmd)
 }
+
+// maskSettings hides the value of any password in the settings, in place
+func maskSettings(v interface{}) interface{} {
+	switch s := v.(type) {
+	case map[string]interface{}:
+		for k, val := range s {
+			if strings.EqualFold(k, "password") {
+				s[k] = "**HIDDEN**"
+				continue
+			}
+			maskSettings(val)
+		}
+	case map[interface{}]interface{}:
+		for k, val := range s {
+			if ks, ok := k.(string); ok && strings.EqualFold(ks, "password") {
+				s[k] = "**HIDDEN**"
+				continue
+			}
+			maskSettings(val)
+		}
+	case []interface{}:
+		for _, val := range s {
+			maskSettings(val)
+		}
+	}
+	return v
+}
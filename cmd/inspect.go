@@ -89,7 +89,7 @@ func inspect(cmd *cobra.Command, args []string) error {
 
 	rs := rcmd.NewRSettings(cfg.RPath)
 	rVersion := rcmd.GetRVersion(&rs)
-	_, ip, _ := planInstall(rVersion, true)
+	_, ip, _ := planInstall(rVersion, rs.Platform, true)
 	if showDeps {
 		var allDeps map[string][]string
 		keepDeps := make(map[string][]string)
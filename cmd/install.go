@@ -16,14 +16,17 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/metrumresearchgroup/pkgr/gpsr"
 	"github.com/metrumresearchgroup/pkgr/rollback"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 
 	"github.com/metrumresearchgroup/pkgr/configlib"
@@ -44,11 +47,20 @@ the configuration file.`,
   pkgr install
   # Install new packages and dependencies but don't update packages that already
   # exist in the library.
-  pkgr install  --no-update`,
+  pkgr install  --no-update
+  # Install exactly the packages recorded in pkgr.lock
+  pkgr install --frozen
+  # Install what can be downloaded, even if some packages cannot be
+  pkgr install --keep-going`,
 	RunE: rInstall,
 }
 
+var frozen bool
+var keepGoing bool
+
 func init() {
+	installCmd.Flags().BoolVar(&frozen, "frozen", false, "install exactly what pkgr.lock specifies instead of resolving dependencies")
+	installCmd.Flags().BoolVar(&keepGoing, "keep-going", false, "install the packages that were downloaded when others could not be, skipping those that depend on them")
 	RootCmd.AddCommand(installCmd)
 }
 
@@ -65,45 +77,34 @@ func rInstall(cmd *cobra.Command, args []string) error {
 
 	// Get master object containing the packages available in each repository (pkgNexus),
 	//  as well as a master install plan to guide our process.
-	_, installPlan, rollbackPlan := planInstall(rVersion, true)
-
-	if installPlan.CreateLibrary {
-		if cfg.Strict {
-			log.WithFields(log.Fields{
-				"library": cfg.Library,
-			}).Fatal("library directory must exist before running pkgr in strict mode -- halting execution")
-		}
-
-		err := fs.MkdirAll(cfg.Library, 0755)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"library": cfg.Library,
-				"error":   err,
-			}).Fatal("could not create library directory")
-		}
-	}
-
-	if !cfg.NoUpdate { // } && cfg.Rollback { We actually need this to run either way, as the "prepare packages for update" operation moves the current installations to __OLD__ folders, thus allowing updated versions to be installed.
-		log.Info("update argument passed. staging packages for update...")
-		rollbackPlan.PreparePackagesForUpdate(fs, cfg.Library)
+	var pkgNexus *cran.PkgNexus
+	var installPlan gpsr.InstallPlan
+	var rollbackPlan rollback.RollbackPlan
+	if frozen {
+		pkgNexus, installPlan, rollbackPlan = planFrozenInstall(rVersion, rSettings.Platform)
+	} else {
+		pkgNexus, installPlan, rollbackPlan = planInstall(rVersion, rSettings.Platform, true)
 	}
-	rollbackPlan.PrepareAdditionalPackagesForOverwrite(fs, cfg.Library)
-
-	// Create a list of package download objects using our install plan and our "nexus" object.
-	// pkgsToDownload := getPackagesToDownload(installPlan, pkgNexus)
 
 	// Retrieve a cache to store any packages we need to download for the install.
 	packageCache := rcmd.NewPackageCache(userCache(cfg.Cache), false)
+	packageCache.Index = cran.OpenCacheIndex(fs, packageCache.BaseDir)
+	packageCache.Platform = cran.CurrentBinaryPlatform(rSettings.Platform)
 
-	// Create a pkgMap object, which helps us with parallel downloads (?)
-	pkgMap, err := cran.DownloadPackages(fs, installPlan.PackageDownloads, packageCache.BaseDir, rVersion, cfg.NoSecure)
-	if err != nil {
-		log.Fatalf("error downloading packages: %s", err)
+	// Packages are downloaded in the order they can be installed in, and each is
+	// installed as soon as it and its dependencies are downloaded.
+	downloads := cran.StartDownloads(fs, installPlan.DownloadOrder(), packageCache.BaseDir, rVersion, pkgNexus.Fetcher, cfg.Downloads)
+
+	if installPlan.CreateLibrary && cfg.Strict {
+		log.WithFields(log.Fields{
+			"library": cfg.Library,
+		}).Fatal("library directory must exist before running pkgr in strict mode -- halting execution")
 	}
 
 	// Set the arguments to be passed in to the R Package Installer
 	pkgInstallArgs := rcmd.NewDefaultInstallArgs()
-	pkgInstallArgs.Library, _ = filepath.Abs(cfg.Library)
+	libraryPath, _ := filepath.Abs(cfg.Library)
+	pkgInstallArgs.Library = libraryPath
 
 	// Get the number of workers.
 	// Use number of user defined threads if set. Otherwise, use the
@@ -116,18 +117,85 @@ func rInstall(cmd *cobra.Command, args []string) error {
 	// Set ENV values in rSettings
 	rSettings = configlib.SetCustomizations(rSettings, cfg)
 
+	// Packages are installed to a staging library alongside the library, and only
+	// moved into the library once every package is downloaded and installed, so a
+	// package that cannot be downloaded leaves the library untouched. With
+	// --keep-going a partial install is wanted, and packages are installed to the
+	// library as they are downloaded.
+	installSettings := rSettings
+	staging := ""
+	if keepGoing {
+		prepareLibrary(installPlan, &rollbackPlan)
+	} else {
+		staging = stagingLibrary(libraryPath)
+		err := fs.RemoveAll(staging)
+		if err == nil {
+			err = fs.MkdirAll(staging, 0755)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"library": staging,
+				"error":   err,
+			}).Fatal("could not create staging library")
+		}
+		pkgInstallArgs.Library = staging
+		// packages in the library are used by those staged, after the staged ones
+		installSettings.LibPaths = append(append([]string{}, rSettings.LibPaths...), staging, libraryPath)
+	}
+
 	//
 	// Install the packages
 	//
-	err = rcmd.InstallPackagePlan(fs,
+	err := rcmd.InstallPackagePlan(fs,
 		installPlan,
-		pkgMap,
+		downloads,
 		packageCache,
 		pkgInstallArgs,
-		rSettings,
+		installSettings,
 		rcmd.ExecSettings{PkgrVersion: VERSION},
 		nworkers,
+		keepGoing,
 	)
+	var downloadErr *cran.DownloadError
+	var offlineErr *cran.OfflineError
+	if staging != "" {
+		// packages staged before one failed to install are moved as well, and
+		// rolled back below along with the rest of the library
+		failedDownload := errors.As(err, &downloadErr) || errors.As(err, &offlineErr)
+		if !failedDownload {
+			prepareLibrary(installPlan, &rollbackPlan)
+			if errMove := moveStagedPackages(fs, staging, libraryPath); errMove != nil && err == nil {
+				err = errMove
+			}
+		}
+		if errRemove := fs.RemoveAll(staging); errRemove != nil {
+			log.WithFields(log.Fields{
+				"library": staging,
+				"error":   errRemove,
+			}).Warn("could not remove staging library")
+		}
+		if failedDownload {
+			exitOnDownloadError(err)
+		}
+	}
+	var skipped []string
+	if errors.As(err, &downloadErr) && keepGoing {
+		logDownloadFailures(downloadErr)
+		skipped = installPlan.Prune(downloadErr.Packages())
+		// packages staged for update that were skipped keep their installed version
+		if errRestore := rollbackPlan.RestorePackages(fs, skipped); errRestore != nil {
+			log.WithField("error", errRestore).Error("failed to restore packages that were not updated")
+		}
+		err = nil
+	} else if errors.As(err, &downloadErr) || errors.As(err, &offlineErr) {
+		if !cfg.NoRollback {
+			if errRollback := rollback.RollbackPackageEnvironment(fs, rollbackPlan); errRollback != nil {
+				log.WithFields(log.Fields{}).Error("failed to reset package environment after bad installation. Your package Library will be in a corrupt state. It is recommended you delete your Library and reinstall all packages.")
+			}
+		}
+		_ = rollbackPlan.DeleteBackupPackageFolders(fs)
+		exitOnDownloadError(err)
+	}
 
 	//
 	// Install the tarballs, if applicable.
@@ -154,10 +222,103 @@ func rInstall(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		log.Errorf("failed package install with err, %s", err)
 	}
+	if len(skipped) > 0 {
+		log.WithField("packages", strings.Join(skipped, ", ")).Error("packages not installed as they could not be downloaded, or depend on one that could not be")
+	}
+
+	return nil
+}
+
+// prepareLibrary creates the library, when it does not exist, and makes way for
+// the packages replaced
+func prepareLibrary(installPlan gpsr.InstallPlan, rollbackPlan *rollback.RollbackPlan) {
+	if installPlan.CreateLibrary {
+		err := fs.MkdirAll(cfg.Library, 0755)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"library": cfg.Library,
+				"error":   err,
+			}).Fatal("could not create library directory")
+		}
+	}
+
+	// Installed packages being replaced are moved to __OLD__ folders, so the new
+	// versions can be installed and the old ones restored on rollback. Without
+	// updating only packages violating a version requirement are replaced, while
+	// a frozen install always moves packages to the locked versions.
+	if !cfg.NoUpdate || frozen {
+		log.Info("update argument passed. staging packages for update...")
+	}
+	rollbackPlan.PreparePackagesForUpdate(fs, cfg.Library)
+	rollbackPlan.PrepareAdditionalPackagesForOverwrite(fs, cfg.Library)
+}
 
+// stagingLibrary provides the library packages are installed to before they are
+// moved to the library. It is alongside the library, so they are moved by a rename.
+func stagingLibrary(library string) string {
+	return filepath.Join(filepath.Dir(library), "."+filepath.Base(library)+".pkgr-staging")
+}
+
+// moveStagedPackages moves the packages installed to the staging library into the
+// library. A package already in the library, which is kept, is left as it is.
+func moveStagedPackages(fs afero.Fs, staging string, library string) error {
+	staged, err := afero.ReadDir(fs, staging)
+	if err != nil {
+		return err
+	}
+	for _, fi := range staged {
+		// R locks a library while installing to it with 00LOCK directories
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), "00LOCK") {
+			continue
+		}
+		dest := filepath.Join(library, fi.Name())
+		if exists, _ := afero.DirExists(fs, dest); exists {
+			log.WithField("package", fi.Name()).Debug("package already installed, keeping it")
+			continue
+		}
+		if err := fs.Rename(filepath.Join(staging, fi.Name()), dest); err != nil {
+			return fmt.Errorf("could not move package %s into the library: %s", fi.Name(), err)
+		}
+	}
 	return nil
 }
 
+// exitOnDownloadError reports the packages that could not be downloaded and exits
+func exitOnDownloadError(err error) {
+	var offlineErr *cran.OfflineError
+	if errors.As(err, &offlineErr) {
+		for _, pkg := range offlineErr.Packages {
+			log.WithField("package", pkg).Error("package not in the cache")
+		}
+		for _, u := range offlineErr.URLs {
+			log.WithField("url", u).Error("package would be downloaded from")
+		}
+		log.Fatal("running offline, fetch the packages listed above before using --offline")
+	}
+	var downloadErr *cran.DownloadError
+	if errors.As(err, &downloadErr) {
+		logDownloadFailures(downloadErr)
+		log.Fatal("stopping without changing the library, pass --keep-going to install the packages that were downloaded")
+	}
+	log.Fatalf("error downloading packages: %s", err)
+}
+
+// logDownloadFailures reports each package that could not be downloaded
+func logDownloadFailures(downloadErr *cran.DownloadError) {
+	for _, f := range downloadErr.Failures {
+		fields := log.Fields{
+			"package": f.Package,
+			"version": f.Version,
+			"url":     f.URL,
+			"error":   f.Err,
+		}
+		if f.StatusCode != 0 {
+			fields["status"] = f.StatusCode
+		}
+		log.WithFields(fields).Error("package could not be downloaded")
+	}
+}
+
 func installAdditionalPackages(installPlan gpsr.InstallPlan, rSettings rcmd.RSettings, library, cache string) error {
 
 	toInstallCount := len(installPlan.AdditionalPackageSources) - 1
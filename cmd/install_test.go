@@ -356,3 +356,31 @@ func checkError(t *testing.T, err error) {
 		t.Fail()
 	}
 }
+
+func TestMoveStagedPackages(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	library := filepath.Join("/project", "lib")
+	staging := stagingLibrary(library)
+	assert.Equal(t, filepath.Join("/project", ".lib.pkgr-staging"), staging)
+	for _, dir := range []string{
+		filepath.Join(staging, "R6"),
+		filepath.Join(staging, "glue"),
+		filepath.Join(staging, "00LOCK-cli"),
+		filepath.Join(library, "glue"),
+	} {
+		assert.NoError(t, fs.MkdirAll(dir, 0755))
+	}
+	assert.NoError(t, afero.WriteFile(fs, filepath.Join(staging, "R6", "DESCRIPTION"), []byte("Package: R6\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, filepath.Join(staging, "glue", "DESCRIPTION"), []byte("Package: glue\nVersion: 2.0.0\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, filepath.Join(library, "glue", "DESCRIPTION"), []byte("Package: glue\nVersion: 1.6.2\n"), 0644))
+
+	assert.NoError(t, moveStagedPackages(fs, staging, library))
+	b, err := afero.ReadFile(fs, filepath.Join(library, "R6", "DESCRIPTION"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Package: R6\n", string(b))
+	b, err = afero.ReadFile(fs, filepath.Join(library, "glue", "DESCRIPTION"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Package: glue\nVersion: 1.6.2\n", string(b), "a package kept in the library is left as it is")
+	exists, _ := afero.DirExists(fs, filepath.Join(library, "00LOCK-cli"))
+	assert.False(t, exists)
+}
@@ -85,7 +85,7 @@ func load(userPackages []string, rs rcmd.RSettings, rDir string, threads int, al
 	log.Info("getting relevant packages via `pkgr plan`..................")
 
 	rVersion := rcmd.GetRVersion(&rs)
-	_, installPlan, _ := planInstall(rVersion, false)
+	_, installPlan, _ := planInstall(rVersion, rs.Platform, false)
 
 	log.Info("finished getting packages from `pkgr plan`__________________")
 
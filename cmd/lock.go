@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/gpsr"
+	"github.com/metrumresearchgroup/pkgr/lockfile"
+	"github.com/metrumresearchgroup/pkgr/logger"
+	"github.com/metrumresearchgroup/pkgr/rcmd"
+	"github.com/metrumresearchgroup/pkgr/rollback"
+)
+
+// lockCmd writes the resolved installation plan to a lockfile
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Write the resolved installation plan to pkgr.lock",
+	Long: `Resolve the installation plan for the current configuration and record
+it in a lockfile ('pkgr.lock' next to the configuration file).
+
+The lockfile pins every package to an exact version, repository, and
+package type (source or binary), along with the MD5sum published by the
+repository and the packages it depends on. Pass --frozen to 'pkgr install'
+to install exactly what the lockfile specifies without resolving
+dependencies against the repositories again.`,
+	Example: `  # Record the current plan
+  pkgr lock
+  # Later, recreate exactly the same library
+  pkgr install --frozen`,
+	RunE: rLock,
+}
+
+func init() {
+	RootCmd.AddCommand(lockCmd)
+}
+
+func rLock(cmd *cobra.Command, args []string) error {
+	logger.AddLogFile(cfg.Logging.All, cfg.Logging.Overwrite)
+	startTime := time.Now()
+
+	rs := rcmd.NewRSettings(cfg.RPath)
+	rVersion := rcmd.GetRVersion(&rs)
+	log.Infoln("R Version " + rVersion.ToFullString())
+	_, installPlan, _ := planInstall(rVersion, rs.Platform, true)
+
+	lf := lockfile.New(installPlan, rVersion, VERSION)
+	err := lf.Write(fs, lockfile.DefaultName)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  lockfile.DefaultName,
+			"error": err,
+		}).Error("could not write lockfile")
+		return err
+	}
+	if len(installPlan.AdditionalPackageSources) > 0 {
+		log.WithField("count", len(installPlan.AdditionalPackageSources)).Warn("tarball, local and url packages are not recorded in the lockfile and will be installed from their configured sources")
+	}
+	log.WithFields(log.Fields{
+		"file":     lockfile.DefaultName,
+		"packages": len(lf.Packages),
+		"duration": time.Since(startTime),
+	}).Info("wrote lockfile")
+	return nil
+}
+
+// planFrozenInstall builds the installation plan from the lockfile rather than
+// resolving it, failing if any locked package can no longer be provided by the
+// configured repositories
+func planFrozenInstall(rv cran.RVersion, rPlatform string) (*cran.PkgNexus, gpsr.InstallPlan, rollback.RollbackPlan) {
+	startTime := time.Now()
+
+	lf, err := lockfile.Read(fs, lockfile.DefaultName)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  lockfile.DefaultName,
+			"error": err,
+		}).Fatal("could not read lockfile, run 'pkgr lock' to create one")
+	}
+	if lf.RVersion != rv.ToFullString() {
+		log.WithFields(log.Fields{
+			"locked":  lf.RVersion,
+			"running": rv.ToFullString(),
+		}).Warn("lockfile was created with a different version of R")
+	}
+
+	libraryExists, installedPackages, _ := scanLibrary()
+	pkgNexus := newPkgNexus(rv, rPlatform)
+
+	// packages locked from remotes are looked up in the remotes built again
+	var tarballDescriptions []desc.Desc
+	var additionalPackageSources map[string]gpsr.AdditionalPkg
+	if len(cfg.Tarballs) > 0 {
+		tarballDescriptions, additionalPackageSources = unpackTarballs(fs, cfg.Tarballs, cfg.Cache)
+	}
+	remoteSources := newRemoteResolver(pkgNexus)
+	remoteSources.resolve(cfg.PackageRemotes, true)
+	remoteSources.resolve(declaredRemotes(tarballDescriptions, unpackDescriptions(fs, cfg.Descriptions)), false)
+
+	for _, lp := range lf.Packages {
+		if lp.Path == "" {
+			continue
+		}
+		// versions outside of the repository index must be looked up again
+		pkgNexus.SetPackageConstraint(lp.Package, desc.Dep{
+			Name:       lp.Package,
+			Version:    desc.ParseVersion(lp.Version),
+			Constraint: desc.Equals,
+		})
+		if _, _, found := pkgNexus.GetPackage(lp.Package); found {
+			continue
+		}
+		if _, _, found := pkgNexus.GetArchivedPackage(lp.Package, rv); !found {
+			log.WithFields(log.Fields{
+				"file":    lockfile.DefaultName,
+				"pkg":     lp.Package,
+				"version": lp.Version,
+				"path":    lp.Path,
+			}).Fatal("locked version of package could not be found in the repository archive, run 'pkgr lock' to lock versions available now")
+		}
+	}
+
+	installPlan, err := lf.InstallPlan(pkgNexus, installedPackages, libraryExists)
+	if err != nil {
+		log.WithField("file", lockfile.DefaultName).Error(err)
+		os.Exit(1)
+	}
+
+	installPlan.AdditionalPackageSources = remoteSources.additionalSources(additionalPackageSources)
+	logAdditionalPackageOrigins(installPlan.AdditionalPackageSources)
+
+	rollbackPlan := rollback.CreateRollbackPlan(cfg.Library, installPlan, installedPackages)
+
+	for _, p := range installPlan.OutdatedPackages {
+		log.WithFields(log.Fields{
+			"pkg":               p.Package,
+			"installed_version": p.OldVersion,
+			"locked_version":    p.NewVersion,
+		}).Info("package will be changed to the locked version")
+	}
+	log.WithFields(log.Fields{
+		"locked":     len(lf.Packages),
+		"to_install": installPlan.GetNumPackagesToInstall(),
+	}).Info("package installation plan from lockfile")
+	log.Infof("Library path to install packages: %s\n", cfg.Library)
+	log.Infoln("resolution time", time.Since(startTime))
+	return pkgNexus, installPlan, rollbackPlan
+}
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/configlib"
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/gpsr"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+	"github.com/metrumresearchgroup/pkgr/logger"
+	"github.com/metrumresearchgroup/pkgr/rcmd"
+	"github.com/metrumresearchgroup/pkgr/repoindex"
+)
+
+var mirrorRVersions []string
+var mirrorTypes []string
+var mirrorJSON bool
+
+// mirrorCmd copies the packages of a configuration into a local repository
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror [flags] <dir>",
+	Short: "Copy the packages of a configuration into a local repository",
+	Long: `Resolve the packages of the configuration, along with all of their
+dependencies, and copy them into <dir>, laid out as a CRAN-like repository with
+its PACKAGES indexes. The directory can then be moved to a site without network
+access and listed under Repos as a file:// url, eg
+
+  Repos:
+    - mirror: "file:///srv/pkgr-mirror"
+
+Source packages are written to src/contrib, and binaries to the directory of
+each version of R under bin, as in the repositories they are taken from. Pass
+--r-versions to mirror packages for versions of R other than the one in use,
+and --types to mirror binaries, which are only available for the platform pkgr
+runs on. A package without a binary is mirrored as a source package.
+
+Running the command again adds the packages that are not yet in <dir>, and keeps
+those already there, so that every version mirrored stays available. The index
+lists each version, so pkgr selects the highest one that suits the version of R.
+Tarballs, and local and url remotes, are not mirrored.
+
+A manifest of the packages mirrored is printed once done. A relative <dir> is
+taken relative to the configuration file, like any other path.`,
+	Example: `  # Mirror the source packages for the version of R in use
+  pkgr mirror ./mirror
+  # Mirror source packages and binaries for two versions of R
+  pkgr mirror --r-versions 4.2,4.3 --types source,binary ./mirror`,
+	Args: cobra.ExactArgs(1),
+	RunE: rMirror,
+}
+
+func init() {
+	mirrorCmd.Flags().StringSliceVar(&mirrorRVersions, "r-versions", nil, "versions of R to mirror packages for, eg 4.2,4.3 (default the version of R in use)")
+	mirrorCmd.Flags().StringSliceVar(&mirrorTypes, "types", []string{"source"}, "types of package to mirror, source and/or binary")
+	mirrorCmd.Flags().BoolVar(&mirrorJSON, "json", false, "print the manifest as a JSON array")
+	RootCmd.AddCommand(mirrorCmd)
+}
+
+// mirroredPackage is a package file in the manifest of a mirror
+type mirroredPackage struct {
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Type     string `json:"type"`
+	RVersion string `json:"r_version"`
+	Repo     string `json:"repo"`
+	Path     string `json:"path"`
+	// New is false for a file that was already in the mirror
+	New bool `json:"new"`
+}
+
+func rMirror(cmd *cobra.Command, args []string) error {
+	logger.AddLogFile(cfg.Logging.All, cfg.Logging.Overwrite)
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	types, err := parseMirrorTypes(mirrorTypes)
+	if err != nil {
+		return err
+	}
+	var rVersions []cran.RVersion
+	for _, s := range mirrorRVersions {
+		rv, err := cran.ParseRVersion(s)
+		if err != nil {
+			return err
+		}
+		rVersions = append(rVersions, rv)
+	}
+	// the platform of R is only known for the R in use, so repositories are
+	// only told it when mirroring for that R
+	var rPlatform string
+	if len(rVersions) == 0 {
+		rs := rcmd.NewRSettings(cfg.RPath)
+		rVersions = append(rVersions, rcmd.GetRVersion(&rs))
+		rPlatform = rs.Platform
+	}
+
+	var manifest []mirroredPackage
+	// a source package mirrored in place of a binary is listed once for each version of R
+	listed := make(map[string]bool)
+	for _, rv := range rVersions {
+		log.Infoln("R Version " + rv.ToFullString())
+		pkgNexus, installPlan, _ := planInstall(rv, rPlatform, true)
+		for name, pkg := range installPlan.AdditionalPackageSources {
+			log.WithFields(log.Fields{
+				"package": name,
+				"origin":  pkg.OriginPath,
+			}).Warn("package is not from a repository and is not mirrored")
+		}
+		for _, st := range types {
+			downloads := mirrorDownloads(pkgNexus, st)
+			pkgMap, err := cran.DownloadPackages(fs, downloads, rcmd.NewPackageCache(userCache(cfg.Cache), false).BaseDir, rv, pkgNexus.Fetcher, cfg.Downloads)
+			var offlineErr *cran.OfflineError
+			if errors.As(err, &offlineErr) {
+				for _, pkg := range offlineErr.Packages {
+					log.WithField("package", pkg).Error("package not in the cache")
+				}
+				log.Fatal("running offline, fetch the packages listed above before using --offline")
+			}
+			var downloadErr *cran.DownloadError
+			if errors.As(err, &downloadErr) {
+				logDownloadFailures(downloadErr)
+				log.Fatal("stopping as the mirror would be missing the packages listed above")
+			}
+			if err != nil {
+				log.Fatalf("error downloading packages: %s", err)
+			}
+			mirrored, err := mirrorPackages(fs, dir, downloads, pkgMap, rv)
+			for _, m := range mirrored {
+				if !listed[m.RVersion+"/"+m.Path] {
+					listed[m.RVersion+"/"+m.Path] = true
+					manifest = append(manifest, m)
+				}
+			}
+			if err != nil {
+				log.WithField("dir", dir).Fatalf("error copying packages to the mirror: %s", err)
+			}
+		}
+	}
+
+	indexes, err := repoindex.Build(dir, repoindex.Options{AllVersions: true})
+	if err != nil {
+		log.WithField("dir", dir).Error(err)
+		return err
+	}
+	for _, idx := range indexes {
+		log.WithFields(log.Fields{
+			"dir":      idx.Dir,
+			"packages": idx.Packages,
+		}).Info("wrote package index")
+	}
+
+	added := 0
+	for _, m := range manifest {
+		if m.New {
+			added++
+		}
+	}
+	log.WithFields(log.Fields{
+		"dir":      dir,
+		"packages": len(manifest),
+		"added":    added,
+	}).Info("mirror up to date")
+	return printManifest(os.Stdout, manifest, mirrorJSON)
+}
+
+// parseMirrorTypes parses the types of package to mirror
+func parseMirrorTypes(names []string) ([]cran.SourceType, error) {
+	var types []cran.SourceType
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "source":
+			types = append(types, cran.Source)
+		case "binary":
+			types = append(types, cran.Binary)
+		default:
+			return nil, fmt.Errorf("invalid package type %q, expected source or binary", name)
+		}
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no package types to mirror")
+	}
+	return types, nil
+}
+
+// mirrorDownloads resolves the packages of the configuration and all of their
+// dependencies, of one type, whatever is installed in the library
+func mirrorDownloads(pkgNexus *cran.PkgNexus, st cran.SourceType) []cran.PkgDl {
+	fallback := pkgNexus.UseSourceType(st)
+	dependencyConfigurations := gpsr.NewDefaultInstallDeps()
+	dependencyConfigurations.Default.NoRecommended = cfg.NoRecommended
+	configlib.SetPlanCustomizations(cfg, dependencyConfigurations, pkgNexus)
+	installPlan, err := gpsr.ResolveInstallationReqs(
+		cfg.Packages,
+		nil,
+		dependencyConfigurations,
+		pkgNexus,
+		false,
+		false,
+		cfg.NoRecommended,
+	)
+	if err != nil {
+		log.Fatalf("error resolving %s packages: %s", st, err)
+	}
+	var downloads []cran.PkgDl
+	for _, d := range installPlan.PackageDownloads {
+		if d.Package.Package == "" {
+			continue
+		}
+		if st == cran.Binary && d.Config.Type == cran.Source && stringInSlice(d.Package.Package, fallback) {
+			log.WithField("package", d.Package.Package).Warn("no binary available, mirroring the source package")
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads
+}
+
+// mirrorPackages copies downloaded package files into the contrib directories of
+// the mirror, where the repositories they are taken from hold them. Files already
+// in the mirror are kept.
+func mirrorPackages(fs afero.Fs, dir string, downloads []cran.PkgDl, pkgMap *cran.PkgMap, rv cran.RVersion) ([]mirroredPackage, error) {
+	var mirrored []mirroredPackage
+	for _, d := range downloads {
+		dl, found := pkgMap.Get(d.Package.Package)
+		if !found {
+			log.WithField("package", d.Package.Package).Warn("package was not downloaded and is not mirrored")
+			continue
+		}
+		// every file is kept at the top of its contrib directory, where the index lists it
+		d.Package.Path = ""
+		rel := cran.PackagePath(d, rv, filepath.Base(dl.Path))
+		m := mirroredPackage{
+			Package:  d.Package.Package,
+			Version:  d.Package.Version,
+			Type:     d.Config.Type.String(),
+			RVersion: rv.ToString(),
+			Repo:     d.Config.Repo.Name,
+			Path:     rel,
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(rel))
+		exists, err := afero.Exists(fs, dest)
+		if err != nil {
+			return mirrored, err
+		}
+		if !exists {
+			if err := fsutil.CopyFileAtomic(fs, dl.Path, dest, 0644); err != nil {
+				return mirrored, err
+			}
+			m.New = true
+		}
+		mirrored = append(mirrored, m)
+	}
+	return mirrored, nil
+}
+
+// printManifest prints the packages mirrored, sorted by version of R, type and package
+func printManifest(w io.Writer, manifest []mirroredPackage, asJSON bool) error {
+	sort.SliceStable(manifest, func(i, j int) bool {
+		a, b := manifest[i], manifest[j]
+		if a.RVersion != b.RVersion {
+			return a.RVersion < b.RVersion
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Package < b.Package
+	})
+	if asJSON {
+		if manifest == nil {
+			manifest = []mirroredPackage{}
+		}
+		b, err := JsonMarshal(manifest)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tVERSION\tTYPE\tR\tREPO\tSTATUS\tPATH")
+	for _, m := range manifest {
+		status := "existing"
+		if m.New {
+			status = "new"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", m.Package, m.Version, m.Type, m.RVersion, m.Repo, status, m.Path)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func TestMirrorPackages(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	repo := cran.RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	rv := cran.RVersion{Major: 4, Minor: 3, Patch: 1}
+	downloads := []cran.PkgDl{
+		{Package: desc.Desc{Package: "R6", Version: "2.5.1"}, Config: cran.PkgConfig{Repo: repo, Type: cran.Source}},
+		{Package: desc.Desc{Package: "MASS", Version: "7.3-51", Path: "Archive/MASS"}, Config: cran.PkgConfig{Repo: repo, Type: cran.Source}},
+		{Package: desc.Desc{Package: "cli", Version: "3.6.1"}, Config: cran.PkgConfig{Repo: repo, Type: cran.Source}},
+	}
+	pkgMap := cran.NewPkgMap()
+	for _, d := range downloads[:2] {
+		path := filepath.Join("/cache", d.Package.Package+"_"+d.Package.Version+".tar.gz")
+		require.NoError(t, afero.WriteFile(memFs, path, []byte(d.Package.Package), 0644))
+		pkgMap.Put(d.Package.Package, cran.Download{Path: path, Metadata: d})
+	}
+	require.NoError(t, afero.WriteFile(memFs, "/mirror/src/contrib/MASS_7.3-51.tar.gz", []byte("kept"), 0644))
+
+	mirrored, err := mirrorPackages(memFs, "/mirror", downloads, pkgMap, rv)
+	require.NoError(t, err)
+	assert.Equal(t, []mirroredPackage{
+		{Package: "R6", Version: "2.5.1", Type: "source", RVersion: "4.3", Repo: "CRAN", Path: "src/contrib/R6_2.5.1.tar.gz", New: true},
+		{Package: "MASS", Version: "7.3-51", Type: "source", RVersion: "4.3", Repo: "CRAN", Path: "src/contrib/MASS_7.3-51.tar.gz"},
+	}, mirrored, "a package that was not downloaded is left out")
+
+	content, err := afero.ReadFile(memFs, "/mirror/src/contrib/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "R6", string(content))
+	content, err = afero.ReadFile(memFs, "/mirror/src/contrib/MASS_7.3-51.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "kept", string(content), "a file already in the mirror is kept")
+}
+
+func TestParseMirrorTypes(t *testing.T) {
+	types, err := parseMirrorTypes([]string{"source", " Binary"})
+	require.NoError(t, err)
+	assert.Equal(t, []cran.SourceType{cran.Source, cran.Binary}, types)
+
+	_, err = parseMirrorTypes([]string{"wheel"})
+	assert.Error(t, err)
+	_, err = parseMirrorTypes(nil)
+	assert.Error(t, err)
+}
+
+func TestPrintManifest(t *testing.T) {
+	manifest := []mirroredPackage{
+		{Package: "cli", Version: "3.6.1", Type: "source", RVersion: "4.3", Repo: "CRAN", Path: "src/contrib/cli_3.6.1.tar.gz"},
+		{Package: "R6", Version: "2.5.1", Type: "source", RVersion: "4.2", Repo: "CRAN", Path: "src/contrib/R6_2.5.1.tar.gz", New: true},
+	}
+	var out bytes.Buffer
+	require.NoError(t, printManifest(&out, manifest, false))
+	assert.Equal(t,
+		"PACKAGE  VERSION  TYPE    R    REPO  STATUS    PATH\n"+
+			"R6       2.5.1    source  4.2  CRAN  new       src/contrib/R6_2.5.1.tar.gz\n"+
+			"cli      3.6.1    source  4.3  CRAN  existing  src/contrib/cli_3.6.1.tar.gz\n",
+		out.String())
+
+	out.Reset()
+	require.NoError(t, printManifest(&out, nil, true))
+	assert.Equal(t, "[]\n", out.String())
+}
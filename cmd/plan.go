@@ -15,7 +15,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"runtime"
 
@@ -70,7 +73,7 @@ func plan(cmd *cobra.Command, args []string) error {
 	rVersion := rcmd.GetRVersion(&rs)
 	log.Infoln("R Version " + rVersion.ToFullString())
 	log.Infoln("OS Platform " + rs.Platform)
-	_, ip, _ := planInstall(rVersion, true)
+	_, ip, _ := planInstall(rVersion, rs.Platform, true)
 	if viper.GetBool("show-deps") {
 		for pkg, deps := range ip.DepDb {
 			fmt.Println("-----------  ", pkg, "   ------------")
@@ -80,99 +83,21 @@ func plan(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.InstallPlan, rollback.RollbackPlan) {
+func planInstall(rv cran.RVersion, rPlatform string, exitOnMissing bool) (*cran.PkgNexus, gpsr.InstallPlan, rollback.RollbackPlan) {
 	startTime := time.Now()
 
-	//Check library existence
-	libraryExists, err := afero.DirExists(fs, cfg.Library)
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"library": cfg.Library,
-			"error":   err,
-		}).Error("unexpected error when checking existence of library")
-	}
+	libraryExists, installedPackages, whereInstalledFrom := scanLibrary()
+	installedPackageNames := extractNamesFromDesc(installedPackages)
 
-	if !libraryExists && cfg.Strict {
-		log.WithFields(log.Fields{
-			"library": cfg.Library,
-		}).Error("library directory must exist before running pkgr in strict mode")
-	}
+	pkgNexus := newPkgNexus(rv, rPlatform)
 
-	var installedPackageNames []string
-	var installedPackages map[string]desc.Desc
-	var whereInstalledFrom pacman.InstalledFromPkgs
-
-	if libraryExists {
-		installedPackages = pacman.GetPriorInstalledPackages(fs, cfg.Library)
-		installedPackageNames = extractNamesFromDesc(installedPackages)
-		log.WithField("count", len(installedPackages)).Info("found installed packages")
-		whereInstalledFrom = pacman.GetInstallers(installedPackages)
-		notPkgr := whereInstalledFrom.NotFromPkgr()
-		if len(notPkgr) > 0 {
-			// TODO: should this say "prior installed packages" not ...
-			log.WithFields(log.Fields{
-				"packages": notPkgr,
-			}).Warn("Packages not installed by pkgr")
-		}
-	} else {
-		log.WithFields(log.Fields{
-			"path": cfg.Library,
-		}).Info("Package Library will be created")
-		//fs.Create(cfg.Library)
-		//fs.Chmod(cfg.Library, 0755)
-	}
-
-	var repos []cran.RepoURL
-	for _, r := range cfg.Repos {
-		for nm, url := range r {
-			repo, _ := configlib.GetRepoCustomizationByName(nm, cfg.Customizations)
-			// for now no need to check if customization exists as the repo will have a default empty string
-			// regardless so no additional logic needed
-			repos = append(repos, cran.RepoURL{Name: nm, URL: url, Suffix: repo.RepoSuffix})
-		}
-	}
-	st := cran.DefaultType()
-	cic := cran.NewInstallConfig()
-	for _, repoSlice := range cfg.Customizations.Repos {
-		for rn, val := range repoSlice {
-			rc := cran.RepoConfig{}
-			if strings.EqualFold(val.RepoType, "MPN") {
-				rc.RepoType = cran.MPN
-				rc.DefaultSourceType = cran.Binary
-			}
-			if strings.EqualFold(val.RepoType, "RSPM") {
-				rc.RepoType = cran.RSPM
-			}
-			if strings.EqualFold(val.Type, "binary") {
-				rc.DefaultSourceType = cran.Binary
-			}
-			if strings.EqualFold(val.Type, "source") {
-				rc.DefaultSourceType = cran.Source
-			}
-			if val.RepoSuffix != "" {
-				rc.RepoSuffix = val.RepoSuffix
-			}
-			cic.Repos[rn] = rc
+	// packages given as remotes are built and take the place of any repository version
+	remoteSources := newRemoteResolver(pkgNexus)
+	for _, name := range remoteSources.resolve(cfg.PackageRemotes, true) {
+		if !funk.Contains(cfg.Packages, name) {
+			cfg.Packages = append(cfg.Packages, name)
 		}
 	}
-	pkgNexus, err := cran.NewPkgDb(repos, st, cic, rv, cfg.NoSecure)
-	if err != nil {
-		log.Panicln("error getting pkgdb ", err)
-	}
-	log.Infoln("Default package installation type: ", st.String())
-	for _, db := range pkgNexus.Db {
-		log.Infoln(fmt.Sprintf("%v:%v (binary:source) packages available in for %s from %s", len(db.DescriptionsBySourceType[cran.Binary]), len(db.DescriptionsBySourceType[cran.Source]), db.Repo.Name, db.Repo.URL))
-		for _, pkg := range cfg.IgnorePackages {
-			// to "skip" packages, we'll just completely nuke them from the pkgdb so they'll never even come up in the plan
-			// this is probably overly hacky
-			log.Debugln("ignoring by deleting pkg: ", pkg)
-			delete(db.DescriptionsBySourceType[cran.Binary], pkg)
-			delete(db.DescriptionsBySourceType[cran.Source], pkg)
-		}
-	}
-	log.Infoln("Package installation cache directory: ", userCache(cfg.Cache))
-	log.Infoln("Database cache directory: ", filepath.Dir(pkgNexus.Db[0].GetRepoDbCacheFilePath(rv.ToFullString())))
 
 	dependencyConfigurations := gpsr.NewDefaultInstallDeps()
 	dependencyConfigurations.Default.NoRecommended = cfg.NoRecommended
@@ -211,8 +136,26 @@ func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.Ins
 	}
 	// end Descriptions deps
 
+	// the Remotes of tarballs and Descriptions decide where those dependencies come from
+	remoteSources.resolve(declaredRemotes(tarballDescriptions, descDescriptions), false)
+
+	// packages of local and url remotes are installed like tarballs, after their dependencies
+	for _, d := range remoteSources.dependencies() {
+		if !funk.Contains(cfg.Packages, d) {
+			cfg.Packages = append(cfg.Packages, d)
+		}
+	}
+
 	cfg.Packages = removeBasePackages(cfg.Packages)
 
+	if !applyPackageConstraints(pkgNexus, rv) {
+		if exitOnMissing {
+			os.Exit(1)
+		} else {
+			return pkgNexus, gpsr.InstallPlan{}, rollback.RollbackPlan{}
+		}
+	}
+
 	availableUserPackages := pkgNexus.GetPackages(cfg.Packages)
 	if len(availableUserPackages.Missing) > 0 {
 		log.Errorln("missing packages: ", availableUserPackages.Missing)
@@ -248,13 +191,30 @@ func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.Ins
 		cfg.NoRecommended,
 	)
 
-	installPlan.AdditionalPackageSources = unpackedTarballPkgs
+	installPlan.AdditionalPackageSources = remoteSources.additionalSources(unpackedTarballPkgs)
 
 	logAdditionalPackageOrigins(installPlan.AdditionalPackageSources)
 
 	rollbackPlan := rollback.CreateRollbackPlan(cfg.Library, installPlan, installedPackages)
 
 	if err != nil {
+		var unsatisfied *gpsr.UnsatisfiedDepsError
+		if errors.As(err, &unsatisfied) {
+			for _, u := range unsatisfied.Deps {
+				log.WithFields(log.Fields{
+					"pkg":       u.Package,
+					"version":   u.Version,
+					"requires":  u.Requires.ToString(),
+					"available": u.Available,
+					"repo":      u.Repo,
+				}).Error("unsatisfied version requirement")
+			}
+			if exitOnMissing {
+				os.Exit(1)
+			} else {
+				return pkgNexus, gpsr.InstallPlan{}, rollback.RollbackPlan{}
+			}
+		}
 		fmt.Println(err)
 		panic(err)
 	}
@@ -269,11 +229,14 @@ func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.Ins
 			"installed_version": p.OldVersion,
 			"update_version":    p.NewVersion,
 		}
-		if cfg.NoUpdate {
+		if p.Required {
+			log.WithFields(updateLogFields).Info("package will be replaced to satisfy a version requirement")
+			pkgsToUpdateCount++
+		} else if cfg.NoUpdate {
 			log.WithFields(updateLogFields).Warn("outdated package found")
 		} else {
 			log.WithFields(updateLogFields).Info("package will be updated")
-			pkgsToUpdateCount = len(installPlan.OutdatedPackages)
+			pkgsToUpdateCount++
 		}
 	}
 
@@ -291,7 +254,15 @@ func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.Ins
 		_, rn := pkgdl.PkgAndRepoNames()
 		installSources[rn]++
 	}
-	installSources["tarballs"] = len(installPlan.AdditionalPackageSources)
+	installSources["tarballs"] = 0
+	for _, additionalPkg := range installPlan.AdditionalPackageSources {
+		if additionalPkg.Type == "tarball" {
+			installSources["tarballs"]++
+		} else {
+			// packages of local and url remotes
+			installSources[additionalPkg.Type]++
+		}
+	}
 	fields := make(log.Fields)
 	for k, v := range installSources {
 		fields[k] = v
@@ -325,6 +296,301 @@ func planInstall(rv cran.RVersion, exitOnMissing bool) (*cran.PkgNexus, gpsr.Ins
 	return pkgNexus, installPlan, rollbackPlan
 }
 
+// scanLibrary checks whether the configured library exists and, if so,
+// collects the packages already installed in it
+func scanLibrary() (bool, map[string]desc.Desc, pacman.InstalledFromPkgs) {
+	//Check library existence
+	libraryExists, err := afero.DirExists(fs, cfg.Library)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"library": cfg.Library,
+			"error":   err,
+		}).Error("unexpected error when checking existence of library")
+	}
+
+	if !libraryExists && cfg.Strict {
+		log.WithFields(log.Fields{
+			"library": cfg.Library,
+		}).Error("library directory must exist before running pkgr in strict mode")
+	}
+
+	var installedPackages map[string]desc.Desc
+	var whereInstalledFrom pacman.InstalledFromPkgs
+
+	if libraryExists {
+		installedPackages = pacman.GetPriorInstalledPackages(fs, cfg.Library)
+		log.WithField("count", len(installedPackages)).Info("found installed packages")
+		whereInstalledFrom = pacman.GetInstallers(installedPackages)
+		notPkgr := whereInstalledFrom.NotFromPkgr()
+		if len(notPkgr) > 0 {
+			// TODO: should this say "prior installed packages" not ...
+			log.WithFields(log.Fields{
+				"packages": notPkgr,
+			}).Warn("Packages not installed by pkgr")
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"path": cfg.Library,
+		}).Info("Package Library will be created")
+		//fs.Create(cfg.Library)
+		//fs.Chmod(cfg.Library, 0755)
+	}
+	return libraryExists, installedPackages, whereInstalledFrom
+}
+
+// sharedTransport is created on first use so every repository request shares
+// one connection pool, and the limits on how hard repositories are hit
+var sharedTransport http.RoundTripper
+
+// repoTransport provides the transport for repository requests, created from the configured settings
+func repoTransport() http.RoundTripper {
+	if sharedTransport != nil {
+		return sharedTransport
+	}
+	var caBundles []string
+	if cfg.CABundle != "" {
+		caBundles = append(caBundles, cfg.CABundle)
+	}
+	// the bundle of a repository is only trusted for the hosts of the repository
+	repoURLs := make(map[string][]string)
+	for _, r := range cfg.Repos {
+		for nm, u := range r {
+			repoURLs[nm] = append(repoURLs[nm], u)
+		}
+	}
+	hostCABundles := make(map[string][]string)
+	for _, repoSlice := range cfg.Customizations.Repos {
+		for rn, val := range repoSlice {
+			if val.CABundle == "" {
+				continue
+			}
+			for _, u := range append(repoURLs[rn], val.Mirrors...) {
+				if parsed, err := url.Parse(u); err == nil && parsed.Hostname() != "" {
+					hostCABundles[parsed.Hostname()] = append(hostCABundles[parsed.Hostname()], val.CABundle)
+				}
+			}
+		}
+	}
+	transport, err := cran.NewTransport(cran.TransportConfig{
+		NoSecure:      cfg.NoSecure,
+		CABundles:     caBundles,
+		HostCABundles: hostCABundles,
+		Proxy: cran.ProxyConfig{
+			HTTP:    cfg.Proxy.HTTP,
+			HTTPS:   cfg.Proxy.HTTPS,
+			NoProxy: cfg.Proxy.NoProxy,
+		},
+		HostConnections: cfg.HostConnections,
+	})
+	if err != nil {
+		log.Fatalf("error configuring repository connections: %s", err)
+	}
+	bandwidth, err := cran.ParseBandwidth(cfg.BandwidthLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sharedTransport = cran.NewLimitedTransport(transport, cran.LimitConfig{
+		HostConnections: cfg.HostConnections,
+		Bandwidth:       bandwidth,
+	})
+	return sharedTransport
+}
+
+// newRepoFetcher provides a fetcher for repository files, identifying itself to
+// repositories with the version of R packages are fetched for and the platform
+// of the R in use
+func newRepoFetcher(rv cran.RVersion, rPlatform string) *cran.Fetcher {
+	auth := make(map[string]cran.RepoAuth)
+	for _, repoSlice := range cfg.Customizations.Repos {
+		for rn, val := range repoSlice {
+			if val.Auth == (configlib.RepoAuth{}) {
+				continue
+			}
+			auth[rn] = cran.RepoAuth{
+				Username: val.Auth.Username,
+				Password: val.Auth.Password,
+				TokenEnv: val.Auth.TokenEnv,
+				Netrc:    val.Auth.Netrc,
+			}
+		}
+	}
+	return cran.NewFetcher(cran.FetchConfig{
+		Transport: repoTransport(),
+		Retry: cran.RetryConfig{
+			Attempts: cfg.Retry.Attempts,
+			Delay:    cfg.Retry.Delay,
+		},
+		Auth:      auth,
+		Offline:   cfg.Offline,
+		UserAgent: cran.UserAgent(VERSION, rv, rPlatform),
+	})
+}
+
+// newPkgNexus builds the package database for the configured repositories
+func newPkgNexus(rv cran.RVersion, rPlatform string) *cran.PkgNexus {
+	st := cran.DefaultType()
+	cic := cran.NewInstallConfig()
+	for _, repoSlice := range cfg.Customizations.Repos {
+		for rn, val := range repoSlice {
+			rc := cran.RepoConfig{}
+			if strings.EqualFold(val.RepoType, "MPN") {
+				rc.RepoType = cran.MPN
+				rc.DefaultSourceType = cran.Binary
+			}
+			if strings.EqualFold(val.RepoType, "RSPM") {
+				rc.RepoType = cran.RSPM
+			}
+			if strings.EqualFold(val.Type, "binary") {
+				rc.DefaultSourceType = cran.Binary
+			}
+			if strings.EqualFold(val.Type, "source") {
+				rc.DefaultSourceType = cran.Source
+			}
+			if val.RepoSuffix != "" {
+				rc.RepoSuffix = val.RepoSuffix
+			}
+			cic.Repos[rn] = rc
+		}
+	}
+	var repos []cran.RepoURL
+	for _, r := range cfg.Repos {
+		for nm, url := range r {
+			repo, _ := configlib.GetRepoCustomizationByName(nm, cfg.Customizations)
+			// for now no need to check if customization exists as the repo will have a default empty string
+			// regardless so no additional logic needed
+			mirrors := repo.Mirrors
+			snapshot := cfg.Snapshot
+			if repo.Snapshot != "" {
+				snapshot = repo.Snapshot
+			}
+			if snapshot != "" {
+				url, mirrors = snapshotRepo(nm, url, mirrors, cic, snapshot)
+			}
+			repos = append(repos, cran.RepoURL{Name: nm, URL: url, Suffix: repo.RepoSuffix, Mirrors: mirrors})
+		}
+	}
+	if biocEnabled() {
+		repos = cran.WithBiocRepos(repos, biocRepos(rv))
+	}
+	pkgNexus, err := cran.NewPkgDb(repos, st, cic, rv, newRepoFetcher(rv, rPlatform))
+	var offlineErr *cran.OfflineError
+	if errors.As(err, &offlineErr) {
+		for _, u := range offlineErr.URLs {
+			log.WithField("url", u).Error("package index not in the cache")
+		}
+		log.Fatal("running offline, fetch the package indexes listed above before using --offline")
+	}
+	if err != nil {
+		log.Panicln("error getting pkgdb ", err)
+	}
+	// archived tarballs read while planning are kept for the install
+	pkgNexus.Fs, pkgNexus.CacheDir = fs, userCache(cfg.Cache)
+	log.Infoln("Default package installation type: ", st.String())
+	for _, db := range pkgNexus.Db {
+		log.Infoln(fmt.Sprintf("%v:%v (binary:source) packages available in for %s from %s", len(db.DescriptionsBySourceType[cran.Binary]), len(db.DescriptionsBySourceType[cran.Source]), db.Repo.Name, cran.MaskURL(db.Repo.URL)))
+		if db.Snapshot != "" {
+			log.Infoln(fmt.Sprintf("Using the %s snapshot of %s", db.Snapshot, db.Repo.Name))
+		}
+		for _, pkg := range cfg.IgnorePackages {
+			// to "skip" packages, we'll just completely nuke them from the pkgdb so they'll never even come up in the plan
+			// this is probably overly hacky
+			log.Debugln("ignoring by deleting pkg: ", pkg)
+			delete(db.DescriptionsBySourceType[cran.Binary], pkg)
+			delete(db.DescriptionsBySourceType[cran.Source], pkg)
+		}
+	}
+	log.Infoln("Package installation cache directory: ", userCache(cfg.Cache))
+	log.Infoln("Database cache directory: ", filepath.Dir(pkgNexus.Db[0].GetRepoDbCacheFilePath(rv.ToFullString())))
+	return pkgNexus
+}
+
+// biocEnabled tells if the Bioconductor repositories should be added to the configured repositories
+func biocEnabled() bool {
+	return cfg.Bioconductor || cfg.BiocVersion != ""
+}
+
+// biocRepos provides the Bioconductor repositories for the configured release,
+// or for the release matching the version of R
+func biocRepos(rv cran.RVersion) []cran.RepoURL {
+	version := cfg.BiocVersion
+	if version == "" {
+		var err error
+		version, err = cran.BiocVersionForR(rv)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if err := cran.CheckBiocVersion(version, rv); err != nil {
+		log.Warn(err)
+	}
+	log.Infoln("Bioconductor version: ", version)
+	repos := cran.BiocRepos(version, cfg.BiocMirror)
+	for i, r := range repos {
+		// customizations apply to the Bioconductor repositories by name, as for any other
+		repo, _ := configlib.GetRepoCustomizationByName(r.Name, cfg.Customizations)
+		repos[i].Suffix = repo.RepoSuffix
+		repos[i].Mirrors = repo.Mirrors
+	}
+	return repos
+}
+
+// snapshotRepo rewrites the url and mirrors of a repository to the snapshot date,
+// recording the snapshot in the repository configuration
+func snapshotRepo(name string, url string, mirrors []string, cic *cran.InstallConfig, snapshot string) (string, []string) {
+	rc := cic.Repos[name]
+	if !cran.SupportsSnapshot(rc.RepoType) {
+		log.WithFields(log.Fields{
+			"repo":     name,
+			"snapshot": snapshot,
+		}).Warn("snapshots only apply to repositories with a RepoType of RSPM or MPN, using the configured url")
+		return url, mirrors
+	}
+	snapshotURL, err := cran.SnapshotURL(url, rc.RepoType, snapshot)
+	if err != nil {
+		log.WithField("repo", name).Fatal(err)
+	}
+	var snapshotMirrors []string
+	for _, m := range mirrors {
+		sm, _ := cran.SnapshotURL(m, rc.RepoType, snapshot)
+		snapshotMirrors = append(snapshotMirrors, sm)
+	}
+	rc.Snapshot = snapshot
+	cic.Repos[name] = rc
+	return snapshotURL, snapshotMirrors
+}
+
+// applyPackageConstraints sets the version requirements from the Packages
+// entries on the package database, falling back to the repository archives
+// when the current version of a package does not satisfy its requirement.
+// It reports whether every requirement could be satisfied.
+func applyPackageConstraints(pkgNexus *cran.PkgNexus, rv cran.RVersion) bool {
+	satisfied := true
+	for pkg, dep := range cfg.PackageConstraints {
+		pkgNexus.SetPackageConstraint(pkg, dep)
+		if _, _, found := pkgNexus.GetPackage(pkg); found {
+			continue
+		}
+		if _, _, found := pkgNexus.GetArchivedPackage(pkg, rv); found {
+			continue
+		}
+		var available []string
+		for _, db := range pkgNexus.Db {
+			for st, descs := range db.DescriptionsBySourceType {
+				for _, pd := range descs[pkg] {
+					available = append(available, fmt.Sprintf("%s %s (%s)", db.Repo.Name, pd.Version, st))
+				}
+			}
+		}
+		log.WithFields(log.Fields{
+			"pkg":        pkg,
+			"constraint": dep.ToString(),
+			"available":  available,
+		}).Error("no repository can satisfy the version requirement")
+		satisfied = false
+	}
+	return satisfied
+}
+
 // Removes any "base" packages from the given list.
 func removeBasePackages(pkgList []string) []string {
 	var nonbasePkgList []string
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/gpsr"
+	"github.com/metrumresearchgroup/pkgr/remotes"
+)
+
+// remoteResolver adds the packages built from git remotes to the package database,
+// so that each takes the place of any repository version of the package, and
+// collects the packages of local and url remotes, which are installed like tarballs.
+// The first remote to provide a package is used, so remotes given in Packages
+// take precedence over those declared in the Remotes field of other packages.
+type remoteResolver struct {
+	pkgNexus *cran.PkgNexus
+	// resolved holds the remotes already built, by Remote.Key
+	resolved map[string]bool
+	// provided holds the remote each package is taken from
+	provided map[string]string
+	// additional holds the packages of local and url remotes, with their descriptions
+	additional   map[string]gpsr.AdditionalPkg
+	descriptions []desc.Desc
+}
+
+func newRemoteResolver(pkgNexus *cran.PkgNexus) *remoteResolver {
+	return &remoteResolver{
+		pkgNexus:   pkgNexus,
+		resolved:   make(map[string]bool),
+		provided:   make(map[string]string),
+		additional: make(map[string]gpsr.AdditionalPkg),
+	}
+}
+
+// pending is a remote waiting to be resolved
+type pending struct {
+	spec      string
+	requested bool
+}
+
+// appendPending queues the remotes declared by a package
+func appendPending(queue []pending, specs []string) []pending {
+	for _, s := range specs {
+		queue = append(queue, pending{s, false})
+	}
+	return queue
+}
+
+// resolve builds the packages of the remotes, along with the remotes declared in
+// the Remotes field of those packages, returning the names of the packages built
+// from the git remotes in specs. Requested remotes, given in Packages, must be
+// valid, while an unsupported entry in a Remotes field is skipped with a warning.
+func (rr *remoteResolver) resolve(specs []string, requested bool) []string {
+	var names []string
+	queue := make([]pending, 0, len(specs))
+	for _, s := range specs {
+		queue = append(queue, pending{s, requested})
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		r, err := remotes.Parse(next.spec)
+		if err != nil {
+			if next.requested {
+				log.WithField("remote", next.spec).Fatal(err)
+			}
+			log.WithField("remote", next.spec).Warnf("skipping remote: %s", err)
+			continue
+		}
+		if rr.resolved[r.Key()] {
+			continue
+		}
+		rr.resolved[r.Key()] = true
+		if r.Type == remotes.Local || r.Type == remotes.URL {
+			d, pkg := unpackRemote(r, rr.pkgNexus.Fetcher)
+			if !rr.provide(r, d) {
+				continue
+			}
+			rr.additional[d.Package] = pkg
+			rr.descriptions = append(rr.descriptions, d)
+			log.WithFields(log.Fields{
+				"remote":  r.String(),
+				"package": d.Package,
+				"version": d.Version,
+			}).Info("using package from remote")
+			queue = appendPending(queue, d.Remotes)
+			continue
+		}
+		pkg, err := remotes.Build(r, userCache(cfg.Cache), cfg.Offline)
+		if err != nil {
+			log.WithField("remote", r.String()).Fatal(err)
+		}
+		if !rr.provide(r, pkg.Desc) {
+			continue
+		}
+		rr.pkgNexus.AddSourcePackage(pkg.Repo(), pkg.Desc)
+		log.WithFields(log.Fields{
+			"remote":  r.String(),
+			"package": pkg.Desc.Package,
+			"version": pkg.Desc.Version,
+			"sha":     pkg.SHA,
+		}).Info("using package from remote")
+		if next.requested {
+			names = append(names, pkg.Desc.Package)
+		}
+		queue = appendPending(queue, pkg.Desc.Remotes)
+	}
+	return names
+}
+
+// provide records the remote a package is taken from, unless another remote
+// already provides the package
+func (rr *remoteResolver) provide(r remotes.Remote, d desc.Desc) bool {
+	if from, found := rr.provided[d.Package]; found {
+		log.WithFields(log.Fields{
+			"package": d.Package,
+			"remote":  r.String(),
+			"using":   from,
+		}).Warn("package is already provided by another remote")
+		return false
+	}
+	rr.provided[d.Package] = r.String()
+	return true
+}
+
+// unpackRemote provides the package of a local or url remote, unpacked into the cache
+func unpackRemote(r remotes.Remote, fetcher *cran.Fetcher) (desc.Desc, gpsr.AdditionalPkg) {
+	cacheDir := userCache(cfg.Cache)
+	source, err := remotes.Source(r, cacheDir, fetcher)
+	if err != nil {
+		log.WithField("remote", r.String()).Fatal(err)
+	}
+	var pkgDir string
+	if isDir, _ := afero.IsDir(fs, source); isDir {
+		pkgDir = copyPackageDir(fs, source, cacheDir)
+	} else {
+		pkgDir = untar(fs, source, cacheDir)
+	}
+	return readPackageDescription(fs, pkgDir), gpsr.AdditionalPkg{InstallPath: pkgDir, OriginPath: r.String(), Type: r.Type}
+}
+
+// additionalSources adds the packages of local and url remotes to those of
+// tarballs, which take precedence
+func (rr *remoteResolver) additionalSources(tarballPkgs map[string]gpsr.AdditionalPkg) map[string]gpsr.AdditionalPkg {
+	if len(rr.additional) == 0 {
+		return tarballPkgs
+	}
+	sources := make(map[string]gpsr.AdditionalPkg)
+	for name, pkg := range rr.additional {
+		sources[name] = pkg
+	}
+	for name, pkg := range tarballPkgs {
+		sources[name] = pkg
+	}
+	return sources
+}
+
+// dependencies lists the dependencies of the packages of local and url remotes,
+// leaving out those that are themselves provided by local or url remotes
+func (rr *remoteResolver) dependencies() []string {
+	var deps []string
+	for _, d := range rr.descriptions {
+		for _, dep := range d.GetCombinedDependencies(false) {
+			if _, found := rr.additional[dep.Name]; !found {
+				deps = append(deps, dep.Name)
+			}
+		}
+	}
+	return deps
+}
+
+// declaredRemotes collects the Remotes fields of package descriptions
+func declaredRemotes(descriptions ...[]desc.Desc) []string {
+	var specs []string
+	for _, ds := range descriptions {
+		for _, d := range ds {
+			specs = append(specs, d.Remotes...)
+		}
+	}
+	return specs
+}
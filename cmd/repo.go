@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// repoCmd groups the commands for publishing a CRAN-like repository
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Manage CRAN-like repositories",
+	Long: `This subcommand is an entry point for publishing packages in a CRAN-like
+repository, which can then be listed under Repos in a configuration.
+
+Use the 'build' subcommand to write the package indexes of a repository.`,
+}
+
+func init() {
+	RootCmd.AddCommand(repoCmd)
+}
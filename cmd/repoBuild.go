@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/metrumresearchgroup/pkgr/logger"
+	"github.com/metrumresearchgroup/pkgr/repoindex"
+)
+
+var archiveSuperseded bool
+
+// repoBuildCmd writes the PACKAGES indexes of a repository
+var repoBuildCmd = &cobra.Command{
+	Use:   "build [flags] <dir>",
+	Short: "Write the package indexes of a CRAN-like repository",
+	Long: `Scan the package files of a CRAN-like repository and write the PACKAGES and
+PACKAGES.gz indexes that R and pkgr read, as tools::write_PACKAGES does.
+
+Source tarballs are read from <dir>/src/contrib, and binaries from each
+<dir>/bin/<platform>/contrib/<R version> directory, eg bin/windows/contrib/4.3
+or bin/linux/jammy/contrib/4.3. Each file must be named <package>_<version>
+for the package and version in its DESCRIPTION file. The index lists the newest
+version of each package, along with the MD5sum of its file. Any PACKAGES.rds is
+removed, as R would read it in place of the new index.
+
+If --archive is passed, older versions are moved to the Archive directory,
+eg src/contrib/Archive/<package>/, where 'pkgr install' looks for a version
+that a package entry requires.
+
+A relative <dir> is taken relative to the configuration file, like any other
+path.`,
+	Example: `  # Index the packages of a repository
+  pkgr repo build ./repo
+  # Also move superseded versions to the archive
+  pkgr repo build --archive ./repo`,
+	Args: cobra.ExactArgs(1),
+	RunE: rRepoBuild,
+}
+
+func init() {
+	repoBuildCmd.Flags().BoolVar(&archiveSuperseded, "archive", false, "move superseded versions of packages to the Archive directory")
+	repoCmd.AddCommand(repoBuildCmd)
+}
+
+func rRepoBuild(cmd *cobra.Command, args []string) error {
+	logger.AddLogFile(cfg.Logging.All, cfg.Logging.Overwrite)
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	indexes, err := repoindex.Build(dir, repoindex.Options{Archive: archiveSuperseded})
+	for _, idx := range indexes {
+		for _, a := range idx.Archived {
+			log.WithField("file", a).Info("archived superseded package")
+		}
+		log.WithFields(log.Fields{
+			"dir":      idx.Dir,
+			"packages": idx.Packages,
+		}).Info("wrote package index")
+	}
+	if err != nil {
+		log.WithField("dir", dir).Error(err)
+		return err
+	}
+	return nil
+}
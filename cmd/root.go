@@ -85,6 +85,9 @@ func rootInit() {
 	RootCmd.PersistentFlags().Int("threads", 0, "number of threads to execute with")
 	_ = viper.BindPFlag("threads", RootCmd.PersistentFlags().Lookup("threads"))
 
+	RootCmd.PersistentFlags().Int("downloads", 0, "number of packages to download at a time (default 10)")
+	_ = viper.BindPFlag("downloads", RootCmd.PersistentFlags().Lookup("downloads"))
+
 	RootCmd.PersistentFlags().Bool("preview", false, "preview action, but don't actually run command")
 	_ = viper.BindPFlag("preview", RootCmd.PersistentFlags().Lookup("preview"))
 	RootCmd.PersistentFlags().MarkHidden("preview")
@@ -106,6 +109,9 @@ func rootInit() {
 
 	RootCmd.PersistentFlags().Bool("strict", cfg.Strict, "enable strict mode")
 	_ = viper.BindPFlag("strict", RootCmd.PersistentFlags().Lookup("strict"))
+
+	RootCmd.PersistentFlags().Bool("offline", cfg.Offline, "use only cached package databases and packages, without accessing repositories")
+	_ = viper.BindPFlag("offline", RootCmd.PersistentFlags().Lookup("offline"))
 }
 
 func setGlobals() {
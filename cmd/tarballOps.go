@@ -24,22 +24,7 @@ func unpackTarballs(fs afero.Fs, tarballs []string, cache string) ([]desc.Desc,
 		// replace
 		untarredFolder := untar(fs, tarballPath, cacheDir)
 
-		reader, err := fs.Open(filepath.Join(untarredFolder, "DESCRIPTION"))
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"file":  untarredFolder,
-				"error": err,
-			}).Fatal("error opening DESCRIPTION file for tarball package")
-		}
-
-		desc, err := desc.ParseDesc(reader)
-		reader.Close()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"file":  untarredFolder,
-				"error": err,
-			}).Fatal("error parsing DESCRIPTION file for tarball package")
-		}
+		desc := readPackageDescription(fs, untarredFolder)
 		descriptions = append(descriptions, desc)
 		untarredMap[desc.Package] = gpsr.AdditionalPkg{InstallPath: untarredFolder, OriginPath: tarballPath, Type: "tarball"}
 	}
@@ -47,6 +32,27 @@ func unpackTarballs(fs afero.Fs, tarballs []string, cache string) ([]desc.Desc,
 	return descriptions, untarredMap
 }
 
+// readPackageDescription parses the DESCRIPTION file of an unpacked package
+func readPackageDescription(fs afero.Fs, pkgDir string) desc.Desc {
+	reader, err := fs.Open(filepath.Join(pkgDir, "DESCRIPTION"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  pkgDir,
+			"error": err,
+		}).Fatal("error opening DESCRIPTION file for tarball package")
+	}
+	defer reader.Close()
+
+	d, err := desc.ParseDesc(reader)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  pkgDir,
+			"error": err,
+		}).Fatal("error parsing DESCRIPTION file for tarball package")
+	}
+	return d
+}
+
 // Returns path to top-level package folder of untarred files
 func untar(fs afero.Fs, path string, cacheDir string) string {
 
@@ -145,3 +151,97 @@ func getHashedTarballName(tgzFile afero.File) (string, error) {
 	// Hashing code adapted from https://mrwaggel.be/post/generate-md5-hash-of-a-file-in-golang/
 	return tarballDirectoryName, err
 }
+
+// Returns path to a copy of a package directory in the cache, so that the package
+// is built away from its sources. As with tarballs, the copy is named by a hash of
+// the content, so it is made again whenever the package changes.
+func copyPackageDir(fs afero.Fs, dir string, cacheDir string) string {
+	hash := md5.New()
+	err := afero.Walk(fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		io.WriteString(hash, rel+"\n")
+		f, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(hash, f)
+		return err
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  dir,
+			"error": err,
+		}).Fatal("error while creating hash for package directory")
+	}
+	absDir, _ := filepath.Abs(dir)
+	copyDirectoryPath := filepath.Join(cacheDir, hex.EncodeToString(hash.Sum(nil)[:8]))
+	pkgDir := filepath.Join(copyDirectoryPath, filepath.Base(absDir))
+	if exists, _ := afero.DirExists(fs, pkgDir); exists {
+		logrus.WithFields(logrus.Fields{
+			"cached_package": pkgDir,
+			"source_dir":     dir,
+		}).Debug("using cached copy of package directory.")
+		return pkgDir
+	}
+
+	// copy into a temporary directory first so an incomplete copy is never used
+	tmpDir, err := afero.TempDir(fs, cacheDir, filepath.Base(copyDirectoryPath)+".tmp")
+	if err == nil {
+		err = copyDir(fs, dir, filepath.Join(tmpDir, filepath.Base(absDir)))
+	}
+	if err == nil {
+		fs.RemoveAll(copyDirectoryPath)
+		err = fs.Rename(tmpDir, copyDirectoryPath)
+	}
+	if err != nil {
+		fs.RemoveAll(tmpDir)
+		logrus.WithFields(logrus.Fields{
+			"path":  dir,
+			"error": err,
+		}).Fatal("error while copying package directory to the cache")
+	}
+	return pkgDir
+}
+
+// copyDir copies the regular files of a directory tree, leaving out any git metadata
+func copyDir(fs afero.Fs, src string, dest string) error {
+	return afero.Walk(fs, src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.IsDir():
+			return fs.MkdirAll(target, info.Mode().Perm()|0700)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		in, err := fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := fs.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyPackageDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tool")
+	for _, d := range []string{"R", ".git"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.0.0\nImports: R6\n",
+		"R/tool.R":    "tool <- function() 1\n",
+		".git/HEAD":   "ref: refs/heads/main\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := t.TempDir()
+	osFs := afero.NewOsFs()
+
+	pkgDir := copyPackageDir(osFs, dir, cache)
+	assert.Equal(t, "tool", filepath.Base(pkgDir))
+	assert.Equal(t, cache, filepath.Dir(filepath.Dir(pkgDir)))
+	assert.FileExists(t, filepath.Join(pkgDir, "R", "tool.R"))
+	assert.NoDirExists(t, filepath.Join(pkgDir, ".git"))
+	d := readPackageDescription(osFs, pkgDir)
+	assert.Equal(t, "tool", d.Package)
+	assert.Equal(t, "1.0.0", d.Version)
+
+	// the copy is reused until the package changes
+	assert.Equal(t, pkgDir, copyPackageDir(osFs, dir, cache))
+	if err := os.WriteFile(filepath.Join(dir, "R", "tool.R"), []byte("tool <- function() 2\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	changed := copyPackageDir(osFs, dir, cache)
+	assert.NotEqual(t, pkgDir, changed)
+	content, err := os.ReadFile(filepath.Join(changed, "R", "tool.R"))
+	assert.NoError(t, err)
+	assert.Equal(t, "tool <- function() 2\n", string(content))
+}
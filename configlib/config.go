@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 
@@ -17,9 +18,11 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
 	"github.com/metrumresearchgroup/pkgr/gpsr"
 	"github.com/metrumresearchgroup/pkgr/rcmd"
 	"github.com/metrumresearchgroup/pkgr/rcmd/rp"
+	"github.com/metrumresearchgroup/pkgr/remotes"
 )
 
 // packrat uses R.version platform, which is not the same as the Platform
@@ -44,6 +47,12 @@ func NewConfig(cfgPath string, cfg *PkgrConfig) {
 		log.Fatalf("error parsing pkgr.yml: %s\n", err)
 	}
 
+	cfg.Packages, cfg.PackageRemotes = splitPackageRemotes(cfg.Packages)
+	cfg.Packages, cfg.PackageConstraints, err = parsePackageConstraints(cfg.Packages)
+	if err != nil {
+		log.Fatalf("error parsing pkgr.yml: %s\n", err)
+	}
+
 	if len(cfg.Library) == 0 {
 		rs := rcmd.NewRSettings(cfg.RPath)
 		rVersion := rcmd.GetRVersion(&rs)
@@ -59,10 +68,61 @@ func NewConfig(cfgPath string, cfg *PkgrConfig) {
 	cfg.Logging.All = expandTilde(cfg.Logging.All)
 	cfg.Logging.Install = expandTilde(cfg.Logging.Install)
 	cfg.Cache = expandTilde(cfg.Cache)
+	cfg.CABundle = expandTilde(cfg.CABundle)
+	cfg.BiocMirror = expandTilde(cfg.BiocMirror)
+	cfg.PackageRemotes = expandTildesRemotes(cfg.PackageRemotes)
+	for _, repoSlice := range cfg.Customizations.Repos {
+		for rn, rc := range repoSlice {
+			rc.CABundle = expandTilde(rc.CABundle)
+			repoSlice[rn] = rc
+		}
+	}
 
 	return
 }
 
+// splitPackageRemotes separates the Packages entries that are remotes,
+// which are resolved to package names when planning
+func splitPackageRemotes(entries []string) ([]string, []string) {
+	var pkgs, remoteSpecs []string
+	for _, entry := range entries {
+		if remotes.IsSpec(entry) {
+			remoteSpecs = append(remoteSpecs, strings.TrimSpace(entry))
+		} else {
+			pkgs = append(pkgs, entry)
+		}
+	}
+	return pkgs, remoteSpecs
+}
+
+// packageEntryRegex matches a Packages entry with an optional version
+// requirement, using the same notation as DESCRIPTION files, eg dplyr (== 1.0.10)
+var packageEntryRegex = regexp.MustCompile(`^[A-Za-z0-9.]+\s*(\(\s*(==|>=|<=|>|<)\s*[0-9]+([.-][0-9]+)+\s*\))?$`)
+
+// parsePackageConstraints splits Packages entries into bare package names
+// and the version requirements attached to them
+func parsePackageConstraints(entries []string) ([]string, map[string]desc.Dep, error) {
+	var pkgs []string
+	constraints := make(map[string]desc.Dep)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "(") {
+			pkgs = append(pkgs, entry)
+			continue
+		}
+		if !packageEntryRegex.MatchString(entry) {
+			return entries, constraints, fmt.Errorf("invalid version requirement for package entry '%s', expected a form like 'dplyr (>= 1.0.10)'", entry)
+		}
+		dep := desc.ParseDep(entry)
+		if existing, found := constraints[dep.Name]; found && existing != dep {
+			return entries, constraints, fmt.Errorf("conflicting version requirements for package %s: %s and %s", dep.Name, existing.ToString(), dep.ToString())
+		}
+		constraints[dep.Name] = dep
+		pkgs = append(pkgs, dep.Name)
+	}
+	return pkgs, constraints, nil
+}
+
 /// expand the ~ at the beginning of a path to the home directory.
 /// consider any problems a fatal error.
 func expandTilde(p string) string {
@@ -87,6 +147,19 @@ func expandTildes(paths []string) []string {
 	return expanded
 }
 
+/// For local remotes, expand the ~ at the beginning of the path to the home directory.
+/// consider any problems a fatal error.
+func expandTildesRemotes(specs []string) []string {
+	var expanded []string
+	for _, spec := range specs {
+		if path, found := strings.CutPrefix(spec, remotes.Local+"::"); found {
+			spec = remotes.Local + "::" + expandTilde(path)
+		}
+		expanded = append(expanded, spec)
+	}
+	return expanded
+}
+
 /// In the PkgrConfig object, Repos are stored as a list of key-value pairs.
 /// Keys are repo names and values are repos to those repos
 /// For each key-value pair, expand the prefix ~ to be the home directory, if applicable.
@@ -217,6 +290,7 @@ func loadDefaultSettings() {
 	viper.SetDefault("rpath", "R")
 	// setting this to GOMAXPROCS(0) because NumCPU() won't work well with the scheduler.
 	viper.SetDefault("threads", runtime.GOMAXPROCS(0))
+	viper.SetDefault("downloads", cran.DefaultDownloads)
 }
 
 // IsCustomizationSet ...
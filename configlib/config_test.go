@@ -14,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
 	"github.com/metrumresearchgroup/pkgr/gpsr"
 	"github.com/metrumresearchgroup/pkgr/rcmd"
 	log "github.com/sirupsen/logrus"
@@ -612,6 +613,58 @@ func TestGetLibraryPathRenv(t *testing.T) {
 		library)
 }
 
+func TestParsePackageConstraints(t *testing.T) {
+	pkgs, constraints, err := parsePackageConstraints([]string{
+		"R6",
+		"dplyr (== 1.0.10)",
+		"data.table (>= 1.14)",
+		"  rlang ( < 1.1.0 )",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"R6", "dplyr", "data.table", "rlang"}, pkgs)
+	assert.Equal(t, 3, len(constraints))
+	assert.Equal(t, desc.Equals, constraints["dplyr"].Constraint)
+	assert.Equal(t, "1.0.10", constraints["dplyr"].Version.String)
+	assert.Equal(t, desc.GTE, constraints["data.table"].Constraint)
+	assert.Equal(t, desc.LT, constraints["rlang"].Constraint)
+
+	for _, invalid := range []string{"dplyr (~= 1.0.10)", "dplyr (== )", "dplyr (>= 1.0.10"} {
+		_, _, err := parsePackageConstraints([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+
+	_, _, err = parsePackageConstraints([]string{"dplyr (== 1.0.10)", "dplyr (== 1.1.0)"})
+	assert.Error(t, err)
+}
+
+func TestSplitPackageRemotes(t *testing.T) {
+	pkgs, remoteSpecs := splitPackageRemotes([]string{
+		"R6",
+		"git::https://git.example.com/org/tool.git@v1.2.0",
+		"dplyr (== 1.0.10)",
+		" github::org/repo@main",
+	})
+	assert.Equal(t, []string{"R6", "dplyr (== 1.0.10)"}, pkgs)
+	assert.Equal(t, []string{"git::https://git.example.com/org/tool.git@v1.2.0", "github::org/repo@main"}, remoteSpecs)
+}
+
+func TestExpandTildesRemotes(t *testing.T) {
+	homeDirectory, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal("error determining home directory to use for testing: ", err)
+	}
+	expanded := expandTildesRemotes([]string{
+		"local::~/pkgs/tool",
+		"local::pkgs/tool_1.0.tar.gz",
+		"url::https://example.com/~user/tool_1.0.tar.gz",
+	})
+	assert.Equal(t, []string{
+		"local::" + filepath.Join(homeDirectory, "pkgs", "tool"),
+		"local::pkgs/tool_1.0.tar.gz",
+		"url::https://example.com/~user/tool_1.0.tar.gz",
+	}, expanded)
+}
+
 func TestSetCustomizations(t *testing.T) {
 	tests := []struct {
 		pkg   string
@@ -722,7 +775,7 @@ func TestSetViperCustomizations(t *testing.T) {
 				URL:  "https://mpn.metworx.com/snapshots/stable/2019-12-02",
 			},
 		}
-		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, false)
+		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, cran.NewFetcher(cran.FetchConfig{}))
 		dependencyConfigurations := gpsr.NewDefaultInstallDeps()
 
 		// build pkgSettings, normally read from the yml file, via viper
@@ -823,8 +876,8 @@ func TestSetViperCustomizations2(t *testing.T) {
 			},
 		}
 
-		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, false)
-		pkgNexus2, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, false)
+		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, cran.NewFetcher(cran.FetchConfig{}))
+		pkgNexus2, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, cran.NewFetcher(cran.FetchConfig{}))
 		dependencyConfigurations := gpsr.NewDefaultInstallDeps()
 		dependencyConfigurations2 := gpsr.NewDefaultInstallDeps()
 
@@ -919,8 +972,8 @@ func TestSetPkgConfig(t *testing.T) {
 			},
 		}
 
-		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, false)
-		pkgNexus2, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, false)
+		pkgNexus, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, cran.NewFetcher(cran.FetchConfig{}))
+		pkgNexus2, _ := cran.NewPkgDb(urls, cran.Source, &installConfig, cran.RVersion{}, cran.NewFetcher(cran.FetchConfig{}))
 		dependencyConfigurations := gpsr.NewDefaultInstallDeps()
 		dependencyConfigurations2 := gpsr.NewDefaultInstallDeps()
 
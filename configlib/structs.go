@@ -1,5 +1,12 @@
 package configlib
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
 // PkgConfig provides information about custom settings during package installation
 type PkgConfig struct {
 	Suggests bool              `yaml:"Suggests,omitempty"`
@@ -17,6 +24,32 @@ type RepoConfig struct {
 	Type       string `yaml:"Type,omitempty"`
 	RepoType   string `yaml:"RepoType,omitempty"`
 	RepoSuffix string `yaml:"RepoSuffix,omitempty"`
+	// Mirrors are alternate URLs tried in order when the repository cannot serve a file
+	Mirrors []string `yaml:"Mirrors,omitempty"`
+	Auth    RepoAuth `yaml:"Auth,omitempty"`
+	// CABundle is a PEM file of certificates to trust in addition to the system pool
+	CABundle string `yaml:"CABundle,omitempty"`
+	// Snapshot overrides the top level Snapshot date for the repository
+	Snapshot string `yaml:"Snapshot,omitempty"`
+}
+
+// RepoAuth provides the credentials used to access a repository
+type RepoAuth struct {
+	Username string `yaml:"Username,omitempty"`
+	Password string `yaml:"Password,omitempty"`
+	// TokenEnv names the environment variable holding a bearer token
+	TokenEnv string `yaml:"TokenEnv,omitempty"`
+	Netrc    bool   `yaml:"Netrc,omitempty"`
+}
+
+// MarshalJSON hides the password whenever the configuration is displayed
+func (a RepoAuth) MarshalJSON() ([]byte, error) {
+	type repoAuth RepoAuth
+	masked := repoAuth(a)
+	if masked.Password != "" {
+		masked.Password = "**HIDDEN**"
+	}
+	return json.Marshal(masked)
 }
 
 // LogConfig stores information for logging purposes
@@ -27,6 +60,20 @@ type LogConfig struct {
 	Overwrite bool   `yaml:"Overwrite,omitempty"`
 }
 
+// RetryConfig controls how failed repository requests are retried
+type RetryConfig struct {
+	Attempts int           `yaml:"Attempts,omitempty"`
+	Delay    time.Duration `yaml:"Delay,omitempty"`
+}
+
+// ProxyConfig provides the proxies used to reach repositories,
+// overriding the proxy environment variables when set
+type ProxyConfig struct {
+	HTTP    string `yaml:"HTTP,omitempty"`
+	HTTPS   string `yaml:"HTTPS,omitempty"`
+	NoProxy string `yaml:"NoProxy,omitempty"`
+}
+
 // Customizations contains various custom configurations
 type Customizations struct {
 	Packages []map[string]PkgConfig  `yaml:"Packages,omitempty"`
@@ -53,6 +100,9 @@ type PkgrConfig struct {
 	LibPaths       []string            `yaml:"LibPaths,omitempty"`
 	Customizations Customizations      `yaml:"Customizations,omitempty"`
 	Threads        int                 `yaml:"Threads,omitempty"`
+	// Downloads is the number of packages downloaded at a time, separately
+	// from the Threads installing them
+	Downloads int `yaml:"Downloads,omitempty"`
 	RPath          string              `yaml:"RPath,omitempty"`
 	Cache          string              `yaml:"Cache,omitempty"`
 	Logging        LogConfig           `yaml:"Logging,omitempty"`
@@ -60,6 +110,27 @@ type PkgrConfig struct {
 	Lockfile       Lockfile            `yaml:"Lockfile,omitempty"`
 	Strict         bool                `yaml:"Strict,omitempty"`
 	NoSecure       bool                `yaml:"NoSecure,omitempty"`
+	Retry          RetryConfig         `yaml:"Retry,omitempty"`
+	CABundle       string              `yaml:"CABundle,omitempty"`
+	Proxy          ProxyConfig         `yaml:"Proxy,omitempty"`
+	// HostConnections is the number of requests made to one repository host at a time
+	HostConnections int `yaml:"HostConnections,omitempty"`
+	// BandwidthLimit caps the rate packages are downloaded at, eg 2MB per second
+	BandwidthLimit string `yaml:"BandwidthLimit,omitempty"`
+	Offline        bool                `yaml:"Offline,omitempty"`
+	// Snapshot is the date RSPM and MPN repository urls are rewritten to
+	Snapshot string `yaml:"Snapshot,omitempty"`
+	// Bioconductor adds the Bioconductor repositories for the release
+	// matching the version of R, or for BiocVersion when it is set
+	Bioconductor bool   `yaml:"Bioconductor,omitempty"`
+	BiocVersion  string `yaml:"BiocVersion,omitempty"`
+	BiocMirror   string `yaml:"BiocMirror,omitempty"`
+	// PackageConstraints holds the version requirements parsed from
+	// Packages entries such as "dplyr (== 1.0.10)", keyed by package name
+	PackageConstraints map[string]desc.Dep `yaml:"-"`
+	// PackageRemotes holds the Packages entries that are remotes rather than
+	// package names, such as "git::https://host/org/repo.git@v1.2.0"
+	PackageRemotes []string `yaml:"-"`
 }
 
 /*	viper.SetDefault("debug", false)
@@ -0,0 +1,236 @@
+package cran
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// archiveHrefRegex matches the links to files in the listing of an archive directory
+var archiveHrefRegex = regexp.MustCompile(`href="([^"/]+)"`)
+
+// archivePath provides the Path, relative to src/contrib, under which
+// CRAN-like repositories keep the older source versions of a package
+func archivePath(pkg string) string {
+	return "Archive/" + pkg
+}
+
+// GetArchivedPackage searches the archive of each repository for the highest
+// version of a package that satisfies the version requirement set for it.
+// A matching version is added to the package database, as a source package,
+// so that it will be selected by GetPackage and downloaded from the archive.
+//
+// Each candidate is read from its tarball, as only its DESCRIPTION tells the
+// versions of R it supports. When the nexus has a CacheDir, the tarballs read
+// are kept in the package cache, so a search is not downloaded again and the
+// install of the version found uses the tarball already read.
+func (pkgNexus *PkgNexus) GetArchivedPackage(pkg string, rv RVersion) (desc.Desc, PkgConfig, bool) {
+	for _, db := range pkgNexus.Db {
+		if !isCorrectRepo(pkg, db.Repo, pkgNexus.Config.Packages) {
+			continue
+		}
+		archiveURL := fmt.Sprintf("%s/src/contrib/%s", strings.TrimSuffix(db.Repo.URL, "/"), archivePath(pkg))
+		versions, err := listArchivedVersions(pkgNexus.Fetcher, db.Repo, archiveURL, pkg)
+		var oe *OfflineError
+		if errors.As(err, &oe) {
+			log.WithFields(log.Fields{
+				"pkg":  pkg,
+				"repo": db.Repo.Name,
+				"urls": oe.URLs,
+			}).Warn("offline, cannot search the repository archive")
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pkg":   pkg,
+				"repo":  db.Repo.Name,
+				"error": err,
+			}).Debug("no archive available for package")
+			continue
+		}
+		for _, version := range versions {
+			if !pkgNexus.satisfiesConstraint(pkg, version) {
+				continue
+			}
+			tarball := fmt.Sprintf("%s/%s_%s.tar.gz", archiveURL, pkg, version)
+			kept := pkgNexus.archivedTarballPath(db.Repo, pkg, version)
+			body, cached, err := pkgNexus.readArchivedTarball(db.Repo, tarball, kept)
+			var pd desc.Desc
+			if err == nil {
+				pd, err = readArchivedDescription(body, tarball, pkg)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"pkg":     pkg,
+					"version": version,
+					"repo":    db.Repo.Name,
+					"error":   err,
+				}).Warn("could not read archived package")
+				continue
+			}
+			if !cached {
+				pkgNexus.keepArchivedTarball(kept, body)
+			}
+			if pkgRConstraint, valid := isRVersionCompatible(pd, rv); !valid {
+				log.WithFields(log.Fields{
+					"pkg":     pkg,
+					"version": version,
+					"r":       pkgRConstraint.ToString(),
+				}).Debug("archived package not compatible with R version")
+				continue
+			}
+			if db.DescriptionsBySourceType[Source] == nil {
+				db.DescriptionsBySourceType[Source] = make(map[string][]desc.Desc)
+			}
+			db.DescriptionsBySourceType[Source][pkg] = addDescription(db.DescriptionsBySourceType[Source][pkg], pd)
+			pc := PkgConfig{Repo: db.Repo, Type: Source}
+			pkgNexus.Config.Packages[pkg] = pc
+			log.WithFields(log.Fields{
+				"pkg":     pkg,
+				"version": pd.Version,
+				"repo":    db.Repo.Name,
+			}).Info("using archived package version")
+			return pd, pc, true
+		}
+	}
+	return desc.Desc{}, PkgConfig{}, false
+}
+
+// listArchivedVersions lists the versions of a package found in an archive
+// directory, ordered from highest to lowest
+func listArchivedVersions(fetcher *Fetcher, repo RepoURL, archiveURL string, pkg string) ([]string, error) {
+	var listing []string
+	if strings.HasPrefix(archiveURL, "http") {
+		body, err := fetchArchiveFile(fetcher, repo, archiveURL+"/")
+		if err != nil {
+			return nil, err
+		}
+		hrefs := archiveHrefRegex.FindAllSubmatch(body, -1)
+		for _, href := range hrefs {
+			listing = append(listing, string(href[1]))
+		}
+	} else {
+		entries, err := ioutil.ReadDir(localPath(archiveURL))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			listing = append(listing, e.Name())
+		}
+	}
+	tarballRegex := regexp.MustCompile(`^` + regexp.QuoteMeta(pkg) + `_([0-9]+([.-][0-9]+)+)\.tar\.gz$`)
+	var versions []string
+	for _, f := range listing {
+		if m := tarballRegex.FindStringSubmatch(f); m != nil {
+			versions = append(versions, m[1])
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return desc.CompareVersionStrings(versions[i], versions[j]) > 0
+	})
+	return versions, nil
+}
+
+// archivedTarballPath provides the place in the package cache of an archived
+// source tarball, where it is downloaded to when installed, or an empty path
+// when the nexus has no cache
+func (pkgNexus *PkgNexus) archivedTarballPath(repo RepoURL, pkg string, version string) string {
+	if pkgNexus.CacheDir == "" {
+		return ""
+	}
+	d := PkgDl{Package: desc.Desc{Package: pkg, Version: version}, Config: PkgConfig{Repo: repo, Type: Source}}
+	return CachePath(d, pkgNexus.CacheDir, RVersion{})
+}
+
+// readArchivedTarball retrieves an archived package tarball, from its place
+// kept in the package cache when it is there, telling if it was
+func (pkgNexus *PkgNexus) readArchivedTarball(repo RepoURL, tarball string, kept string) ([]byte, bool, error) {
+	if kept != "" {
+		if body, err := afero.ReadFile(pkgNexus.Fs, kept); err == nil {
+			log.WithField("file", kept).Debug("reading archived package from the cache")
+			return body, true, nil
+		}
+	}
+	body, err := fetchArchiveFile(pkgNexus.Fetcher, repo, tarball)
+	return body, false, err
+}
+
+// keepArchivedTarball keeps an archived package tarball that was read in the
+// package cache. Failing to keep it only means it is downloaded again.
+func (pkgNexus *PkgNexus) keepArchivedTarball(kept string, body []byte) {
+	if kept == "" {
+		return
+	}
+	err := fsutil.WriteFileAtomic(pkgNexus.Fs, kept, 0644, func(w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	})
+	if err == nil {
+		index := OpenCacheIndex(pkgNexus.Fs, pkgNexus.CacheDir)
+		index.Record(kept, OriginDownloaded)
+		err = index.Save()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  kept,
+			"error": err,
+		}).Debug("could not keep archived package in the cache")
+	}
+}
+
+// readArchivedDescription parses the DESCRIPTION file inside an archived
+// package tarball, recording the MD5sum of the tarball
+func readArchivedDescription(body []byte, tarball string, pkg string) (desc.Desc, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return desc.Desc{}, err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return desc.Desc{}, fmt.Errorf("no DESCRIPTION file found in %s", tarball)
+		}
+		if err != nil {
+			return desc.Desc{}, err
+		}
+		if filepath.ToSlash(filepath.Clean(hdr.Name)) != pkg+"/DESCRIPTION" {
+			continue
+		}
+		pd, err := desc.ParseDesc(tr)
+		if err != nil {
+			return pd, err
+		}
+		pd.Path = archivePath(pkg)
+		pd.MD5sum = fmt.Sprintf("%x", md5.Sum(body))
+		return pd, nil
+	}
+}
+
+func fetchArchiveFile(fetcher *Fetcher, repo RepoURL, url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "http") {
+		return ioutil.ReadFile(localPath(url))
+	}
+	res, _, err := fetcher.Get(repo, url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,130 @@
+package cran
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func makeTestTarball(t *testing.T, pkg string, description string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: pkg + "/DESCRIPTION",
+		Mode: 0644,
+		Size: int64(len(description)),
+	}))
+	_, err := tw.Write([]byte(description))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func newArchiveServer(t *testing.T) (*httptest.Server, *int32) {
+	var tarballRequests int32
+	tarballs := map[string][]byte{
+		"/src/contrib/Archive/dplyr/dplyr_1.0.9.tar.gz":  makeTestTarball(t, "dplyr", "Package: dplyr\nVersion: 1.0.9\nImports: rlang (>= 1.0.2)\n"),
+		"/src/contrib/Archive/dplyr/dplyr_1.0.10.tar.gz": makeTestTarball(t, "dplyr", "Package: dplyr\nVersion: 1.0.10\nDepends: R (>= 99.0)\n"),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/src/contrib/Archive/dplyr/", func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := tarballs[r.URL.Path]; ok {
+			atomic.AddInt32(&tarballRequests, 1)
+			w.Write(b)
+			return
+		}
+		w.Write([]byte(`<html><body>
+<a href="/src/contrib/Archive/">Parent Directory</a>
+<a href="dplyr_0.8.5.tar.gz">dplyr_0.8.5.tar.gz</a>
+<a href="dplyr_1.0.9.tar.gz">dplyr_1.0.9.tar.gz</a>
+<a href="dplyr_1.0.10.tar.gz">dplyr_1.0.10.tar.gz</a>
+</body></html>`))
+	})
+	return httptest.NewServer(mux), &tarballRequests
+}
+
+func TestGetArchivedPackage(t *testing.T) {
+	server, tarballRequests := newArchiveServer(t)
+	defer server.Close()
+
+	repo := RepoURL{Name: "CRAN", URL: server.URL}
+	pkgNexus := &PkgNexus{
+		Db: []*RepoDb{{
+			Repo: repo,
+			DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{
+				Source: {"dplyr": {{Package: "dplyr", Version: "1.1.0"}}},
+			},
+		}},
+		Config:            NewInstallConfig(),
+		DefaultSourceType: Source,
+		Fs:                afero.NewMemMapFs(),
+		CacheDir:          "/cache",
+	}
+	rv := RVersion{Major: 4, Minor: 2, Patch: 1}
+	fetcher := NewFetcher(FetchConfig{})
+	pkgNexus.Fetcher = fetcher
+
+	pkgNexus.SetPackageConstraint("dplyr", desc.ParseDep("dplyr (< 1.1.0)"))
+	_, _, found := pkgNexus.GetPackage("dplyr")
+	assert.False(t, found, "current version should not satisfy the constraint")
+
+	// 1.0.10 requires a newer version of R, so the next highest match is used
+	pd, pc, found := pkgNexus.GetArchivedPackage("dplyr", rv)
+	require.True(t, found)
+	assert.Equal(t, "1.0.9", pd.Version)
+	assert.Equal(t, "Archive/dplyr", pd.Path)
+	assert.NotEmpty(t, pd.MD5sum)
+	assert.Contains(t, pd.Imports, "rlang")
+	assert.Equal(t, PkgConfig{Repo: repo, Type: Source}, pc)
+
+	pd, _, found = pkgNexus.GetPackage("dplyr")
+	require.True(t, found)
+	assert.Equal(t, "1.0.9", pd.Version)
+	assert.Equal(t, int32(2), atomic.LoadInt32(tarballRequests))
+
+	t.Run("keeps the tarballs read in the cache", func(t *testing.T) {
+		kept := CachePath(PkgDl{Package: pd, Config: pc}, "/cache", rv)
+		b, err := afero.ReadFile(pkgNexus.Fs, kept)
+		require.NoError(t, err)
+		assert.Equal(t, pd.MD5sum, fmt.Sprintf("%x", md5.Sum(b)))
+		assert.Equal(t, OriginDownloaded, OpenCacheIndex(pkgNexus.Fs, "/cache").Origin(kept))
+
+		// searching again, or installing the version found, downloads nothing
+		_, _, found := pkgNexus.GetArchivedPackage("dplyr", rv)
+		require.True(t, found)
+		dl, err := DownloadPackage(pkgNexus.Fs, PkgDl{Package: pd, Config: pc}, kept, rv, fetcher)
+		require.NoError(t, err)
+		assert.False(t, dl.New)
+		assert.Equal(t, int32(2), atomic.LoadInt32(tarballRequests))
+	})
+
+	t.Run("downloads from the archive", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		dest := filepath.Join("/cache", "dplyr_1.0.9.tar.gz")
+		dl, err := DownloadPackage(fs, PkgDl{Package: pd, Config: pc}, dest, rv, fetcher)
+		require.NoError(t, err)
+		assert.True(t, dl.New)
+		assert.Greater(t, dl.Size, int64(0))
+	})
+
+	t.Run("reports when no archived version satisfies the constraint", func(t *testing.T) {
+		pkgNexus.SetPackageConstraint("dplyr", desc.ParseDep("dplyr (== 0.7.0)"))
+		_, _, found := pkgNexus.GetArchivedPackage("dplyr", rv)
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,196 @@
+package cran
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hiddenValue replaces secrets whenever they would be displayed
+const hiddenValue = "**HIDDEN**"
+
+// RepoAuth contains the credentials used to access a repository
+type RepoAuth struct {
+	Username string
+	Password string
+	// TokenEnv names the environment variable holding a bearer token
+	TokenEnv string
+	// Netrc looks up credentials for each host in the netrc file
+	Netrc bool
+}
+
+// String describes the credentials without revealing any secret
+func (a RepoAuth) String() string {
+	var methods []string
+	if a.TokenEnv != "" {
+		methods = append(methods, "token from $"+a.TokenEnv)
+	}
+	if a.Username != "" {
+		methods = append(methods, "basic as "+a.Username+":"+hiddenValue)
+	}
+	if a.Netrc {
+		methods = append(methods, "netrc")
+	}
+	if len(methods) == 0 {
+		return "none"
+	}
+	return strings.Join(methods, ", ")
+}
+
+// MaskURL hides the password of any credentials embedded in a url,
+// so that it can be displayed
+func MaskURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return rawURL
+	}
+	// Redacted replaces the password with xxxxx
+	return strings.Replace(u.Redacted(), ":xxxxx@", ":"+hiddenValue+"@", 1)
+}
+
+// sameHost reports whether a request is to the host of the repository url
+func sameHost(u *url.URL, repoURL string) bool {
+	ru, err := url.Parse(repoURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, ru.Host)
+}
+
+// authorize adds the credentials configured for a repository to a request.
+// Credentials given in the configuration are only sent to the host of the
+// repository url, while netrc credentials are looked up for any host,
+// including those of mirrors.
+func (f *Fetcher) authorize(req *http.Request, repo RepoURL) {
+	auth, exists := f.auth[repo.Name]
+	if !exists {
+		return
+	}
+	if sameHost(req.URL, repo.URL) {
+		if auth.TokenEnv != "" {
+			if token := os.Getenv(auth.TokenEnv); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+				return
+			}
+		}
+		if auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+			return
+		}
+	}
+	if auth.Netrc {
+		if m, found := f.netrcMachine(req.URL.Hostname()); found {
+			req.SetBasicAuth(m.login, m.password)
+		}
+	}
+}
+
+// netrcMachine looks up the netrc entry for a host, falling back to the default entry.
+// The netrc file is read once, from $NETRC if set or the home directory otherwise.
+func (f *Fetcher) netrcMachine(host string) (netrcMachine, bool) {
+	f.netrcOnce.Do(func() {
+		path := os.Getenv("NETRC")
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return
+			}
+			name := ".netrc"
+			if runtime.GOOS == "windows" {
+				name = "_netrc"
+			}
+			path = filepath.Join(home, name)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  path,
+				"error": err,
+			}).Debug("could not read netrc file")
+			return
+		}
+		f.netrc = parseNetrc(string(data))
+	})
+	var fallback *netrcMachine
+	for i, m := range f.netrc {
+		if m.machine == "" {
+			if fallback == nil {
+				fallback = &f.netrc[i]
+			}
+			continue
+		}
+		if strings.EqualFold(m.machine, host) {
+			return m, true
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return netrcMachine{}, false
+}
+
+// netrcMachine is an entry of a netrc file, with an empty machine for the default entry
+type netrcMachine struct {
+	machine  string
+	login    string
+	password string
+}
+
+// parseNetrc parses the machine entries of a netrc file, as described in ftp(1)
+func parseNetrc(data string) []netrcMachine {
+	var machines []netrcMachine
+	var m *netrcMachine
+	inMacro := false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// a macro definition ends at the first blank line
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine", "default":
+				if m != nil {
+					machines = append(machines, *m)
+				}
+				m = &netrcMachine{}
+				if fields[i] == "machine" && i+1 < len(fields) {
+					i++
+					m.machine = fields[i]
+				}
+			case "login", "password", "account":
+				if i+1 >= len(fields) {
+					continue
+				}
+				i++
+				if m == nil {
+					continue
+				}
+				if fields[i-1] == "login" {
+					m.login = fields[i]
+				} else if fields[i-1] == "password" {
+					m.password = fields[i]
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if m != nil {
+		machines = append(machines, *m)
+	}
+	return machines
+}
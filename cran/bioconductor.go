@@ -0,0 +1,138 @@
+package cran
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultBiocMirror is the host of the Bioconductor repositories
+const DefaultBiocMirror = "https://bioconductor.org"
+
+// biocRelease pairs a Bioconductor release with the version of R it is built for
+type biocRelease struct {
+	Bioc string
+	R    string
+}
+
+// biocReleases lists the Bioconductor releases from oldest to newest.
+// Each version of R is served by two releases, of which the newest is used.
+var biocReleases = []biocRelease{
+	{"3.7", "3.5"},
+	{"3.8", "3.5"},
+	{"3.9", "3.6"},
+	{"3.10", "3.6"},
+	{"3.11", "4.0"},
+	{"3.12", "4.0"},
+	{"3.13", "4.1"},
+	{"3.14", "4.1"},
+	{"3.15", "4.2"},
+	{"3.16", "4.2"},
+	{"3.17", "4.3"},
+	{"3.18", "4.3"},
+	{"3.19", "4.4"},
+	{"3.20", "4.4"},
+	{"3.21", "4.5"},
+	{"3.22", "4.5"},
+}
+
+// biocRepos are the names and paths, relative to the release, of the
+// Bioconductor repositories, in the order they are searched
+var biocRepos = []struct {
+	Name string
+	Path string
+}{
+	{"BioCsoft", "bioc"},
+	{"BioCann", "data/annotation"},
+	{"BioCexp", "data/experiment"},
+	{"BioCworkflows", "workflows"},
+}
+
+// BiocVersionForR provides the newest Bioconductor release for a version of R
+func BiocVersionForR(rv RVersion) (string, error) {
+	for i := len(biocReleases) - 1; i >= 0; i-- {
+		if biocReleases[i].R == rv.ToString() {
+			return biocReleases[i].Bioc, nil
+		}
+	}
+	return "", fmt.Errorf("no known Bioconductor release for R %s, set BiocVersion to choose one", rv.ToString())
+}
+
+// CheckBiocVersion reports when a Bioconductor release is unknown
+// or is not built for the version of R
+func CheckBiocVersion(version string, rv RVersion) error {
+	for _, r := range biocReleases {
+		if r.Bioc != version {
+			continue
+		}
+		if r.R != rv.ToString() {
+			return fmt.Errorf("Bioconductor %s is built for R %s, not R %s", version, r.R, rv.ToString())
+		}
+		return nil
+	}
+	return fmt.Errorf("Bioconductor %s is not a known release", version)
+}
+
+// BiocRepos provides the software, annotation, experiment and workflows
+// repositories of a Bioconductor release, served from the mirror
+func BiocRepos(version string, mirror string) []RepoURL {
+	if mirror == "" {
+		mirror = DefaultBiocMirror
+	}
+	base := fmt.Sprintf("%s/packages/%s", strings.TrimSuffix(mirror, "/"), version)
+	var repos []RepoURL
+	for _, r := range biocRepos {
+		repos = append(repos, RepoURL{Name: r.Name, URL: base + "/" + r.Path})
+	}
+	return repos
+}
+
+// WithBiocRepos adds the Bioconductor repositories ahead of the first CRAN repository,
+// as BiocManager does, or after every repository when none is CRAN. The repositories
+// are otherwise searched in the order given, and a Bioconductor repository that is
+// already listed by name is left as it is.
+func WithBiocRepos(repos []RepoURL, bioc []RepoURL) []RepoURL {
+	listed := make(map[string]bool)
+	for _, r := range repos {
+		listed[r.Name] = true
+	}
+	var add []RepoURL
+	for _, r := range bioc {
+		if !listed[r.Name] {
+			add = append(add, r)
+		}
+	}
+	at := len(repos)
+	for i, r := range repos {
+		if isCRAN(r) {
+			at = i
+			break
+		}
+	}
+	result := make([]RepoURL, 0, len(repos)+len(add))
+	result = append(result, repos[:at]...)
+	result = append(result, add...)
+	return append(result, repos[at:]...)
+}
+
+// isCRAN tells if a repository is CRAN, or a mirror or snapshot of it,
+// from its name or url
+func isCRAN(r RepoURL) bool {
+	if strings.EqualFold(r.Name, "CRAN") {
+		return true
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(strings.ToLower(u.Hostname()), "r-project.org") {
+		return true
+	}
+	// Posit Package Manager serves CRAN under a cran path, eg /cran/latest
+	for _, segment := range strings.Split(u.Path, "/") {
+		if strings.EqualFold(segment, "cran") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package cran
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBiocVersionForR(t *testing.T) {
+	tests := []struct {
+		rv       RVersion
+		expected string
+	}{
+		{RVersion{3, 6, 3}, "3.10"},
+		{RVersion{4, 2, 1}, "3.16"},
+		{RVersion{4, 3, 2}, "3.18"},
+		{RVersion{4, 5, 0}, "3.22"},
+	}
+	for _, tt := range tests {
+		version, err := BiocVersionForR(tt.rv)
+		require.NoError(t, err, tt.rv.ToString())
+		assert.Equal(t, tt.expected, version, tt.rv.ToString())
+	}
+	_, err := BiocVersionForR(RVersion{3, 2, 0})
+	assert.Error(t, err)
+
+	assert.NoError(t, CheckBiocVersion("3.17", RVersion{4, 3, 2}))
+	assert.Error(t, CheckBiocVersion("3.16", RVersion{4, 3, 2}))
+	assert.Error(t, CheckBiocVersion("2.99", RVersion{4, 3, 2}))
+}
+
+func TestBiocRepos(t *testing.T) {
+	assert.Equal(t, []RepoURL{
+		{Name: "BioCsoft", URL: "https://bioconductor.org/packages/3.18/bioc"},
+		{Name: "BioCann", URL: "https://bioconductor.org/packages/3.18/data/annotation"},
+		{Name: "BioCexp", URL: "https://bioconductor.org/packages/3.18/data/experiment"},
+		{Name: "BioCworkflows", URL: "https://bioconductor.org/packages/3.18/workflows"},
+	}, BiocRepos("3.18", ""))
+}
+
+func TestWithBiocRepos(t *testing.T) {
+	bioc := BiocRepos("3.18", "")
+	names := func(repos []RepoURL) []string {
+		var n []string
+		for _, r := range repos {
+			n = append(n, r.Name)
+		}
+		return n
+	}
+	internal := RepoURL{Name: "Internal", URL: "https://pkgs.example.com"}
+	cranRepo := RepoURL{Name: "Posit", URL: "https://packagemanager.posit.co/cran/latest"}
+	assert.Equal(t,
+		[]string{"Internal", "BioCsoft", "BioCann", "BioCexp", "BioCworkflows", "Posit"},
+		names(WithBiocRepos([]RepoURL{internal, cranRepo}, bioc)))
+	assert.Equal(t,
+		[]string{"Internal", "BioCsoft", "BioCann", "BioCexp", "BioCworkflows"},
+		names(WithBiocRepos([]RepoURL{internal}, bioc)))
+	// a release listed by hand is kept where it is
+	assert.Equal(t,
+		[]string{"BioCsoft", "BioCann", "BioCexp", "BioCworkflows", "CRAN"},
+		names(WithBiocRepos([]RepoURL{{Name: "BioCsoft", URL: "https://bioconductor.org/packages/3.17/bioc"}, {Name: "CRAN", URL: "https://cran.r-project.org"}}, bioc)))
+}
+
+func TestBiocReposFromMirror(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	rv := RVersion{4, 3, 2}
+	version, err := BiocVersionForR(rv)
+	require.NoError(t, err)
+	mirror, err := filepath.Abs(filepath.Join("testdata", "bioconductor"))
+	require.NoError(t, err)
+
+	pkgNexus, err := NewPkgDb(BiocRepos(version, mirror), Source, NewInstallConfig(), rv, NewFetcher(FetchConfig{}))
+	require.NoError(t, err)
+	for pkg, repo := range map[string]string{
+		"S4Vectors":    "BioCsoft",
+		"org.Hs.eg.db": "BioCann",
+		"airway":       "BioCexp",
+		"rnaseqGene":   "BioCworkflows",
+	} {
+		pd, cfg, found := pkgNexus.GetPackage(pkg)
+		require.True(t, found, pkg)
+		assert.Equal(t, repo, cfg.Repo.Name, pkg)
+		assert.Equal(t, pkg, pd.Package)
+	}
+}
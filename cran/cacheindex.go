@@ -0,0 +1,274 @@
+package cran
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// CacheIndexFile is the file at the top of the package cache that records when
+// each package file in the cache was last used
+const CacheIndexFile = "pkgr-cache-index.json"
+
+// The origins of a package file in the cache
+const (
+	// OriginDownloaded is a package downloaded from its repository
+	OriginDownloaded = "downloaded"
+	// OriginBuilt is a binary built while installing the source package
+	OriginBuilt = "built"
+)
+
+// CacheIndex records when each file in the package cache was last used, by a
+// download or an install from the cache, so that the files used least recently
+// can be removed first. It also records where each file came from, and the
+// repository each directory of the cache holds the packages of.
+type CacheIndex struct {
+	fs     afero.Fs
+	dir    string
+	mu     sync.Mutex
+	used   map[string]time.Time
+	origin map[string]string
+	repos  map[string]string
+	// recorded holds the files whose origin was recorded since the index was opened
+	recorded map[string]bool
+}
+
+// cacheIndexFile is the format of the index on disk, keyed by the path of each
+// file relative to the cache, with forward slashes
+type cacheIndexFile struct {
+	LastUsed map[string]time.Time `json:"last_used"`
+	Origin   map[string]string    `json:"origin,omitempty"`
+	// Repos holds the URL of the repository of each directory of the cache,
+	// with any credentials masked
+	Repos map[string]string `json:"repos,omitempty"`
+}
+
+// OpenCacheIndex reads the index of the package cache in dir, starting an empty
+// index when there is none or it cannot be read
+func OpenCacheIndex(fs afero.Fs, dir string) *CacheIndex {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	ci := &CacheIndex{fs: fs, dir: dir, recorded: make(map[string]bool)}
+	f, err := readCacheIndex(fs, dir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  filepath.Join(dir, CacheIndexFile),
+			"error": err,
+		}).Warn("could not read cache index, starting a new one")
+	}
+	ci.used, ci.origin, ci.repos = f.LastUsed, f.Origin, f.Repos
+	return ci
+}
+
+func readCacheIndex(fs afero.Fs, dir string) (cacheIndexFile, error) {
+	empty := cacheIndexFile{
+		LastUsed: make(map[string]time.Time),
+		Origin:   make(map[string]string),
+		Repos:    make(map[string]string),
+	}
+	b, err := afero.ReadFile(fs, filepath.Join(dir, CacheIndexFile))
+	if os.IsNotExist(err) {
+		return empty, nil
+	}
+	if err != nil {
+		return empty, err
+	}
+	var f cacheIndexFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return empty, err
+	}
+	if f.LastUsed == nil {
+		f.LastUsed = empty.LastUsed
+	}
+	if f.Origin == nil {
+		f.Origin = empty.Origin
+	}
+	if f.Repos == nil {
+		f.Repos = empty.Repos
+	}
+	return f, nil
+}
+
+// key provides the path of a file relative to the cache, or false when the file
+// is outside the cache
+func (ci *CacheIndex) key(path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	rel, err := filepath.Rel(ci.dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Touch records that a file in the cache was used now. A nil index records nothing.
+func (ci *CacheIndex) Touch(path string) {
+	if ci == nil {
+		return
+	}
+	k, ok := ci.key(path)
+	if !ok {
+		return
+	}
+	ci.mu.Lock()
+	ci.used[k] = time.Now()
+	ci.mu.Unlock()
+}
+
+// Record records that a file was added to the cache now, and where it came from.
+// A nil index records nothing.
+func (ci *CacheIndex) Record(path string, origin string) {
+	if ci == nil {
+		return
+	}
+	k, ok := ci.key(path)
+	if !ok {
+		return
+	}
+	ci.mu.Lock()
+	ci.used[k] = time.Now()
+	ci.origin[k] = origin
+	ci.recorded[k] = true
+	ci.mu.Unlock()
+}
+
+// RecordRepo records the repository that a directory of the cache holds the
+// packages of, as the directory is named by a hash of its URL
+func (ci *CacheIndex) RecordRepo(r RepoURL) {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	ci.repos[RepoURLHash(r)] = MaskURL(r.URL)
+	ci.mu.Unlock()
+}
+
+// RecordRepoURL records the URL of the repository a directory of the cache holds
+// the packages of, as another cache recorded it, unless a URL is already recorded
+func (ci *CacheIndex) RecordRepoURL(dir string, url string) {
+	if ci == nil || url == "" {
+		return
+	}
+	ci.mu.Lock()
+	if _, found := ci.repos[dir]; !found {
+		ci.repos[dir] = url
+	}
+	ci.mu.Unlock()
+}
+
+// Origin provides where a file in the cache came from, or an empty string when
+// the index has no record of it
+func (ci *CacheIndex) Origin(path string) string {
+	if ci == nil {
+		return ""
+	}
+	k, ok := ci.key(path)
+	if !ok {
+		return ""
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.origin[k]
+}
+
+// RepoURL provides the URL of the repository a directory of the cache holds the
+// packages of, or false when the index has no record of it
+func (ci *CacheIndex) RepoURL(dir string) (string, bool) {
+	if ci == nil {
+		return "", false
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	url, found := ci.repos[dir]
+	return url, found
+}
+
+// LastUsed provides when a file in the cache was last used, or false when the
+// index has no record of it
+func (ci *CacheIndex) LastUsed(path string) (time.Time, bool) {
+	if ci == nil {
+		return time.Time{}, false
+	}
+	k, ok := ci.key(path)
+	if !ok {
+		return time.Time{}, false
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	t, found := ci.used[k]
+	return t, found
+}
+
+// Save writes the index to the cache. Records written by other runs since the
+// index was opened are kept, taking the latest use of each file, and records of
+// files no longer in the cache are dropped.
+func (ci *CacheIndex) Save() error {
+	if ci == nil {
+		return nil
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if err := ci.fs.MkdirAll(ci.dir, 0777); err != nil {
+		return err
+	}
+	// runs sharing the cache save one at a time, so none lose the records of another
+	lock, err := LockFile(ci.fs, filepath.Join(ci.dir, CacheIndexFile))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	onDisk, _ := readCacheIndex(ci.fs, ci.dir)
+	for k, t := range onDisk.LastUsed {
+		if t.After(ci.used[k]) {
+			ci.used[k] = t
+		}
+	}
+	for k, origin := range onDisk.Origin {
+		if !ci.recorded[k] {
+			ci.origin[k] = origin
+		}
+	}
+	for dir, url := range onDisk.Repos {
+		if _, found := ci.repos[dir]; !found {
+			ci.repos[dir] = url
+		}
+	}
+	for k := range ci.used {
+		if _, err := ci.fs.Stat(filepath.Join(ci.dir, filepath.FromSlash(k))); os.IsNotExist(err) {
+			delete(ci.used, k)
+		}
+	}
+	for k := range ci.origin {
+		if _, found := ci.used[k]; !found {
+			delete(ci.origin, k)
+		}
+	}
+	for dir := range ci.repos {
+		if _, err := ci.fs.Stat(filepath.Join(ci.dir, dir)); os.IsNotExist(err) {
+			delete(ci.repos, dir)
+		}
+	}
+	b, err := json.MarshalIndent(cacheIndexFile{LastUsed: ci.used, Origin: ci.origin, Repos: ci.repos}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written alongside and renamed, so a run reading the index never sees half of it
+	return fsutil.WriteFileAtomic(ci.fs, filepath.Join(ci.dir, CacheIndexFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
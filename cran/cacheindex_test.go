@@ -0,0 +1,95 @@
+package cran
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheIndex(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := "/cache"
+	r6 := filepath.Join(dir, "CRAN-abc", "src", "R6_2.5.1.tar.gz")
+	cli := filepath.Join(dir, "CRAN-abc", "src", "cli_3.6.1.tar.gz")
+	for _, f := range []string{r6, cli} {
+		require.NoError(t, afero.WriteFile(fs, f, []byte("pkg"), 0644))
+	}
+
+	index := OpenCacheIndex(fs, dir)
+	_, found := index.LastUsed(r6)
+	assert.False(t, found)
+	before := time.Now()
+	index.Touch(r6)
+	index.Touch("/elsewhere/R6_2.5.1.tar.gz")
+	used, found := index.LastUsed(r6)
+	assert.True(t, found)
+	assert.False(t, used.Before(before))
+	require.NoError(t, index.Save())
+
+	// another run records a later use of its own while this one was open
+	other := OpenCacheIndex(fs, dir)
+	other.Touch(cli)
+	require.NoError(t, other.Save())
+	index.Touch(cli)
+	require.NoError(t, fs.Remove(r6))
+	require.NoError(t, index.Save())
+
+	reopened := OpenCacheIndex(fs, dir)
+	_, found = reopened.LastUsed(r6)
+	assert.False(t, found, "files no longer in the cache are dropped")
+	_, found = reopened.LastUsed(cli)
+	assert.True(t, found)
+	_, found = reopened.LastUsed("/elsewhere/R6_2.5.1.tar.gz")
+	assert.False(t, found)
+
+	var nilIndex *CacheIndex
+	nilIndex.Touch(r6)
+	assert.NoError(t, nilIndex.Save())
+}
+
+func TestCacheIndexUnreadable(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, filepath.Join("/cache", CacheIndexFile), []byte("{not json"), 0644))
+	index := OpenCacheIndex(fs, "/cache")
+	require.NoError(t, afero.WriteFile(fs, "/cache/CRAN-abc/src/R6_2.5.1.tar.gz", []byte("pkg"), 0644))
+	index.Touch("/cache/CRAN-abc/src/R6_2.5.1.tar.gz")
+	assert.NoError(t, index.Save())
+	_, found := OpenCacheIndex(fs, "/cache").LastUsed("/cache/CRAN-abc/src/R6_2.5.1.tar.gz")
+	assert.True(t, found)
+}
+
+func TestCacheIndexOrigins(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cranRepo := RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	gone := RepoURL{Name: "gone", URL: "https://gone.example.com"}
+	binary := filepath.Join("/cache", RepoURLHash(cranRepo), "binary", "4.3", "R6_2.5.1.tgz")
+	source := filepath.Join("/cache", RepoURLHash(cranRepo), "src", "R6_2.5.1.tar.gz")
+	for _, f := range []string{binary, source} {
+		require.NoError(t, afero.WriteFile(fs, f, []byte("pkg"), 0644))
+	}
+
+	index := OpenCacheIndex(fs, "/cache")
+	index.RecordRepo(cranRepo)
+	index.RecordRepo(gone)
+	index.Record(binary, OriginBuilt)
+	require.NoError(t, index.Save())
+
+	// a later run downloads the source package, and only uses the binary
+	later := OpenCacheIndex(fs, "/cache")
+	later.Record(source, OriginDownloaded)
+	later.Touch(binary)
+	require.NoError(t, later.Save())
+
+	reopened := OpenCacheIndex(fs, "/cache")
+	assert.Equal(t, OriginBuilt, reopened.Origin(binary))
+	assert.Equal(t, OriginDownloaded, reopened.Origin(source))
+	url, found := reopened.RepoURL(RepoURLHash(cranRepo))
+	assert.True(t, found)
+	assert.Equal(t, "https://cran.example.com", url)
+	_, found = reopened.RepoURL(RepoURLHash(gone))
+	assert.False(t, found, "repositories with no directory in the cache are dropped")
+}
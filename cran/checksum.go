@@ -0,0 +1,101 @@
+package cran
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+// ChecksumError is returned when the contents of a package file do not match
+// the checksum recorded for it in the repository index
+type ChecksumError struct {
+	Package   string
+	Version   string
+	File      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s %s (%s): expected %s, got %s",
+		e.Algorithm, e.Package, e.Version, e.File, e.Expected, e.Actual)
+}
+
+// checksummer hashes content as it is written so a download can be verified
+// without reading the file a second time
+type checksummer struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksummer() *checksummer {
+	return &checksummer{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.md5.Write(p)
+	return c.sha256.Write(p)
+}
+
+// verify compares the hashed content against the checksums of the package
+// description. Checksums missing from the index are not checked.
+func (c *checksummer) verify(pd desc.Desc, file string) error {
+	sums := []struct {
+		algorithm string
+		expected  string
+		h         hash.Hash
+	}{
+		{"MD5", pd.MD5sum, c.md5},
+		{"SHA256", pd.SHA256, c.sha256},
+	}
+	for _, s := range sums {
+		if s.expected == "" {
+			continue
+		}
+		actual := hex.EncodeToString(s.h.Sum(nil))
+		if !strings.EqualFold(strings.TrimSpace(s.expected), actual) {
+			return &ChecksumError{
+				Package:   pd.Package,
+				Version:   pd.Version,
+				File:      file,
+				Algorithm: s.algorithm,
+				Expected:  s.expected,
+				Actual:    actual,
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyFile checks a package file against the checksums recorded for it
+// in the repository index, returning a ChecksumError on mismatch
+func VerifyFile(fs afero.Fs, path string, pd desc.Desc) error {
+	return verifyFile(fs, path, pd, path)
+}
+
+// verifyFile checks a file against the checksums of a package, naming it as
+// given in any ChecksumError
+func verifyFile(fs afero.Fs, path string, pd desc.Desc, name string) error {
+	if pd.MD5sum == "" && pd.SHA256 == "" {
+		return nil
+	}
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := newChecksummer()
+	if _, err := io.Copy(c, f); err != nil {
+		return err
+	}
+	return c.verify(pd, name)
+}
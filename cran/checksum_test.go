@@ -0,0 +1,73 @@
+package cran
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func TestDownloadPackageVerifiesChecksums(t *testing.T) {
+	tarball := []byte("not really a tarball")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	md5sum := fmt.Sprintf("%x", md5.Sum(tarball))
+	sha256sum := fmt.Sprintf("%X", sha256.Sum256(tarball))
+	rv := RVersion{Major: 4, Minor: 2, Patch: 1}
+	fetcher := NewFetcher(FetchConfig{})
+	repo := RepoURL{Name: "CRAN", URL: server.URL}
+	dest := filepath.Join("/cache", "R6_2.5.1.tar.gz")
+
+	tests := []struct {
+		name    string
+		pkg     desc.Desc
+		invalid string
+	}{
+		{name: "no checksums", pkg: desc.Desc{Package: "R6", Version: "2.5.1"}},
+		{name: "matching checksums", pkg: desc.Desc{Package: "R6", Version: "2.5.1", MD5sum: md5sum, SHA256: sha256sum}},
+		{name: "MD5 mismatch", pkg: desc.Desc{Package: "R6", Version: "2.5.1", MD5sum: "0123456789abcdef0123456789abcdef"}, invalid: "MD5"},
+		{name: "SHA256 mismatch", pkg: desc.Desc{Package: "R6", Version: "2.5.1", MD5sum: md5sum, SHA256: "deadbeef"}, invalid: "SHA256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			dl, err := DownloadPackage(fs, PkgDl{Package: tt.pkg, Config: PkgConfig{Repo: repo, Type: Source}}, dest, rv, fetcher)
+			files, _ := afero.ReadDir(fs, "/cache")
+			if tt.invalid == "" {
+				require.NoError(t, err)
+				assert.True(t, dl.New)
+				assert.Equal(t, int64(len(tarball)), dl.Size)
+				require.Len(t, files, 1)
+				assert.Equal(t, "R6_2.5.1.tar.gz", files[0].Name())
+				assert.NoError(t, VerifyFile(fs, dest, tt.pkg))
+				return
+			}
+			require.Error(t, err)
+			checksumErr, ok := err.(*ChecksumError)
+			require.True(t, ok)
+			assert.Equal(t, tt.invalid, checksumErr.Algorithm)
+			assert.Contains(t, err.Error(), "checksum mismatch for R6 2.5.1")
+			assert.Empty(t, files, "nothing should be left in the cache")
+		})
+	}
+
+	t.Run("bad server response", func(t *testing.T) {
+		notFound := httptest.NewServer(http.NotFoundHandler())
+		defer notFound.Close()
+		fs := afero.NewMemMapFs()
+		_, err := DownloadPackage(fs, PkgDl{Package: desc.Desc{Package: "R6", Version: "2.5.1"}, Config: PkgConfig{Repo: RepoURL{Name: "CRAN", URL: notFound.URL}, Type: Source}}, dest, rv, fetcher)
+		assert.Error(t, err)
+	})
+}
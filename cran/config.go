@@ -1,9 +1,12 @@
 package cran
 
+import "github.com/metrumresearchgroup/pkgr/desc"
+
 // NewPkgConfigDB initializes a PkgConfig map
 func NewInstallConfig() *InstallConfig {
 	return &InstallConfig{
-		Packages: make(map[string]PkgConfig),
-		Repos:    make(map[string]RepoConfig),
+		Packages:    make(map[string]PkgConfig),
+		Repos:       make(map[string]RepoConfig),
+		Constraints: make(map[string]desc.Dep),
 	}
 }
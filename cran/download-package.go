@@ -1,13 +1,11 @@
 package cran
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -59,6 +57,53 @@ const (
 	Binary
 )
 
+// DownloadFailure describes a package that could not be downloaded
+type DownloadFailure struct {
+	Package string
+	Version string
+	URL     string
+	// StatusCode is the HTTP status the repository responded with, or 0 if there was none
+	StatusCode int
+	Err        error
+}
+
+// DownloadError lists the packages that could not be downloaded
+type DownloadError struct {
+	Failures []DownloadFailure
+}
+
+func (e *DownloadError) Error() string {
+	var failed []string
+	for _, f := range e.Failures {
+		failed = append(failed, fmt.Sprintf("%s %s from %s: %s", f.Package, f.Version, f.URL, f.Err))
+	}
+	return fmt.Sprintf("failed downloading %d package(s): %s", len(e.Failures), strings.Join(failed, "; "))
+}
+
+// Packages lists the names of the packages that could not be downloaded
+func (e *DownloadError) Packages() []string {
+	var pkgs []string
+	for _, f := range e.Failures {
+		pkgs = append(pkgs, f.Package)
+	}
+	return pkgs
+}
+
+// newDownloadFailure describes why a package could not be downloaded
+func newDownloadFailure(d PkgDl, url string, err error) DownloadFailure {
+	f := DownloadFailure{
+		Package: d.Package.Package,
+		Version: d.Package.Version,
+		URL:     MaskURL(url),
+		Err:     err,
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		f.StatusCode = statusErr.StatusCode
+	}
+	return f
+}
+
 func getRepos(ds []PkgDl) map[string]RepoURL {
 	rpm := make(map[string]RepoURL)
 	for _, d := range ds {
@@ -67,90 +112,218 @@ func getRepos(ds []PkgDl) map[string]RepoURL {
 	return rpm
 }
 
-// DownloadPackages downloads a set of packages concurrently
-// noSecure will allow https fetching without validating the certificate chain.
-// This occasionally is needed for repos that have self signed or certs not fully verifiable
-// which will return errors such as x509: certificate signed by unknown authority
-func DownloadPackages(fs afero.Fs, ds []PkgDl, baseDir string, rv RVersion, noSecure bool) (*PkgMap, error) {
+// DefaultDownloads is the number of packages downloaded at a time when no
+// other number is set
+const DefaultDownloads = 10
+
+// DownloadResult is the outcome of downloading one package
+type DownloadResult struct {
+	Package  string
+	Download Download
+	Err      error
+}
+
+// DownloadQueue downloads a set of packages in the background
+type DownloadQueue struct {
+	// Results receives the result of each download as it completes, and is
+	// closed once every download is done
+	Results <-chan DownloadResult
+	stop    chan struct{}
+	stopped sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// StartDownloads starts downloading a set of packages, at most workers at a time,
+// starting each download in the order the packages are given so that packages
+// listed first are available first.
+func StartDownloads(fs afero.Fs, ds []PkgDl, baseDir string, rv RVersion, fetcher *Fetcher, workers int) *DownloadQueue {
 	startTime := time.Now()
-	result := NewPkgMap()
-	sem := make(chan struct{}, 10)
-	wg := sync.WaitGroup{}
+	if workers < 1 {
+		workers = DefaultDownloads
+	}
+	// buffered so downloads never wait on a result being received
+	results := make(chan DownloadResult, len(ds))
+	q := &DownloadQueue{
+		Results: results,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// records when each package is used, for removing those unused the longest
+	index := OpenCacheIndex(fs, baseDir)
 	rpm := getRepos(ds)
 	for _, r := range rpm {
+		index.RecordRepo(r)
 		urlHash := RepoURLHash(r)
 		for _, pt := range []string{"src", filepath.Join("binary", rv.ToString())} {
 			pkgdir := filepath.Join(baseDir, urlHash, pt)
 			err := fs.MkdirAll(pkgdir, 0777)
 			if err != nil {
 				log.WithField("dir", pkgdir).WithField("error", err.Error()).Fatal("error creating package directory ")
-				return result, err
 			}
+			removeStaleParts(fs, pkgdir)
 		}
 	}
-	log.WithField("dir", baseDir).Info("downloading required packages within directory ")
-	for _, d := range ds {
-		wg.Add(1)
-		go func(d PkgDl, wg *sync.WaitGroup) {
-			var pkgType string
-			if d.Config.Type == Default {
-				d.Config.Type = DefaultType()
-			}
-			switch d.Config.Type {
-			case Binary:
-				pkgType = "binary"
-			case Source:
-				pkgType = "src"
+	log.WithFields(log.Fields{
+		"dir":     baseDir,
+		"workers": workers,
+	}).Info("downloading required packages within directory ")
+
+	work := make(chan PkgDl)
+	go func() {
+		defer close(work)
+		for _, d := range ds {
+			// checked first, as select picks at random when both are ready
+			select {
+			case <-q.stop:
+				return
 			default:
-				pkgType = "src"
 			}
-			sem <- struct{}{}
-			defer func() {
-				<-sem
-				wg.Done()
-			}()
-			// TODO: should potentially provide a lookup mapping
-			// but would want to do this outside the goroutine that downloads\
-			// the package so didn't get invoked multiple times
-			urlHash := RepoURLHash(d.Config.Repo)
-			pkgdir := filepath.Join(baseDir, urlHash, pkgType)
-			var pkgFile string
-			if d.Config.Type == Binary {
-				pkgFile = filepath.Join(pkgdir, rv.ToString(), binaryName(d.Package.Package, d.Package.Version))
-			} else {
-				pkgFile = filepath.Join(pkgdir, fmt.Sprintf("%s_%s.tar.gz", d.Package.Package, d.Package.Version))
-			}
-			startDl := time.Now()
-			dl, err := DownloadPackage(fs, d, pkgFile, rv, noSecure)
-			if err != nil {
-				// TODO:  should this cause a failure downstream rather than just printing
-				// as right now it keeps running and just doesn't install that package?
-				log.WithField("package", d.Package.Package).Warn("downloading failed")
+			select {
+			case work <- d:
+			case <-q.stop:
 				return
 			}
+		}
+	}()
 
-			if dl.New {
-				log.WithFields(log.Fields{
-					"package": d.Package.Package,
-					"dltime":  time.Since(startDl),
-					"size":    fmt.Sprintf("%.2f MB", dl.GetMegabytes()),
-				}).Debug("download successful")
+	// packages that would need to be downloaded while offline
+	offlineErr := &OfflineError{}
+	downloadErr := &DownloadError{}
+	var errMu sync.Mutex
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				select {
+				case <-q.stop:
+					// handed over as the queue was stopped, so never started
+					continue
+				default:
+				}
+				r := downloadToCache(fs, d, baseDir, rv, fetcher)
+				if r.Err == nil && r.Download.New {
+					index.Record(r.Download.Path, OriginDownloaded)
+				} else if r.Err == nil {
+					index.Touch(r.Download.Path)
+				}
+				var oe *OfflineError
+				if errors.As(r.Err, &oe) {
+					errMu.Lock()
+					offlineErr.Add(&OfflineError{Packages: []string{d.Package.Package}, URLs: oe.URLs})
+					errMu.Unlock()
+				} else if r.Err != nil {
+					log.WithFields(log.Fields{
+						"package": d.Package.Package,
+						"error":   r.Err,
+					}).Debug("downloading failed")
+					errMu.Lock()
+					downloadErr.Failures = append(downloadErr.Failures, newDownloadFailure(d, r.Download.URL, r.Err))
+					errMu.Unlock()
+				}
+				results <- r
 			}
-			result.Put(d.Package.Package, dl)
-		}(d, &wg)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		if err := index.Save(); err != nil {
+			log.WithField("error", err).Warn("could not save cache index")
+		}
+		if len(offlineErr.Packages) > 0 {
+			sort.Strings(offlineErr.Packages)
+			sort.Strings(offlineErr.URLs)
+			q.err = offlineErr
+		} else if len(downloadErr.Failures) > 0 {
+			sort.Slice(downloadErr.Failures, func(i, j int) bool {
+				return downloadErr.Failures[i].Package < downloadErr.Failures[j].Package
+			})
+			q.err = downloadErr
+		} else {
+			log.WithField("duration", time.Since(startTime)).Info("all packages downloaded")
+		}
+		close(q.done)
+		close(results)
+	}()
+	return q
+}
+
+// Stop stops starting downloads. Downloads already started still complete and
+// send their results.
+func (q *DownloadQueue) Stop() {
+	q.stopped.Do(func() {
+		close(q.stop)
+	})
+}
+
+// Wait waits for every download started to complete. Every package that could not
+// be downloaded is listed in the DownloadError returned, unless offline, when an
+// OfflineError lists the packages that would have been downloaded.
+func (q *DownloadQueue) Wait() error {
+	<-q.done
+	return q.err
+}
+
+// DownloadPackages downloads a set of packages, at most workers at a time. Every
+// package that could not be downloaded is listed in the DownloadError returned,
+// along with the packages that were downloaded, unless offline, when an
+// OfflineError lists the packages that would have been downloaded.
+func DownloadPackages(fs afero.Fs, ds []PkgDl, baseDir string, rv RVersion, fetcher *Fetcher, workers int) (*PkgMap, error) {
+	result := NewPkgMap()
+	q := StartDownloads(fs, ds, baseDir, rv, fetcher, workers)
+	for r := range q.Results {
+		if r.Err == nil {
+			result.Put(r.Package, r.Download)
+		}
 	}
-	wg.Wait()
-	log.WithField("duration", time.Since(startTime)).Info("all packages downloaded")
-	return result, nil
+	return result, q.Wait()
+}
+
+// CachePath provides the location of a package file in the cache in baseDir
+func CachePath(d PkgDl, baseDir string, rv RVersion) string {
+	var pkgType string
+	if d.Config.Type == Default {
+		d.Config.Type = DefaultType()
+	}
+	switch d.Config.Type {
+	case Binary:
+		pkgType = "binary"
+	case Source:
+		pkgType = "src"
+	default:
+		pkgType = "src"
+	}
+	urlHash := RepoURLHash(d.Config.Repo)
+	pkgdir := filepath.Join(baseDir, urlHash, pkgType)
+	if d.Config.Type == Binary {
+		return filepath.Join(pkgdir, rv.ToString(), binaryName(d.Package.Package, d.Package.Version))
+	}
+	return filepath.Join(pkgdir, fmt.Sprintf("%s_%s.tar.gz", d.Package.Package, d.Package.Version))
+}
+
+// downloadToCache downloads a package to its location in the cache
+func downloadToCache(fs afero.Fs, d PkgDl, baseDir string, rv RVersion, fetcher *Fetcher) DownloadResult {
+	if d.Config.Type == Default {
+		d.Config.Type = DefaultType()
+	}
+	startDl := time.Now()
+	dl, err := DownloadPackage(fs, d, CachePath(d, baseDir, rv), rv, fetcher)
+	if err == nil && dl.New {
+		log.WithFields(log.Fields{
+			"package": d.Package.Package,
+			"url":     MaskURL(dl.URL),
+			"dltime":  time.Since(startDl),
+			"size":    fmt.Sprintf("%.2f MB", dl.GetMegabytes()),
+		}).Info("download successful")
+	}
+	return DownloadResult{Package: d.Package.Package, Download: dl, Err: err}
 }
 
 // DownloadPackage should download a package tarball if it doesn't exist and return
 // the path to the downloaded tarball
-//
-// noSecure will allow https fetching without validating the certificate chain.
-// This occasionally is needed for repos that have self signed or certs not fully verifiable
-// which will return errors such as x509: certificate signed by unknown authority
-func DownloadPackage(fs afero.Fs, d PkgDl, dest string, rv RVersion, noSecure bool) (Download, error) {
+func DownloadPackage(fs afero.Fs, d PkgDl, dest string, rv RVersion, fetcher *Fetcher) (Download, error) {
 	if !filepath.IsAbs(dest) {
 		cwd, _ := os.Getwd()
 		// turn to absolute
@@ -169,87 +342,84 @@ func DownloadPackage(fs afero.Fs, d PkgDl, dest string, rv RVersion, noSecure bo
 			Size:     0,
 		}, nil
 	}
-	var pkgdl string
-	if d.Config.Type == Source {
-		pkgdl = fmt.Sprintf("%s/src/contrib/%s", strings.TrimSuffix(d.Config.Repo.URL, "/"), filepath.Base(dest))
-	} else if d.Config.Repo.Suffix != "" {
-		pkgdl = fmt.Sprintf("%s/bin/%s/%s/contrib/%s/%s",
-			strings.TrimSuffix(d.Config.Repo.URL, "/"),
-			cranBinaryURL(rv),
-			d.Config.Repo.Suffix,
-			rv.ToString(),
-			filepath.Base(dest))
-	} else {
-		pkgdl = fmt.Sprintf("%s/bin/%s/contrib/%s/%s",
-			strings.TrimSuffix(d.Config.Repo.URL, "/"),
-			cranBinaryURL(rv),
-			rv.ToString(),
-			filepath.Base(dest))
+	pkgdl := packageURL(d, rv, filepath.Base(dest))
+	log.Trace(MaskURL(pkgdl))
+	if fetcher.Offline() && strings.HasPrefix(pkgdl, "http") {
+		return Download{Metadata: d}, &OfflineError{Packages: []string{d.Package.Package}, URLs: []string{MaskURL(pkgdl)}}
 	}
-	log.Trace(pkgdl)
-
-	log.WithField("package", d.Package.Package).Info("downloading package")
-	var from io.ReadCloser
 
-	client := &http.Client{}
-	if noSecure {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify : true},
-		}
-		client = &http.Client{Transport: tr}
+	// processes sharing the cache download a package one at a time, and any
+	// waiting use the package once the first has downloaded it
+	lock, err := LockFile(fs, dest)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": d.Package.Package,
+			"error":   err,
+		}).Debug("could not lock package file, downloading without a lock")
+	}
+	defer lock.Unlock()
+	if exists, _ := goutils.Exists(fs, dest); exists {
+		log.WithField("package", d.Package.Package).Debug("package downloaded by another process")
+		return Download{
+			Path:     dest,
+			New:      false,
+			Metadata: d,
+			Size:     0,
+		}, nil
 	}
 
+	log.WithField("package", d.Package.Package).Info("downloading package")
+
+	// downloaded to a .part file alongside the destination, which is only renamed
+	// once complete and verified, so a partial or corrupt download is never left
+	// in the cache under the package name
+	part := partPath(dest)
 	if strings.HasPrefix(pkgdl, "http") {
-		resp, err := client.Get(pkgdl)
-		// TODO: the response will often be valid, but return like a server 404 or other error
-		if err != nil {
-			log.WithField("package", d.Package).Warn("error downloading package")
-			return Download{Metadata: d}, err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			log.WithFields(log.Fields{
-				"package":     d.Package.Package,
-				"url":         pkgdl,
-				"status":      resp.Status,
-				"status_code": resp.StatusCode,
-			}).Warn("bad server response")
-			b, _ := ioutil.ReadAll(resp.Body)
-			log.WithField("package", d.Package.Package).Println("body: ", string(b))
-			return Download{Metadata: d}, err
-		}
-		from = resp.Body
-		// not sure if we need to close both from and resp.Body but shouldn't be problematic to call twice just in case
-		defer from.Close()
+		pkgdl, err = fetchPart(fs, fetcher, d, pkgdl, part)
 	} else {
-		from, err = fs.Open(pkgdl)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"package": d.Package.Package,
-				"path":    pkgdl,
-			}).Fatal("missing package")
-		}
-		defer from.Close()
+		err = copyPart(fs, d, localPath(pkgdl), part)
 	}
-
-	file, err := fs.Create(dest)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"package": d.Package,
-			"err":     err,
-		}).Warn("error downloading package, no tarball created")
-		return Download{}, err
+		return Download{Metadata: d, URL: pkgdl}, err
+	}
+	fi, err := fs.Stat(part)
+	if err == nil {
+		err = fs.Rename(part, dest)
 	}
-	defer file.Close()
-	size, err := io.Copy(file, from)
 	if err != nil {
-		return Download{Metadata: d}, err
+		fs.Remove(part)
+		return Download{Metadata: d, URL: pkgdl}, err
 	}
 
 	return Download{
 		Path:     dest,
 		New:      true,
 		Metadata: d,
-		Size:     size,
+		Size:     fi.Size(),
+		URL:      pkgdl,
 	}, nil
 }
+
+// packageURL provides the location of a package file in its repository.
+func packageURL(d PkgDl, rv RVersion, file string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(d.Config.Repo.URL, "/"), PackagePath(d, rv, file))
+}
+
+// PackagePath provides the path of a package file relative to the root of its
+// repository, eg src/contrib/R6_2.5.1.tar.gz. Packages with a Path, such as older
+// releases or those for another R version, are located in that subdirectory of
+// the contrib directory.
+func PackagePath(d PkgDl, rv RVersion, file string) string {
+	var contrib string
+	if d.Config.Type == Source {
+		contrib = "src/contrib"
+	} else if d.Config.Repo.Suffix != "" {
+		contrib = fmt.Sprintf("bin/%s/%s/contrib/%s", cranBinaryURL(rv), d.Config.Repo.Suffix, rv.ToString())
+	} else {
+		contrib = fmt.Sprintf("bin/%s/contrib/%s", cranBinaryURL(rv), rv.ToString())
+	}
+	if d.Package.Path != "" {
+		return fmt.Sprintf("%s/%s/%s", contrib, strings.Trim(d.Package.Path, "/"), file)
+	}
+	return fmt.Sprintf("%s/%s", contrib, file)
+}
@@ -0,0 +1,249 @@
+package cran
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryConfig controls how failed repository requests are retried
+// Attempts is the total number of requests made to each URL, and Delay
+// the wait before the first retry, which doubles for each retry after it
+type RetryConfig struct {
+	Attempts int
+	Delay    time.Duration
+}
+
+// DefaultRetryConfig is used for any retry setting left unset
+var DefaultRetryConfig = RetryConfig{Attempts: 3, Delay: time.Second}
+
+// FetchConfig contains the settings used to retrieve files from repositories
+type FetchConfig struct {
+	// Transport is shared by every request, nil uses http.DefaultTransport
+	Transport http.RoundTripper
+	Retry     RetryConfig
+	// Auth holds the credentials for each repository, by repository name
+	Auth map[string]RepoAuth
+	// Offline refuses every request, reporting the files that would have been fetched
+	Offline bool
+	// UserAgent is sent with every request, when set
+	UserAgent string
+}
+
+// Fetcher retrieves files from repositories over http(s), retrying transient
+// failures with exponential backoff and falling back to the mirrors of a repository
+type Fetcher struct {
+	client    *http.Client
+	retry     RetryConfig
+	auth      map[string]RepoAuth
+	offline   bool
+	userAgent string
+
+	netrcOnce sync.Once
+	netrc     []netrcMachine
+}
+
+// NewFetcher creates a Fetcher from the fetch settings
+func NewFetcher(fc FetchConfig) *Fetcher {
+	client := &http.Client{Transport: fc.Transport}
+	retry := fc.Retry
+	if retry.Attempts < 1 {
+		retry.Attempts = DefaultRetryConfig.Attempts
+	}
+	if retry.Delay <= 0 {
+		retry.Delay = DefaultRetryConfig.Delay
+	}
+	for name, auth := range fc.Auth {
+		if auth.TokenEnv != "" && os.Getenv(auth.TokenEnv) == "" {
+			log.WithFields(log.Fields{
+				"repo": name,
+				"env":  auth.TokenEnv,
+			}).Warn("environment variable for repository token is not set")
+		}
+	}
+	return &Fetcher{client: client, retry: retry, auth: fc.Auth, offline: fc.Offline, userAgent: fc.UserAgent}
+}
+
+// Offline reports whether the fetcher refuses to make requests
+func (f *Fetcher) Offline() bool {
+	return f != nil && f.offline
+}
+
+// OfflineError lists the packages and files that would have been
+// fetched from repositories if pkgr was not running offline
+type OfflineError struct {
+	Packages []string
+	URLs     []string
+}
+
+func (e *OfflineError) Error() string {
+	var missing []string
+	if len(e.Packages) > 0 {
+		missing = append(missing, fmt.Sprintf("packages not in the cache: %s", strings.Join(e.Packages, ", ")))
+	}
+	if len(e.URLs) > 0 {
+		missing = append(missing, fmt.Sprintf("files that would be fetched: %s", strings.Join(e.URLs, ", ")))
+	}
+	return "running offline, " + strings.Join(missing, "; ")
+}
+
+// Add includes the packages and files of another OfflineError
+func (e *OfflineError) Add(other *OfflineError) {
+	e.Packages = append(e.Packages, other.Packages...)
+	e.URLs = append(e.URLs, other.URLs...)
+}
+
+// StatusError is returned when a repository responds to a request with an
+// unsuccessful HTTP status
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed fetching %s, with status %s", e.URL, e.Status)
+}
+
+// mirrorURLs provides the location of a repository file on the repository
+// followed by its location on each mirror of the repository
+func mirrorURLs(repo RepoURL, url string) []string {
+	urls := []string{url}
+	base := strings.TrimSuffix(repo.URL, "/")
+	if !strings.HasPrefix(url, base) {
+		return urls
+	}
+	for _, m := range repo.Mirrors {
+		urls = append(urls, strings.TrimSuffix(m, "/")+strings.TrimPrefix(url, base))
+	}
+	return urls
+}
+
+// isTransient reports whether a failed request is worth retrying
+func isTransient(res *http.Response) bool {
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+}
+
+// Validator holds the response headers used to revalidate a cached copy of a file
+type Validator struct {
+	// URL the cached copy was fetched from
+	URL          string
+	ETag         string
+	LastModified string
+}
+
+// newValidator records the validators of a response
+func newValidator(url string, res *http.Response) Validator {
+	return Validator{
+		URL:          url,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+}
+
+// Get requests a file from a repository, given its url on the repository.
+// Each url is retried on transient errors, and when the repository cannot serve
+// the file each of its mirrors is tried in order. A successful response is returned
+// along with the url that served it, and the caller must close the response body.
+func (f *Fetcher) Get(repo RepoURL, url string) (*http.Response, string, error) {
+	return f.get(repo, url, Validator{}, 0)
+}
+
+// GetIfModified requests a file like Get, but only if it has changed since the
+// cached copy described by the validator. A response with status 304 Not Modified
+// is returned when it has not.
+func (f *Fetcher) GetIfModified(repo RepoURL, url string, v Validator) (*http.Response, string, error) {
+	return f.get(repo, url, v, 0)
+}
+
+// GetRange requests a file like Get, but only from the byte offset on, to resume
+// a download. A server that supports range requests responds with status
+// 206 Partial Content, while others send the whole file.
+func (f *Fetcher) GetRange(repo RepoURL, url string, offset int64) (*http.Response, string, error) {
+	return f.get(repo, url, Validator{}, offset)
+}
+
+func (f *Fetcher) get(repo RepoURL, url string, v Validator, offset int64) (*http.Response, string, error) {
+	if f.Offline() {
+		return nil, "", &OfflineError{URLs: []string{MaskURL(url)}}
+	}
+	var lastErr error
+	for i, u := range mirrorURLs(repo, url) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err == nil {
+			if f.userAgent != "" {
+				req.Header.Set("User-Agent", f.userAgent)
+			}
+			f.authorize(req, repo)
+			if offset > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+				// the range applies to the file as stored, not to a compressed encoding of it
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+			// validators only apply to the url the cached copy came from
+			if v.URL == u {
+				if v.ETag != "" {
+					req.Header.Set("If-None-Match", v.ETag)
+				}
+				if v.LastModified != "" {
+					req.Header.Set("If-Modified-Since", v.LastModified)
+				}
+			}
+			var res *http.Response
+			res, err = f.getWithRetry(req)
+			if err == nil {
+				if i > 0 {
+					log.WithFields(log.Fields{
+						"repo":  repo.Name,
+						"url":   MaskURL(u),
+						"error": lastErr,
+					}).Info("served by repository mirror")
+				}
+				return res, u, nil
+			}
+		}
+		log.WithFields(log.Fields{
+			"repo":  repo.Name,
+			"url":   MaskURL(u),
+			"error": err,
+		}).Debug("failed fetching from repository")
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+func (f *Fetcher) getWithRetry(req *http.Request) (*http.Response, error) {
+	delay := f.retry.Delay
+	url := MaskURL(req.URL.String())
+	var err error
+	for attempt := 1; attempt <= f.retry.Attempts; attempt++ {
+		if attempt > 1 {
+			log.WithFields(log.Fields{
+				"url":     url,
+				"attempt": attempt,
+				"error":   err,
+			}).Debug("retrying request")
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var res *http.Response
+		res, err = f.client.Do(req)
+		if err != nil {
+			continue
+		}
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotModified || res.StatusCode == http.StatusPartialContent {
+			return res, nil
+		}
+		res.Body.Close()
+		err = &StatusError{URL: url, StatusCode: res.StatusCode, Status: res.Status}
+		if !isTransient(res) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
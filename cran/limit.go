@@ -0,0 +1,201 @@
+package cran
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHostConnections is the number of requests made to one host at a time
+// when no other number is set
+const DefaultHostConnections = 6
+
+// LimitConfig controls how hard repositories are hit
+type LimitConfig struct {
+	// HostConnections is the number of requests made to one host at a time,
+	// each holding its place until the response body is closed
+	HostConnections int
+	// Bandwidth is the number of bytes per second read from all responses
+	// together, 0 for no limit
+	Bandwidth int64
+}
+
+// limitedTransport caps the requests in progress to each host, and paces the
+// reading of responses to the bandwidth limit
+type limitedTransport struct {
+	base      http.RoundTripper
+	perHost   int
+	mu        sync.Mutex
+	hosts     map[string]chan struct{}
+	bandwidth *bandwidthLimiter
+}
+
+// NewLimitedTransport wraps a transport with the limits, which apply to every
+// request made through it, so it should be shared by every repository connection
+func NewLimitedTransport(base http.RoundTripper, lc LimitConfig) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if lc.HostConnections < 1 {
+		lc.HostConnections = DefaultHostConnections
+	}
+	t := &limitedTransport{
+		base:    base,
+		perHost: lc.HostConnections,
+		hosts:   make(map[string]chan struct{}),
+	}
+	if lc.Bandwidth > 0 {
+		t.bandwidth = &bandwidthLimiter{rate: lc.Bandwidth}
+	}
+	return t
+}
+
+// RoundTrip waits for a place among the requests to the host before making the request
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	slots := t.hostSlots(req.URL.Host)
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-slots
+		})
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, release: release, bandwidth: t.bandwidth}
+	return res, nil
+}
+
+func (t *limitedTransport) hostSlots(host string) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slots, found := t.hosts[host]
+	if !found {
+		slots = make(chan struct{}, t.perHost)
+		t.hosts[host] = slots
+	}
+	return slots
+}
+
+// limitedBody releases the place of its request among those to the host once closed
+type limitedBody struct {
+	io.ReadCloser
+	release   func()
+	bandwidth *bandwidthLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.bandwidth != nil {
+		b.bandwidth.wait(n)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// bandwidthLimiter paces reads so that together they stay within a number of
+// bytes per second. Each read reserves the time its bytes take at that rate,
+// and waits for the reservations before it to pass.
+type bandwidthLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (b *bandwidthLimiter) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		// time left unused is not saved up for a burst later
+		b.next = now
+	}
+	delay := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.rate))
+	b.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// ParseBandwidth parses a number of bytes per second, such as 500KB or 2.5MB,
+// where a KB is 1024 bytes. A plain number is a number of bytes, and an empty
+// string is no limit.
+func ParseBandwidth(limit string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(limit))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "PS")
+	n, ok := parseSize(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth limit %q, expected a size such as 500KB or 2MB", limit)
+	}
+	return n, nil
+}
+
+// ParseSize parses a number of bytes, such as 500MB or 20GB, where a KB is 1024
+// bytes. A plain number is a number of bytes, and an empty string is 0.
+func ParseSize(size string) (int64, error) {
+	n, ok := parseSize(size)
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, expected a size such as 500MB or 20GB", size)
+	}
+	return n, nil
+}
+
+func parseSize(size string) (int64, bool) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if s == "" {
+		return 0, true
+	}
+	multiplier := float64(1)
+	for _, unit := range []struct {
+		suffix string
+		bytes  float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return int64(n * multiplier), true
+}
+
+// UserAgent provides the User-Agent sent to repositories, which includes the
+// version of R and its platform in the form R sends them, as Posit Package
+// Manager uses them to decide which binaries to serve. The platform is the one
+// the R in use reports, such as x86_64-pc-linux-gnu, and is left out when it is
+// not known, so that no binaries are served for another platform.
+func UserAgent(pkgrVersion string, rv RVersion, rPlatform string) string {
+	arch, os, ok := splitRPlatform(rPlatform)
+	if !ok {
+		return fmt.Sprintf("pkgr/%s R (%s)", pkgrVersion, rv.ToFullString())
+	}
+	return fmt.Sprintf("pkgr/%s R (%s %s %s %s)", pkgrVersion, rv.ToFullString(), rPlatform, arch, os)
+}
+
+// splitRPlatform provides the R.version arch and os of an R platform, which is
+// the arch-vendor-os triple R was built for, such as x86_64-pc-linux-musl
+func splitRPlatform(platform string) (string, string, bool) {
+	parts := strings.SplitN(platform, "-", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[2], true
+}
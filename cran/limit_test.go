@@ -0,0 +1,168 @@
+package cran
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedTransportHostConnections(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewLimitedTransport(nil, LimitConfig{HostConnections: 2})}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			if assert.NoError(t, err) {
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, most)
+}
+
+func TestLimitedTransportHoldsPlaceUntilClosed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewLimitedTransport(nil, LimitConfig{HostConnections: 1})}
+	first, err := client.Get(server.URL)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("a second request was made while the first response was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second request was not made once the first response was closed")
+	}
+}
+
+func TestLimitedTransportBandwidth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewLimitedTransport(nil, LimitConfig{Bandwidth: 10000})}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Len(t, body, 1000)
+	}
+	// each 1000 bytes takes 100ms at 10000 bytes per second, after the first
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected int64
+	}{
+		{"", 0},
+		{"2048", 2048},
+		{"500KB", 500 * 1024},
+		{"2MB", 2 * 1024 * 1024},
+		{"1.5m", 3 * 512 * 1024},
+		{"1GB/s", 1 << 30},
+		{"10 KBps", 10 * 1024},
+	}
+	for _, tt := range tests {
+		n, err := ParseBandwidth(tt.in)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.expected, n, tt.in)
+	}
+	_, err := ParseBandwidth("fast")
+	assert.Error(t, err)
+	_, err = ParseBandwidth("-1MB")
+	assert.Error(t, err)
+}
+
+func TestParseSize(t *testing.T) {
+	n, err := ParseSize("20GB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20)<<30, n)
+	n, err = ParseSize("1.5TB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3)<<39, n)
+	_, err = ParseSize("20GB/s")
+	assert.Error(t, err)
+}
+
+func TestUserAgent(t *testing.T) {
+	rv := RVersion{Major: 4, Minor: 3, Patch: 1}
+	tests := []struct {
+		platform string
+		expected string
+	}{
+		{"x86_64-pc-linux-gnu", "pkgr/3.1.0 R (4.3.1 x86_64-pc-linux-gnu x86_64 linux-gnu)"},
+		{"x86_64-pc-linux-musl", "pkgr/3.1.0 R (4.3.1 x86_64-pc-linux-musl x86_64 linux-musl)"},
+		{"aarch64-apple-darwin23.4.0", "pkgr/3.1.0 R (4.3.1 aarch64-apple-darwin23.4.0 aarch64 darwin23.4.0)"},
+		{"x86_64-w64-mingw32", "pkgr/3.1.0 R (4.3.1 x86_64-w64-mingw32 x86_64 mingw32)"},
+		{"", "pkgr/3.1.0 R (4.3.1)"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, UserAgent("3.1.0", rv, tt.platform), tt.platform)
+	}
+}
+
+func TestFetcherUserAgent(t *testing.T) {
+	var agent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = r.UserAgent()
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	ua := UserAgent("3.1.0", RVersion{Major: 4, Minor: 3, Patch: 1}, "x86_64-pc-linux-gnu")
+	assert.Equal(t, "pkgr/3.1.0 R (4.3.1 x86_64-pc-linux-gnu x86_64 linux-gnu)", ua)
+	res, _, err := NewFetcher(FetchConfig{UserAgent: ua}).Get(RepoURL{Name: "CRAN", URL: server.URL}, server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, ua, agent)
+}
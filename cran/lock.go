@@ -0,0 +1,208 @@
+package cran
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// lockSuffix is added to the name of a file in the cache for the lock held
+// while it is written
+const lockSuffix = ".lock"
+
+// takeoverSuffix is added to the name of a file in the cache, before the lock
+// suffix, for the lock held while a stale lock on the file is taken over
+const takeoverSuffix = ".takeover"
+
+var (
+	// lockRefresh is how often a held lock is marked as still in use
+	lockRefresh = 10 * time.Second
+	// staleLockAge is how long a lock can go unmarked before it is taken to
+	// belong to a process that stopped without releasing it
+	staleLockAge = 2 * time.Minute
+	// lockPoll is how often a lock held by another process is checked
+	lockPoll = 250 * time.Millisecond
+)
+
+// FileLock is a lock on a file in the cache, held by one process at a time, so
+// processes sharing the cache never write the same file at once. It is a lock
+// file created alongside the file, which works on network filesystems where
+// other locks may not, and which only processes that take the lock respect.
+type FileLock struct {
+	fs   afero.Fs
+	path string
+	// owner is written to the lock file, identifying the process and the lock
+	owner string
+	token string
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+// LockFile takes the lock on a file, waiting while another process holds it.
+// The lock is marked as in use until it is released, and a lock left unmarked
+// for longer than staleLockAge, by a process that stopped, is taken over.
+func LockFile(fs afero.Fs, path string) (*FileLock, error) {
+	waiting := false
+	for {
+		l, err := TryLockFile(fs, path)
+		if l != nil || err != nil {
+			return l, err
+		}
+		if !waiting {
+			log.WithField("file", path).Info("waiting for another process using the file")
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// TryLockFile takes the lock on a file unless another process holds it, when
+// it provides a nil lock. A stale lock is taken over, as by LockFile.
+func TryLockFile(fs afero.Fs, path string) (*FileLock, error) {
+	lockPath := path + lockSuffix
+	for {
+		l, err := createLock(fs, lockPath)
+		if err == nil {
+			l.done.Add(1)
+			go l.refresh()
+			return l, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		fi, err := fs.Stat(lockPath)
+		if os.IsNotExist(err) {
+			// released since, so it is taken again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(fi.ModTime()) <= staleLockAge {
+			return nil, nil
+		}
+		retry, err := takeOverStaleLock(fs, lockPath)
+		if err != nil || !retry {
+			return nil, err
+		}
+	}
+}
+
+// createLock creates a lock file, failing with os.ErrExist when it is held. The
+// file holds the pid@host of the process, and a token for the lock, as one
+// process can take the same lock more than once over time.
+func createLock(fs afero.Fs, lockPath string) (*FileLock, error) {
+	f, err := fs.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	token := make([]byte, 8)
+	rand.Read(token)
+	l := &FileLock{fs: fs, path: lockPath, token: hex.EncodeToString(token), stop: make(chan struct{})}
+	l.owner = fmt.Sprintf("%d@%s %s\n", os.Getpid(), host, l.token)
+	_, err = f.WriteString(l.owner)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(lockPath)
+		return nil, err
+	}
+	return l, nil
+}
+
+// takeOverStaleLock removes a lock left by a process that stopped, telling if
+// the lock should be taken again now. Waiters take over a stale lock one at a
+// time, under a lock of their own, and check it is still stale before moving
+// it aside, so a lock just taken by another waiter is never removed.
+func takeOverStaleLock(fs afero.Fs, lockPath string) (bool, error) {
+	path := strings.TrimSuffix(lockPath, lockSuffix)
+	guardPath := path + takeoverSuffix + lockSuffix
+	guard, err := createLock(fs, guardPath)
+	if errors.Is(err, os.ErrExist) {
+		// another waiter is taking over the lock, unless it stopped while doing so
+		if fi, statErr := fs.Stat(guardPath); statErr == nil && time.Since(fi.ModTime()) > staleLockAge {
+			fs.Remove(guardPath)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer guard.release()
+	fi, err := fs.Stat(lockPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if time.Since(fi.ModTime()) <= staleLockAge {
+		// taken over by another waiter since
+		return false, nil
+	}
+	log.WithField("file", lockPath).Warn("removing lock left by a process that stopped")
+	// moved to a name of its own first, so only this waiter removes it
+	aside := path + ".stale-" + guard.token + lockSuffix
+	if err := fs.Rename(lockPath, aside); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	fs.Remove(aside)
+	return true, nil
+}
+
+// refresh marks the lock as in use until it is released
+func (l *FileLock) refresh() {
+	defer l.done.Done()
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			// a lock taken over by another process is left to it
+			if l.owned() {
+				now := time.Now()
+				l.fs.Chtimes(l.path, now, now)
+			}
+		}
+	}
+}
+
+// owned tells if the lock file is still the one this lock created
+func (l *FileLock) owned() bool {
+	b, err := afero.ReadFile(l.fs, l.path)
+	return err == nil && string(b) == l.owner
+}
+
+// release removes the lock file, unless another process has taken it over
+func (l *FileLock) release() error {
+	if !l.owned() {
+		log.WithField("file", l.path).Warn("lock was taken over by another process")
+		return nil
+	}
+	return l.fs.Remove(l.path)
+}
+
+// Unlock releases the lock. Unlocking a nil lock does nothing.
+func (l *FileLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	l.done.Wait()
+	return l.release()
+}
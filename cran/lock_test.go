@@ -0,0 +1,175 @@
+package cran
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func shortLockTimes(t *testing.T) {
+	refresh, stale, poll := lockRefresh, staleLockAge, lockPoll
+	lockRefresh, staleLockAge, lockPoll = 10*time.Millisecond, time.Second, time.Millisecond
+	t.Cleanup(func() {
+		lockRefresh, staleLockAge, lockPoll = refresh, stale, poll
+	})
+}
+
+func TestLockFileWaits(t *testing.T) {
+	shortLockTimes(t)
+	fs := afero.NewMemMapFs()
+	first, err := LockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+
+	locked := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(fs, "/cache/R6_2.5.1.tar.gz")
+		assert.NoError(t, err)
+		locked <- second
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was taken while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the lock is kept fresh while held
+	fi, err := fs.Stat("/cache/R6_2.5.1.tar.gz.lock")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), fi.ModTime(), 500*time.Millisecond)
+
+	require.NoError(t, first.Unlock())
+	select {
+	case second := <-locked:
+		require.NoError(t, second.Unlock())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not taken once released")
+	}
+	exists, _ := afero.Exists(fs, "/cache/R6_2.5.1.tar.gz.lock")
+	assert.False(t, exists)
+	var nilLock *FileLock
+	assert.NoError(t, nilLock.Unlock())
+}
+
+func TestLockFileTakesOverStaleLock(t *testing.T) {
+	shortLockTimes(t)
+	fs := afero.NewMemMapFs()
+	lockPath := "/cache/R6_2.5.1.tar.gz.lock"
+	require.NoError(t, afero.WriteFile(fs, lockPath, []byte("123@elsewhere\n"), 0644))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, fs.Chtimes(lockPath, old, old))
+
+	l, err := LockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	content, _ := afero.ReadFile(fs, lockPath)
+	assert.NotEqual(t, "123@elsewhere\n", string(content))
+	require.NoError(t, l.Unlock())
+}
+
+func TestLockFileStaleLockTakenOverOnce(t *testing.T) {
+	shortLockTimes(t)
+	fs := afero.NewMemMapFs()
+	lockPath := "/cache/R6_2.5.1.tar.gz.lock"
+	require.NoError(t, afero.WriteFile(fs, lockPath, []byte("123@elsewhere\n"), 0644))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, fs.Chtimes(lockPath, old, old))
+
+	// waiters that all find the lock stale take it one at a time
+	var holding, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := LockFile(fs, "/cache/R6_2.5.1.tar.gz")
+			if !assert.NoError(t, err) {
+				return
+			}
+			if atomic.AddInt32(&holding, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&holding, -1)
+			assert.NoError(t, l.Unlock())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(0), overlaps)
+	files, _ := afero.ReadDir(fs, "/cache")
+	assert.Empty(t, files, "no lock files are left behind")
+}
+
+func TestTryLockFile(t *testing.T) {
+	shortLockTimes(t)
+	fs := afero.NewMemMapFs()
+	first, err := TryLockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	require.NotNil(t, first)
+
+	second, err := TryLockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	assert.Nil(t, second, "the lock is held")
+
+	require.NoError(t, first.Unlock())
+	second, err = TryLockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	require.NoError(t, second.Unlock())
+}
+
+func TestUnlockLeavesLockTakenOver(t *testing.T) {
+	shortLockTimes(t)
+	fs := afero.NewMemMapFs()
+	l, err := LockFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	// another process found the lock stale and took it over
+	require.NoError(t, afero.WriteFile(fs, "/cache/R6_2.5.1.tar.gz.lock", []byte("123@elsewhere 0123456789abcdef\n"), 0644))
+
+	require.NoError(t, l.Unlock())
+	content, err := afero.ReadFile(fs, "/cache/R6_2.5.1.tar.gz.lock")
+	require.NoError(t, err)
+	assert.Equal(t, "123@elsewhere 0123456789abcdef\n", string(content))
+}
+
+func TestDownloadPackageWaitsForAnotherProcess(t *testing.T) {
+	shortLockTimes(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	fs := afero.NewMemMapFs()
+	dest := filepath.Join("/cache", "R6_2.5.1.tar.gz")
+	// another process is downloading the package
+	other, err := LockFile(fs, dest)
+	require.NoError(t, err)
+
+	type result struct {
+		dl  Download
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		d := PkgDl{Package: desc.Desc{Package: "R6", Version: "2.5.1"}, Config: PkgConfig{Repo: RepoURL{Name: "CRAN", URL: server.URL}, Type: Source}}
+		dl, err := DownloadPackage(fs, d, dest, RVersion{Major: 4, Minor: 2, Patch: 1}, NewFetcher(FetchConfig{}))
+		done <- result{dl, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, afero.WriteFile(fs, dest, []byte("content"), 0644))
+	require.NoError(t, other.Unlock())
+
+	r := <-done
+	require.NoError(t, r.err)
+	assert.False(t, r.dl.New, "the package downloaded by the other process is used")
+	assert.Equal(t, 0, requests)
+}
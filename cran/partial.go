@@ -0,0 +1,195 @@
+package cran
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// partSuffix is added to the name of a package file while it is downloaded
+const partSuffix = ".part"
+
+// stalePartAge is how long a partial download is kept, to be resumed, after it
+// was last written to
+const stalePartAge = 24 * time.Hour
+
+// errRangeMismatch is returned when a server responds to a range request with
+// content that does not continue the partial download
+var errRangeMismatch = errors.New("server responded with a different range than requested")
+
+// partPath provides the path a package file is downloaded to before it is complete
+func partPath(dest string) string {
+	return dest + partSuffix
+}
+
+// fetchPart downloads a package file to its .part file, resuming from the end of
+// any part already downloaded, by an earlier attempt or an earlier run, and
+// verifies the complete file against the checksums of the package. The url that
+// served the file is returned.
+func fetchPart(fs afero.Fs, fetcher *Fetcher, d PkgDl, url string, part string) (string, error) {
+	resumed := false
+	if fi, err := fs.Stat(part); err == nil && fi.Size() > 0 {
+		log.WithFields(log.Fields{
+			"package": d.Package.Package,
+			"bytes":   fi.Size(),
+		}).Info("resuming partial download")
+		resumed = true
+	}
+	servedURL := url
+	for attempt := 1; ; attempt++ {
+		n, u, err := appendPart(fs, fetcher, d.Config.Repo, url, part)
+		if u != "" {
+			servedURL = u
+		}
+		if err == nil {
+			break
+		}
+		var statusErr *StatusError
+		if errors.Is(err, errRangeMismatch) || (errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+			// the part does not belong to the file the server holds now
+			fs.Remove(part)
+			resumed = false
+		} else if n == 0 {
+			// the request failed, which the fetcher has already retried
+			return servedURL, err
+		}
+		if attempt >= fetcher.retry.Attempts {
+			// anything written is kept, so the next run resumes from it
+			return servedURL, err
+		}
+		log.WithFields(log.Fields{
+			"package": d.Package.Package,
+			"url":     MaskURL(servedURL),
+			"error":   err,
+		}).Debug("download interrupted, resuming")
+		resumed = resumed || n > 0
+	}
+	err := verifyFile(fs, part, d.Package, servedURL)
+	if err != nil && resumed {
+		// the part may have come from a different copy of the file, so it is
+		// downloaded again in full
+		log.WithFields(log.Fields{
+			"package": d.Package.Package,
+			"error":   err,
+		}).Debug("resumed download failed verification, downloading again")
+		fs.Remove(part)
+		var u string
+		if _, u, err = appendPart(fs, fetcher, d.Config.Repo, url, part); u != "" {
+			servedURL = u
+		}
+		if err == nil {
+			err = verifyFile(fs, part, d.Package, servedURL)
+		}
+	}
+	if err != nil {
+		fs.Remove(part)
+	}
+	return servedURL, err
+}
+
+// appendPart requests the rest of a file from the end of its part, and appends
+// it to the part. A server that does not support range requests sends the whole
+// file, which replaces the part. The number of bytes written is returned, along
+// with the url that served the file.
+func appendPart(fs afero.Fs, fetcher *Fetcher, repo RepoURL, url string, part string) (int64, string, error) {
+	var offset int64
+	if fi, err := fs.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+	res, servedURL, err := fetcher.GetRange(repo, url, offset)
+	if err != nil {
+		return 0, servedURL, err
+	}
+	defer res.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if res.StatusCode == http.StatusPartialContent {
+		if contentRangeStart(res.Header.Get("Content-Range")) != offset {
+			return 0, servedURL, errRangeMismatch
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := fs.OpenFile(part, flags, 0644)
+	if err != nil {
+		return 0, servedURL, err
+	}
+	n, err := io.Copy(f, res.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, servedURL, err
+}
+
+// contentRangeStart parses the first byte of a Content-Range header, such as
+// bytes 100-199/200, returning -1 when it cannot be parsed
+func contentRangeStart(cr string) int64 {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return -1
+	}
+	return start
+}
+
+// copyPart copies a package file from a local repository to its .part file,
+// verifying it against the checksums of the package
+func copyPart(fs afero.Fs, d PkgDl, src string, part string) error {
+	from, err := fs.Open(src)
+	if err != nil {
+		return fmt.Errorf("missing package file: %w", err)
+	}
+	defer from.Close()
+	f, err := fs.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	checksums := newChecksummer()
+	_, err = io.Copy(io.MultiWriter(f, checksums), from)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = checksums.verify(d.Package, src)
+	}
+	if err != nil {
+		fs.Remove(part)
+	}
+	return err
+}
+
+// removeStaleParts removes partial downloads from a cache directory that have
+// not been written to for a day, as they are unlikely to be resumed, along with
+// the temporary files that earlier versions of pkgr left when interrupted. Locks
+// left by processes that stopped are only taken over by LockFile.
+func removeStaleParts(fs afero.Fs, dir string) {
+	files, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		stalePart := strings.HasSuffix(f.Name(), partSuffix) && time.Since(f.ModTime()) > stalePartAge
+		oldTemp := strings.HasSuffix(f.Name(), ".tmp") && time.Since(f.ModTime()) > time.Hour
+		if !stalePart && !oldTemp {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if err := fs.Remove(path); err != nil {
+			log.WithFields(log.Fields{
+				"file":  path,
+				"error": err,
+			}).Warn("could not remove partial download")
+			continue
+		}
+		log.WithField("file", path).Debug("removed partial download")
+	}
+}
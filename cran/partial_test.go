@@ -0,0 +1,146 @@
+package cran
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func TestDownloadPackageResumes(t *testing.T) {
+	tarball := []byte(strings.Repeat("0123456789", 100))
+	pd := desc.Desc{Package: "R6", Version: "2.5.1", MD5sum: fmt.Sprintf("%x", md5.Sum(tarball))}
+	rv := RVersion{Major: 4, Minor: 2, Patch: 1}
+	dest := filepath.Join("/cache", "R6_2.5.1.tar.gz")
+
+	var mu sync.Mutex
+	var ranges []string
+	record := func(r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+	}
+	serveContent := func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		http.ServeContent(w, r, "R6_2.5.1.tar.gz", time.Time{}, bytes.NewReader(tarball))
+	}
+	ignoreRange := func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Write(tarball)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		part    []byte
+		ranges  []string
+	}{
+		{name: "resumes from the end of the part", handler: serveContent, part: tarball[:400], ranges: []string{"bytes=400-"}},
+		{name: "replaces the part when the server sends the whole file", handler: ignoreRange, part: tarball[:400], ranges: []string{"bytes=400-"}},
+		{name: "downloads again when the resumed file fails verification", handler: serveContent, part: []byte("corrupt"), ranges: []string{"bytes=7-", ""}},
+		{name: "downloads again when the part is not shorter than the file", handler: serveContent, part: append(append([]byte{}, tarball...), 'x'), ranges: []string{"bytes=1001-", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges = nil
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, dest+".part", tt.part, 0644))
+
+			d := PkgDl{Package: pd, Config: PkgConfig{Repo: RepoURL{Name: "CRAN", URL: server.URL}, Type: Source}}
+			dl, err := DownloadPackage(fs, d, dest, rv, NewFetcher(FetchConfig{Retry: RetryConfig{Attempts: 2, Delay: time.Millisecond}}))
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(tarball)), dl.Size)
+			content, err := afero.ReadFile(fs, dest)
+			require.NoError(t, err)
+			assert.Equal(t, tarball, content)
+			exists, _ := afero.Exists(fs, dest+".part")
+			assert.False(t, exists, "the part is renamed once complete")
+			assert.Equal(t, tt.ranges, ranges)
+		})
+	}
+}
+
+func TestDownloadPackageResumesInterruptedTransfer(t *testing.T) {
+	tarball := []byte(strings.Repeat("0123456789", 100))
+	pd := desc.Desc{Package: "R6", Version: "2.5.1", MD5sum: fmt.Sprintf("%x", md5.Sum(tarball))}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// the connection drops half way through the file
+			w.Header().Set("Content-Length", fmt.Sprint(len(tarball)))
+			w.Write(tarball[:500])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		assert.Equal(t, "bytes=500-", r.Header.Get("Range"))
+		http.ServeContent(w, r, "R6_2.5.1.tar.gz", time.Time{}, bytes.NewReader(tarball))
+	}))
+	defer server.Close()
+
+	fs := afero.NewMemMapFs()
+	dest := filepath.Join("/cache", "R6_2.5.1.tar.gz")
+	d := PkgDl{Package: pd, Config: PkgConfig{Repo: RepoURL{Name: "CRAN", URL: server.URL}, Type: Source}}
+	_, err := DownloadPackage(fs, d, dest, RVersion{Major: 4, Minor: 2, Patch: 1}, NewFetcher(FetchConfig{Retry: RetryConfig{Attempts: 2, Delay: time.Millisecond}}))
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	content, err := afero.ReadFile(fs, dest)
+	require.NoError(t, err)
+	assert.Equal(t, tarball, content)
+
+	t.Run("keeps the part when every attempt is interrupted", func(t *testing.T) {
+		requests = 0
+		fs := afero.NewMemMapFs()
+		_, err := DownloadPackage(fs, d, dest, RVersion{Major: 4, Minor: 2, Patch: 1}, NewFetcher(FetchConfig{Retry: RetryConfig{Attempts: 1}}))
+		assert.Error(t, err)
+		part, err := afero.ReadFile(fs, dest+".part")
+		require.NoError(t, err)
+		assert.Equal(t, tarball[:500], part)
+		exists, _ := afero.Exists(fs, dest)
+		assert.False(t, exists, "an incomplete file is never left under the package name")
+	})
+}
+
+func TestRemoveStaleParts(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	dir := "/cache/CRAN-abc/src"
+	files := map[string]time.Duration{
+		"R6_2.5.1.tar.gz":             48 * time.Hour,
+		"rlang_1.0.6.tar.gz.part":     time.Minute,
+		"cli_3.6.1.tar.gz.part":       48 * time.Hour,
+		"glue_1.6.2.tar.gz.123.tmp":   2 * time.Hour,
+		"vctrs_0.6.3.tar.gz.456.tmp":  time.Minute,
+		"withr_2.5.0.tar.gz.part.bak": 48 * time.Hour,
+		"R6_2.5.1.tar.gz.lock":        48 * time.Hour,
+	}
+	for name, age := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, afero.WriteFile(fs, path, []byte(name), 0644))
+		modified := time.Now().Add(-age)
+		require.NoError(t, fs.Chtimes(path, modified, modified))
+	}
+
+	removeStaleParts(fs, dir)
+
+	var left []string
+	entries, err := afero.ReadDir(fs, dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"R6_2.5.1.tar.gz", "rlang_1.0.6.tar.gz.part", "vctrs_0.6.3.tar.gz.456.tmp", "withr_2.5.0.tar.gz.part.bak", "R6_2.5.1.tar.gz.lock"}, left)
+}
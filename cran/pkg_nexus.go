@@ -3,6 +3,7 @@ package cran
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -10,14 +11,13 @@ import (
 	"github.com/metrumresearchgroup/pkgr/desc"
 )
 
-// NewPkgDb returns a new package database
-// noSecure will allow https fetching without validating the certificate chain.
-// This occasionally is needed for repos that have self signed or certs not fully verifiable
-// which will return errors such as x509: certificate signed by unknown authority
-func NewPkgDb(urls []RepoURL, dst SourceType, cfgdb *InstallConfig, rv RVersion, noSecure bool) (*PkgNexus, error) {
+// NewPkgDb returns a new package database, fetching the repository
+// package databases with the fetcher
+func NewPkgDb(urls []RepoURL, dst SourceType, cfgdb *InstallConfig, rv RVersion, fetcher *Fetcher) (*PkgNexus, error) {
 	pkgNexus := PkgNexus{
 		Config:            cfgdb,
 		DefaultSourceType: dst,
+		Fetcher:           fetcher,
 	}
 	if len(urls) == 0 {
 		return &pkgNexus, errors.New("Package database must contain at least one RepoUrl")
@@ -34,33 +34,56 @@ func NewPkgDb(urls []RepoURL, dst SourceType, cfgdb *InstallConfig, rv RVersion,
 	for _, url := range urls {
 		pkgNexus.Db = append(pkgNexus.Db, nil)
 		go func(url RepoURL, dst SourceType, ri int) {
-			rdb, err := NewRepoDb(url, dst, cfgdb.Repos[url.Name], rv, noSecure)
+			rdb, err := NewRepoDb(url, dst, cfgdb.Repos[url.Name], rv, fetcher)
 			rdbc <- rd{url, rdb, ri, err}
 		}(url, dst, ri)
 		ri++
 	}
 	var err error
 	err = nil
+	offlineErr := &OfflineError{}
 	for i := 0; i < len(urls); i++ {
 		result := <-rdbc
-		if result.Err != nil {
+		var oe *OfflineError
+		if errors.As(result.Err, &oe) {
+			// collected so every missing file is reported together
+			offlineErr.Add(oe)
+		} else if result.Err != nil {
 			// ran into an error here when downloading on multiple versions of R on windows
 			// within the 1 hr cache time, using the same pkgr.yml minus the Rpath/lib
 			// simply changing the offending repo name to something else, eg MPN2 vs MPN
 			// caused it to then run successfully
 			log.WithFields(log.Fields{
 				"repo":  result.Url.Name,
-				"url":   result.Url.URL,
-				"error": err,
+				"url":   MaskURL(result.Url.URL),
+				"error": result.Err,
 			}).Error("error downloading repo information")
 			err = result.Err
 		} else {
 			pkgNexus.Db[result.repoIndex] = result.Rdb
 		}
 	}
+	if err == nil && len(offlineErr.URLs) > 0 {
+		err = offlineErr
+	}
 	return &pkgNexus, err
 }
 
+// AddSourcePackage adds a repository holding a single source package, such as one
+// built from a git remote, and sets the package to be taken from it. The repository
+// url must be a directory laid out as a CRAN-like repository.
+func (pkgNexus *PkgNexus) AddSourcePackage(repo RepoURL, pd desc.Desc) {
+	rdb := &RepoDb{
+		DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{
+			Source: {pd.Package: {pd}},
+		},
+		Repo:              repo,
+		DefaultSourceType: Source,
+	}
+	pkgNexus.Db = append([]*RepoDb{rdb}, pkgNexus.Db...)
+	pkgNexus.Config.Packages[pd.Package] = PkgConfig{Repo: repo, Type: Source}
+}
+
 // SetPackageRepo sets a package repository so querying the package will
 // pull from that repo
 func (pkgNexus *PkgNexus) SetPackageRepo(pkg string, repo string) error {
@@ -86,6 +109,64 @@ func (pkgNexus *PkgNexus) SetPackageType(pkg string, t string) error {
 	return nil
 }
 
+// UseSourceType sets the type of package taken from every repository, in place of
+// the default type and any type set for a repository. Packages set to a type
+// keep it. When the type is binary, packages with no binary version are set to
+// be taken as source packages, and their names returned.
+func (pkgNexus *PkgNexus) UseSourceType(st SourceType) []string {
+	pkgNexus.DefaultSourceType = st
+	for _, db := range pkgNexus.Db {
+		db.DefaultSourceType = st
+	}
+	if st != Binary {
+		return nil
+	}
+	var fallback []string
+	pkgs := pkgNexus.GetAllPkgsByName()
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		cfg, exists := pkgNexus.Config.Packages[pkg]
+		if exists && cfg.Type != Default {
+			continue
+		}
+		if _, _, found := pkgNexus.GetPackage(pkg); found {
+			continue
+		}
+		cfg.Type = Source
+		pkgNexus.Config.Packages[pkg] = cfg
+		if _, _, found := pkgNexus.GetPackage(pkg); found {
+			fallback = append(fallback, pkg)
+			continue
+		}
+		if exists {
+			cfg.Type = Default
+			pkgNexus.Config.Packages[pkg] = cfg
+		} else {
+			delete(pkgNexus.Config.Packages, pkg)
+		}
+	}
+	return fallback
+}
+
+// SetPackageConstraint restricts the versions of a package that
+// can be selected from the package database
+func (pkgNexus *PkgNexus) SetPackageConstraint(pkg string, dep desc.Dep) {
+	if pkgNexus.Config.Constraints == nil {
+		pkgNexus.Config.Constraints = make(map[string]desc.Dep)
+	}
+	pkgNexus.Config.Constraints[pkg] = dep
+}
+
+// satisfiesConstraint checks a candidate version against any version
+// requirement set for the package
+func (pkgNexus *PkgNexus) satisfiesConstraint(pkg string, version string) bool {
+	dep, exists := pkgNexus.Config.Constraints[pkg]
+	if !exists {
+		return true
+	}
+	return dep.IsSatisfiedBy(version)
+}
+
 func setType(cfg *PkgConfig, t string) error {
 	if strings.EqualFold(t, "source") {
 		cfg.Type = Source
@@ -97,19 +178,28 @@ func setType(cfg *PkgConfig, t string) error {
 	return nil
 }
 
-func pkgExists(pkg string, db map[string]desc.Desc) bool {
-	_, exists := db[pkg]
-	return exists
+func pkgExists(pkg string, db map[string][]desc.Desc) bool {
+	return len(db[pkg]) > 0
 }
-func pkgExistsInRepo(pkg string, dbs map[SourceType]map[string]desc.Desc) bool {
-	exists := false
+func pkgExistsInRepo(pkg string, dbs map[SourceType]map[string][]desc.Desc) bool {
 	for _, db := range dbs {
-		_, exists = db[pkg]
-		if exists {
-			return exists
+		if pkgExists(pkg, db) {
+			return true
+		}
+	}
+	return false
+}
+
+// highestSatisfying returns the highest version of a package that satisfies
+// any version requirement set for it
+func (pkgNexus *PkgNexus) highestSatisfying(pkg string, db map[string][]desc.Desc) (desc.Desc, bool) {
+	// versions are kept ordered from highest to lowest
+	for _, pd := range db[pkg] {
+		if pkgNexus.satisfiesConstraint(pkg, pd.Version) {
+			return pd, true
 		}
 	}
-	return exists
+	return desc.Desc{}, false
 }
 
 func isCorrectRepo(pkg string, r RepoURL, cfg map[string]PkgConfig) bool {
@@ -124,7 +214,8 @@ func isCorrectRepo(pkg string, r RepoURL, cfg map[string]PkgConfig) bool {
 	return true
 }
 
-// GetPackage gets a package from the package database, returning the first match
+// GetPackage gets a package from the package database, returning the highest version,
+// from the first repo that has one, that satisfies any version requirement set for the package
 func (pkgNexus *PkgNexus) GetPackage(pkg string) (desc.Desc, PkgConfig, bool) {
 	cfg, exists := pkgNexus.Config.Packages[pkg]
 	st := pkgNexus.DefaultSourceType
@@ -140,8 +231,11 @@ func (pkgNexus *PkgNexus) GetPackage(pkg string) (desc.Desc, PkgConfig, bool) {
 		// in the config. Eg, if specifies binary, will only check binary version
 		// the checking if also exists as source or otherwise should occur upstream
 		// then be set as part of the explicit configuration.
-		if pkgExists(pkg, db.DescriptionsBySourceType[rst]) && isCorrectRepo(pkg, db.Repo, pkgNexus.Config.Packages) {
-			return db.DescriptionsBySourceType[rst][pkg], PkgConfig{Repo: db.Repo, Type: rst}, true
+		if !isCorrectRepo(pkg, db.Repo, pkgNexus.Config.Packages) {
+			continue
+		}
+		if pd, found := pkgNexus.highestSatisfying(pkg, db.DescriptionsBySourceType[rst]); found {
+			return pd, PkgConfig{Repo: db.Repo, Type: rst}, true
 		}
 	}
 	return desc.Desc{}, PkgConfig{}, false
@@ -154,8 +248,24 @@ func (pkgNexus *PkgNexus) GetPackageFromRepo(pkg string, repo string) (desc.Desc
 		if repo != "" && db.Repo.Name != repo {
 			continue
 		}
-		if pkgExists(pkg, db.DescriptionsBySourceType[st]) {
-			return db.DescriptionsBySourceType[st][pkg], PkgConfig{Repo: db.Repo, Type: st}, true
+		if pd, found := pkgNexus.highestSatisfying(pkg, db.DescriptionsBySourceType[st]); found {
+			return pd, PkgConfig{Repo: db.Repo, Type: st}, true
+		}
+	}
+	return desc.Desc{}, PkgConfig{}, false
+}
+
+// GetPackageVersion gets an exact version of a package, of the given source type,
+// from a named repo in the package database
+func (pkgNexus *PkgNexus) GetPackageVersion(pkg string, version string, repo string, st SourceType) (desc.Desc, PkgConfig, bool) {
+	for _, db := range pkgNexus.Db {
+		if db.Repo.Name != repo {
+			continue
+		}
+		for _, pd := range db.DescriptionsBySourceType[st][pkg] {
+			if pd.Version == version {
+				return pd, PkgConfig{Repo: db.Repo, Type: st}, true
+			}
 		}
 	}
 	return desc.Desc{}, PkgConfig{}, false
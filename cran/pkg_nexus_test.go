@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
 )
 
 func TestSetType(t *testing.T) {
@@ -31,7 +33,7 @@ func TestSetType2(t *testing.T) {
 		Packages: map[string]PkgConfig{},
 	}
 
-	pkgNexus, _ := NewPkgDb(urls, Source, &installConfig, RVersion{4, 1, 3}, false)
+	pkgNexus, _ := NewPkgDb(urls, Source, &installConfig, RVersion{4, 1, 3}, NewFetcher(FetchConfig{}))
 	_, pkgCfg, _ := pkgNexus.GetPackage(pkgName)
 	assert.Equal(t, Source, pkgCfg.Type, "Error getting type source")
 
@@ -61,7 +63,7 @@ func TestSetRepo(t *testing.T) {
 		Packages: map[string]PkgConfig{},
 	}
 
-	pkgNexus, _ := NewPkgDb(urls, Source, &installConfig, RVersion{4, 1, 3}, false)
+	pkgNexus, _ := NewPkgDb(urls, Source, &installConfig, RVersion{4, 1, 3}, NewFetcher(FetchConfig{}))
 
 	_, pkgCfg, _ := pkgNexus.GetPackage(pkgName)
 	assert.Equal(t, "MPN_2023_03_13", pkgCfg.Repo.Name, "Error getting repo MPN_2023_03_13")
@@ -70,3 +72,75 @@ func TestSetRepo(t *testing.T) {
 	_, pkgCfg, _ = pkgNexus.GetPackage(pkgName)
 	assert.Equal(t, "MPN_2022_06_15", pkgCfg.Repo.Name, "Error getting repo MPN_2022_06_15")
 }
+
+func TestGetPackageVersions(t *testing.T) {
+	repo := RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	pkgNexus := PkgNexus{
+		Db: []*RepoDb{{
+			Repo: repo,
+			DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{
+				Source: {"MASS": {
+					{Package: "MASS", Version: "7.3-58", Path: "4.2.0/Recommended"},
+					{Package: "MASS", Version: "7.3-51", Path: "older"},
+				}},
+			},
+		}},
+		Config:            NewInstallConfig(),
+		DefaultSourceType: Source,
+	}
+
+	pd, _, found := pkgNexus.GetPackage("MASS")
+	assert.True(t, found)
+	assert.Equal(t, "7.3-58", pd.Version, "highest version should be selected")
+
+	pkgNexus.SetPackageConstraint("MASS", desc.ParseDep("MASS (< 7.3-58)"))
+	pd, pc, found := pkgNexus.GetPackage("MASS")
+	assert.True(t, found)
+	assert.Equal(t, "7.3-51", pd.Version, "highest version satisfying the constraint should be selected")
+	assert.Equal(t,
+		"https://cran.example.com/src/contrib/older/MASS_7.3-51.tar.gz",
+		packageURL(PkgDl{Package: pd, Config: pc}, RVersion{4, 2, 1}, "MASS_7.3-51.tar.gz"))
+
+	pd, _, found = pkgNexus.GetPackageVersion("MASS", "7.3-58", "CRAN", Source)
+	assert.True(t, found)
+	assert.Equal(t, "4.2.0/Recommended", pd.Path)
+}
+
+func TestUseSourceType(t *testing.T) {
+	repo := RepoURL{Name: "CRAN", URL: "https://cran.example.com"}
+	pkgNexus := PkgNexus{
+		Db: []*RepoDb{{
+			Repo: repo,
+			DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{
+				Source: {
+					"R6":     {{Package: "R6", Version: "2.5.1"}},
+					"cli":    {{Package: "cli", Version: "3.6.1"}},
+					"pinned": {{Package: "pinned", Version: "1.0"}},
+				},
+				Binary: {
+					"R6":     {{Package: "R6", Version: "2.5.1"}},
+					"pinned": {{Package: "pinned", Version: "1.0"}},
+				},
+			},
+			DefaultSourceType: Binary,
+		}},
+		Config:            NewInstallConfig(),
+		DefaultSourceType: Binary,
+	}
+	pkgNexus.SetPackageType("pinned", "source")
+
+	assert.Empty(t, pkgNexus.UseSourceType(Source))
+	for _, pkg := range []string{"R6", "cli", "pinned"} {
+		_, pc, found := pkgNexus.GetPackage(pkg)
+		assert.True(t, found, pkg)
+		assert.Equal(t, Source, pc.Type, pkg)
+	}
+
+	assert.Equal(t, []string{"cli"}, pkgNexus.UseSourceType(Binary), "only packages without a binary fall back to source")
+	_, pc, _ := pkgNexus.GetPackage("R6")
+	assert.Equal(t, Binary, pc.Type)
+	_, pc, _ = pkgNexus.GetPackage("cli")
+	assert.Equal(t, Source, pc.Type)
+	_, pc, _ = pkgNexus.GetPackage("pinned")
+	assert.Equal(t, Source, pc.Type, "a package set to a type keeps it")
+}
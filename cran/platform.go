@@ -0,0 +1,99 @@
+package cran
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// PlatformFileSuffix is added to the name of a binary built by pkgr for the
+// file alongside it recording the platform it was built on
+const PlatformFileSuffix = ".platform.json"
+
+// BinaryPlatform identifies the platform a binary was built on, as a binary
+// built on one Linux distribution, or for one architecture, may not load on
+// another
+type BinaryPlatform struct {
+	// OS is the operating system, as runtime.GOOS
+	OS string `json:"os"`
+	// Distro and DistroVersion are the ID and VERSION_ID of the Linux
+	// distribution from /etc/os-release
+	Distro        string `json:"distro,omitempty"`
+	DistroVersion string `json:"distro_version,omitempty"`
+	// Arch is the architecture, as runtime.GOARCH
+	Arch string `json:"arch"`
+	// RPlatform is the platform R was built for, eg x86_64-pc-linux-gnu
+	RPlatform string `json:"r_platform"`
+}
+
+// NewBinaryPlatform provides the platform for an operating system and
+// architecture, the os-release of a Linux distribution and an R platform
+func NewBinaryPlatform(goos string, goarch string, rPlatform string, release OsRelease) BinaryPlatform {
+	p := BinaryPlatform{OS: goos, Arch: goarch, RPlatform: rPlatform}
+	if goos == "linux" {
+		p.Distro = release.Id
+		p.DistroVersion = release.VersionId
+	}
+	return p
+}
+
+// CurrentBinaryPlatform provides the platform pkgr is running on, for the
+// platform of the R in use
+func CurrentBinaryPlatform(rPlatform string) BinaryPlatform {
+	if runtime.GOOS == "linux" {
+		if err := ReadOsRelease(); err != nil {
+			log.WithField("error", err).Warn("could not read the Linux distribution, binaries built are only used on unknown distributions")
+		}
+	}
+	return NewBinaryPlatform(runtime.GOOS, runtime.GOARCH, rPlatform, osRelease)
+}
+
+// unsafeKeyChars matches the characters replaced in a platform key
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Key provides the name of the directory in the cache for the binaries built on
+// the platform, such as ubuntu-22.04_x86_64-pc-linux-gnu
+func (p BinaryPlatform) Key() string {
+	system := p.OS
+	if p.Distro != "" {
+		system = strings.TrimSuffix(p.Distro+"-"+p.DistroVersion, "-")
+	}
+	platform := p.RPlatform
+	if platform == "" {
+		platform = p.Arch
+	}
+	return unsafeKeyChars.ReplaceAllString(system+"_"+platform, "-")
+}
+
+// WritePlatformFile records the platform a binary was built on in the file
+// alongside it. The file is written atomically, as a binary with part of one
+// is taken to be built on another platform.
+func WritePlatformFile(fs afero.Fs, binaryPath string, p BinaryPlatform) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(fs, binaryPath+PlatformFileSuffix, 0644, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// ReadPlatformFile reads the platform a binary was built on from the file
+// alongside it
+func ReadPlatformFile(fs afero.Fs, binaryPath string) (BinaryPlatform, error) {
+	var p BinaryPlatform
+	b, err := afero.ReadFile(fs, binaryPath+PlatformFileSuffix)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(b, &p)
+	return p, err
+}
@@ -0,0 +1,41 @@
+package cran
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryPlatformKey(t *testing.T) {
+	ubuntu := OsRelease{Id: "ubuntu", VersionId: "20.04"}
+	rocky := OsRelease{Id: "rocky", VersionId: "9.2"}
+	tests := []struct {
+		platform BinaryPlatform
+		key      string
+	}{
+		{NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", ubuntu), "ubuntu-20.04_x86_64-pc-linux-gnu"},
+		{NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", rocky), "rocky-9.2_x86_64-pc-linux-gnu"},
+		{NewBinaryPlatform("linux", "arm64", "", OsRelease{}), "linux_arm64"},
+		{NewBinaryPlatform("darwin", "arm64", "aarch64-apple-darwin20", ubuntu), "darwin_aarch64-apple-darwin20"},
+		{NewBinaryPlatform("windows", "amd64", "x86_64-w64-mingw32/x64", OsRelease{}), "windows_x86_64-w64-mingw32-x64"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.key, tt.platform.Key())
+	}
+	assert.NotEqual(t,
+		NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", ubuntu),
+		NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", rocky))
+}
+
+func TestPlatformFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	p := NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", OsRelease{Id: "ubuntu", VersionId: "22.04"})
+	require.NoError(t, WritePlatformFile(fs, "/cache/R6_2.5.1.tar.gz", p))
+	read, err := ReadPlatformFile(fs, "/cache/R6_2.5.1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, p, read)
+	_, err = ReadPlatformFile(fs, "/cache/cli_3.6.1.tar.gz")
+	assert.Error(t, err)
+}
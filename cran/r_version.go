@@ -1,6 +1,10 @@
 package cran
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // ToFullString provides a string representation of the Rversion
 func (rv RVersion) ToFullString() string {
@@ -11,3 +15,21 @@ func (rv RVersion) ToFullString() string {
 func (rv RVersion) ToString() string {
 	return fmt.Sprintf("%v.%v", rv.Major, rv.Minor)
 }
+
+// ParseRVersion parses a version of R given as major.minor, eg 4.3,
+// or major.minor.patch, eg 4.3.1
+func ParseRVersion(s string) (RVersion, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return RVersion{}, fmt.Errorf("invalid R version %q, expected major.minor, eg 4.3", s)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return RVersion{}, fmt.Errorf("invalid R version %q, expected major.minor, eg 4.3", s)
+		}
+		nums[i] = n
+	}
+	return RVersion{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
@@ -34,3 +34,23 @@ func TestRVersion(t *testing.T) {
 
 	}
 }
+
+func TestParseRVersion(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected RVersion
+	}{
+		{"4.3", RVersion{4, 3, 0}},
+		{"4.3.1", RVersion{4, 3, 1}},
+		{" 3.6.3 ", RVersion{3, 6, 3}},
+	}
+	for _, tt := range tests {
+		rv, err := ParseRVersion(tt.in)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.expected, rv, tt.in)
+	}
+	for _, in := range []string{"", "4", "4.x", "4.3.1.2", "-1.2"} {
+		_, err := ParseRVersion(in)
+		assert.Error(t, err, in)
+	}
+}
@@ -2,9 +2,10 @@ package cran
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
-	"crypto/tls"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,22 +13,19 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/metrumresearchgroup/pkgr/desc"
-	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 )
 
 // NewRepoDb returns a new Repo database
-// noSecure will allow https fetching without validating the certificate chain.
-// This occasionally is needed for repos that have self signed or certs not fully verifiable
-// which will return errors such as x509: certificate signed by unknown authority
-func NewRepoDb(url RepoURL, dst SourceType, rc RepoConfig, rv RVersion, noSecure bool) (*RepoDb, error) {
+func NewRepoDb(url RepoURL, dst SourceType, rc RepoConfig, rv RVersion, fetcher *Fetcher) (*RepoDb, error) {
 	repoDatabasePointer := &RepoDb{
-		DescriptionsBySourceType: make(map[SourceType]map[string]desc.Desc),
+		DescriptionsBySourceType: make(map[SourceType]map[string][]desc.Desc),
 		Time:                     time.Now(),
 		Repo:                     url,
 	}
@@ -38,7 +36,7 @@ func NewRepoDb(url RepoURL, dst SourceType, rc RepoConfig, rv RVersion, noSecure
 	}
 
 	if SupportsBinary(rc.RepoType) {
-		repoDatabasePointer.DescriptionsBySourceType[Binary] = make(map[string]desc.Desc)
+		repoDatabasePointer.DescriptionsBySourceType[Binary] = make(map[string][]desc.Desc)
 	}
 
 	if rc.RepoSuffix != "" {
@@ -46,9 +44,11 @@ func NewRepoDb(url RepoURL, dst SourceType, rc RepoConfig, rv RVersion, noSecure
 		url.Suffix = rc.RepoSuffix
 	}
 
-	repoDatabasePointer.DescriptionsBySourceType[Source] = make(map[string]desc.Desc)
+	repoDatabasePointer.Snapshot = rc.Snapshot
 
-	return repoDatabasePointer, repoDatabasePointer.FetchPackages(rv, noSecure)
+	repoDatabasePointer.DescriptionsBySourceType[Source] = make(map[string][]desc.Desc)
+
+	return repoDatabasePointer, repoDatabasePointer.FetchPackages(rv, fetcher)
 }
 
 // Decode decodes the package database
@@ -60,7 +60,14 @@ func (repoDb *RepoDb) Decode(file string) error {
 	}
 	defer f.Close()
 	d := gob.NewDecoder(f)
-	return d.Decode(&repoDb.DescriptionsBySourceType)
+	var cache repoDbCache
+	err = d.Decode(&cache)
+	if err != nil {
+		return err
+	}
+	repoDb.DescriptionsBySourceType = cache.DescriptionsBySourceType
+	repoDb.Validators = cache.Validators
+	return nil
 }
 
 // Encode encodes the PackageDatabase
@@ -73,16 +80,30 @@ func (repoDb *RepoDb) Encode(file string) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	e := gob.NewEncoder(f)
 
 	// Encoding the map
-	err = e.Encode(repoDb.DescriptionsBySourceType)
+	err = e.Encode(repoDbCache{
+		DescriptionsBySourceType: repoDb.DescriptionsBySourceType,
+		Validators:               repoDb.Validators,
+	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// repoDbCache is the encoded form of the package database
+type repoDbCache struct {
+	DescriptionsBySourceType map[SourceType]map[string][]desc.Desc
+	Validators               map[SourceType]Validator
+}
+
+// repoDbCacheVersion is incremented whenever the encoded layout of the
+// package database changes, so that existing caches are not decoded into it
+const repoDbCacheVersion = 3
+
 // Hash provides a hash based on the RepoDb sources
 func (repoDb *RepoDb) Hash(rVersion string) string {
 	h := md5.New()
@@ -94,7 +115,8 @@ func (repoDb *RepoDb) Hash(rVersion string) string {
 		stsum += st + 1
 	}
 
-	io.WriteString(h, repoDb.Repo.Name+repoDb.Repo.URL+fmt.Sprint(stsum)+rVersion)
+	// the snapshot keeps cached indexes from different dates apart
+	io.WriteString(h, repoDb.Repo.Name+repoDb.Repo.URL+fmt.Sprint(stsum)+rVersion+fmt.Sprint(repoDbCacheVersion)+repoDb.Snapshot)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
@@ -113,14 +135,23 @@ func GetPackagesFileURL(r *RepoDb, st SourceType, rv RVersion) string {
 
 // FetchPackages gets the packages for  RepoDb
 // R_AVAILABLE_PACKAGES_CACHE_CONTROL_MAX_AGE controls the timing to requery the cache in R
-// noSecure will allow https fetching without validating the certificate chain.
-// This occasionally is needed for repos that have self signed or certs not fully verifiable
-// which will return errors such as x509: certificate signed by unknown authority
-func (repoDb *RepoDb) FetchPackages(rVersion RVersion, noSecure bool) error {
-	var err error
+// Once the cached database is older than that, each PACKAGES file is revalidated
+// with the repository, and is only downloaded again if it has changed.
+// When the fetcher is offline the cached database is used however old it is.
+func (repoDb *RepoDb) FetchPackages(rVersion RVersion, fetcher *Fetcher) error {
 	pkgdbFile := repoDb.GetRepoDbCacheFilePath(rVersion.ToFullString())
 
+	// a stale cache is kept to revalidate against the repository
+	cached := &RepoDb{}
 	if fi, err := os.Stat(pkgdbFile); !os.IsNotExist(err) {
+		if fetcher.Offline() {
+			log.WithFields(log.Fields{
+				"repo":     repoDb.Repo.Name,
+				"cache":    pkgdbFile,
+				"cachedAt": fi.ModTime(),
+			}).Debug("offline, using cached packages database")
+			return repoDb.Decode(pkgdbFile)
+		}
 		maxSecs := 3600
 		maxAge, ok := os.LookupEnv("R_AVAILABLE_PACKAGES_CACHE_CONTROL_MAX_AGE")
 		if ok {
@@ -135,66 +166,53 @@ func (repoDb *RepoDb) FetchPackages(rVersion RVersion, noSecure bool) error {
 			// only read if was cached in the last hour
 			return repoDb.Decode(pkgdbFile)
 		}
-		err := os.Remove(pkgdbFile)
-		if err != nil {
-			fmt.Println("error removing cache ", pkgdbFile, err)
+		if err := cached.Decode(pkgdbFile); err != nil {
+			cached = &RepoDb{}
 		}
 	}
 
 	type downloadDatabase struct {
 		St                    SourceType
-		AvailableDescriptions map[string]desc.Desc
+		AvailableDescriptions map[string][]desc.Desc
+		Validator             Validator
+		NotModified           bool
 		Err                   error
 	}
 
-	client := &http.Client{}
-	if noSecure {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify : true},
-		}
-		client = &http.Client{Transport: tr}
-	}
-
 	downloadChannel := make(chan downloadDatabase, len(repoDb.DescriptionsBySourceType))
 	defer close(downloadChannel)
 
 	for sourceType := range repoDb.DescriptionsBySourceType {
 		go func(st SourceType) {
-			descriptionMap := make(map[string]desc.Desc)
+			descriptionMap := make(map[string][]desc.Desc)
 			pkgURL := GetPackagesFileURL(repoDb, st, rVersion)
-			log.Debugf("packages database - type: %s, url: %s\n", st, pkgURL)
+			log.Debugf("packages database - type: %s, url: %s\n", st, MaskURL(pkgURL))
 			var body []byte
+			var validator Validator
 
 			if strings.HasPrefix(pkgURL, "http") {
-				res, err := client.Get(pkgURL)
-				if err != nil {
-					log.Error("error with http get to url: " + pkgURL)
-					log.Fatal(err)
-				}
-				if res.StatusCode != 200 {
-					downloadChannel <- downloadDatabase{
-						St:                    st,
-						AvailableDescriptions: descriptionMap,
-						Err:                   fmt.Errorf("failed fetching PACKAGES file from %s, with status %s", pkgURL, res.Status)}
-					return
+				previous, hasPrevious := cached.DescriptionsBySourceType[st]
+				v := cached.Validators[st]
+				if !hasPrevious {
+					v = Validator{}
 				}
+				var err error
+				body, validator, err = fetchPackagesFile(fetcher, repoDb.Repo, pkgURL, v)
 				if err != nil {
-					err = fmt.Errorf("problem getting packages from url %s: %s", pkgURL, err)
+					err = fmt.Errorf("problem getting packages from url %s: %w", MaskURL(pkgURL), err)
 					downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Err: err}
 					return
 				}
-
-				defer res.Body.Close()
-				body, err = ioutil.ReadAll(res.Body)
-				if err != nil {
-					err = fmt.Errorf("error reading body: %s", err)
-					downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Err: err}
+				if body == nil {
+					log.WithFields(log.Fields{
+						"url": MaskURL(validator.URL),
+					}).Debug("packages database not modified")
+					downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: previous, Validator: validator, NotModified: true}
 					return
 				}
-
+				pkgURL = validator.URL
 			} else {
-				pkgdir, _ := homedir.Expand(pkgURL)
-				pkgdir, _ = filepath.Abs(pkgdir)
+				pkgdir, _ := filepath.Abs(localPath(pkgURL))
 				if fi, err := os.Open(pkgdir); !os.IsNotExist(err) {
 					body, err = ioutil.ReadAll(fi)
 					fi.Close()
@@ -204,56 +222,30 @@ func (repoDb *RepoDb) FetchPackages(rVersion RVersion, noSecure bool) error {
 					return
 				}
 			}
-			// cran windows PACKAGES file can have windows carriage returns, lets normalize
-			body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
-			parsedPackagesFile := bytes.Split(body, []byte("\n\n"))
-			log.WithFields(log.Fields{
-				"url":      pkgURL,
-				"num_pkgs": len(parsedPackagesFile),
-			}).Debug("potential packages")
-			for _, pkg := range parsedPackagesFile {
-				if len(pkg) == 0 {
-					// end of file might have double spaces
-					// and thus will be one split, so want
-					// to skip that
-					//todo: trim this before the loop
-					continue
-				}
-				reader := bytes.NewReader(pkg)
-				pkgDesc, err := desc.ParseDesc(reader)
-
-				if err != nil {
-					fmt.Println("problem parsing package with info ", string(pkg))
-					fmt.Println(err)
-					downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Err: err}
-					return
-				}
-
-				pkgRConstraint, packageValid := isRVersionCompatible(pkgDesc, rVersion)
-
-				// the path will be set to a character if its a special version of the package,
-				// such as an older type, or a newer type in prep for a new R version release
-				// as such, for now we'll just discard if its one of those until we can
-				// more comprehensively teach pkgr what it should do in such a situation
-				if packageValid && pkgDesc.Path == "" {
-					descriptionMap[pkgDesc.Package] = pkgDesc
-				} else {
-					log.WithFields(log.Fields{
-						"pkg":     pkgDesc.Package,
-						"version": pkgRConstraint.ToString(),
-					}).Debug("invalid package constraint")
-				}
+			descriptionMap, err := parsePackagesFile(body, rVersion)
+			if err != nil {
+				downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Err: err}
+				return
 			}
+			log.WithFields(log.Fields{
+				"url":      MaskURL(pkgURL),
+				"num_pkgs": len(descriptionMap),
+			}).Debug("packages available")
 
-			downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Err: err}
+			downloadChannel <- downloadDatabase{St: st, AvailableDescriptions: descriptionMap, Validator: validator, Err: err}
 		}(sourceType)
 
 	}
 	errorCount := 0
+	notModifiedCount := 0
 	var lasterr error
+	offlineErr := &OfflineError{}
 	for i := 0; i < len(repoDb.DescriptionsBySourceType); i++ {
 		result := <-downloadChannel
-		if result.Err != nil {
+		var oe *OfflineError
+		if errors.As(result.Err, &oe) {
+			offlineErr.Add(oe)
+		} else if result.Err != nil {
 			log.Warnf("error downloading repo %s, type: %s, with information: %s\n", repoDb.Repo.Name, result.St, result.Err)
 			errorCount++
 			lasterr = result.Err
@@ -261,16 +253,120 @@ func (repoDb *RepoDb) FetchPackages(rVersion RVersion, noSecure bool) error {
 			// as don't want a partial repodb as it might cause improperly pulled packages
 		} else {
 			repoDb.DescriptionsBySourceType[result.St] = result.AvailableDescriptions
+			if result.Validator != (Validator{}) {
+				if repoDb.Validators == nil {
+					repoDb.Validators = make(map[SourceType]Validator)
+				}
+				repoDb.Validators[result.St] = result.Validator
+			}
+			if result.NotModified {
+				notModifiedCount++
+			}
 		}
 	}
+	// an incomplete database is never cached while offline
+	if len(offlineErr.URLs) > 0 {
+		return offlineErr
+	}
 	// if only one source fails, this could be because it isn't present - eg if have binary/source but only source available
 	if len(repoDb.DescriptionsBySourceType) > 1 && errorCount == len(repoDb.DescriptionsBySourceType) {
 		return lasterr
 	}
 
+	if notModifiedCount == len(repoDb.DescriptionsBySourceType) {
+		// nothing changed, so only the age of the cache needs refreshing
+		now := time.Now()
+		return os.Chtimes(pkgdbFile, now, now)
+	}
 	return repoDb.Encode(pkgdbFile)
 }
 
+// fetchPackagesFile retrieves the PACKAGES file at a url, preferring the
+// compressed PACKAGES.gz when the repository offers it. When the validator
+// shows the cached copy is current, a nil body is returned along with it.
+func fetchPackagesFile(fetcher *Fetcher, repo RepoURL, pkgURL string, v Validator) ([]byte, Validator, error) {
+	var lastErr error
+	for _, u := range []string{pkgURL + ".gz", pkgURL} {
+		res, servedURL, err := fetcher.GetIfModified(repo, u, v)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotModified {
+			return nil, v, nil
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, Validator{}, fmt.Errorf("error reading body: %s", err)
+		}
+		// the transport may already have decompressed the content
+		if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+			gzr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, Validator{}, err
+			}
+			body, err = ioutil.ReadAll(gzr)
+			if err != nil {
+				return nil, Validator{}, fmt.Errorf("error decompressing %s: %s", MaskURL(servedURL), err)
+			}
+		}
+		return body, newValidator(servedURL, res), nil
+	}
+	return nil, Validator{}, lastErr
+}
+
+// parsePackagesFile parses the entries of a PACKAGES file, keeping every version
+// of a package that is compatible with the R version, ordered from highest to lowest.
+// Entries with a Path, such as those for older releases or for another R version,
+// are kept alongside the others as they are downloaded from that subdirectory.
+func parsePackagesFile(body []byte, rVersion RVersion) (map[string][]desc.Desc, error) {
+	descriptionMap := make(map[string][]desc.Desc)
+	// cran windows PACKAGES file can have windows carriage returns, lets normalize
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	parsedPackagesFile := bytes.Split(body, []byte("\n\n"))
+	for _, pkg := range parsedPackagesFile {
+		if len(bytes.TrimSpace(pkg)) == 0 {
+			// end of file might have double spaces
+			// and thus will be one split, so want
+			// to skip that
+			continue
+		}
+		reader := bytes.NewReader(pkg)
+		pkgDesc, err := desc.ParseDesc(reader)
+
+		if err != nil {
+			fmt.Println("problem parsing package with info ", string(pkg))
+			fmt.Println(err)
+			return descriptionMap, err
+		}
+
+		pkgRConstraint, packageValid := isRVersionCompatible(pkgDesc, rVersion)
+		if !packageValid {
+			log.WithFields(log.Fields{
+				"pkg":     pkgDesc.Package,
+				"version": pkgRConstraint.ToString(),
+				"path":    pkgDesc.Path,
+			}).Debug("invalid package constraint")
+			continue
+		}
+		descriptionMap[pkgDesc.Package] = addDescription(descriptionMap[pkgDesc.Package], pkgDesc)
+	}
+	return descriptionMap, nil
+}
+
+// addDescription adds a package description to the versions of that package,
+// keeping them ordered from highest to lowest version
+func addDescription(versions []desc.Desc, pkgDesc desc.Desc) []desc.Desc {
+	i := sort.Search(len(versions), func(i int) bool {
+		return desc.CompareVersionStrings(versions[i].Version, pkgDesc.Version) < 0
+	})
+	versions = append(versions, desc.Desc{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = pkgDesc
+	return versions
+}
+
 func isRVersionCompatible(pkgDesc desc.Desc, rVersion RVersion) (desc.Dep, bool) {
 	pkgRConstraint, present := pkgDesc.Depends["R"]
 	packageValid := true
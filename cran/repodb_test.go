@@ -1,9 +1,16 @@
 package cran
 
 import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
 	"github.com/metrumresearchgroup/pkgr/desc"
 	"github.com/stretchr/testify/suite"
-	"testing"
 )
 
 type RepoDbTestSuite struct {
@@ -272,3 +279,169 @@ func (suite *RepoDbTestSuite) TestIsRVersionCompatible_InvalidEqualsInstalledVer
 
 	suite.False(actual, "R package is invalid")
 }
+
+func (suite *RepoDbTestSuite) TestParsePackagesFile_KeepsEveryCompatibleVersion() {
+	packages := []byte(`Package: MASS
+Version: 7.3-51
+Path: older
+
+Package: MASS
+Version: 7.3-60
+Depends: R (>= 4.4.0)
+
+Package: MASS
+Version: 7.3-58
+Depends: R (>= 4.2.0)
+Path: 4.2.0/Recommended
+
+Package: R6
+Version: 2.5.1
+
+`)
+	descs, err := parsePackagesFile(packages, RVersion{Major: 4, Minor: 2, Patch: 1})
+	suite.Require().NoError(err)
+	suite.Len(descs, 2)
+
+	var versions, paths []string
+	for _, d := range descs["MASS"] {
+		versions = append(versions, d.Version)
+		paths = append(paths, d.Path)
+	}
+	suite.Equal([]string{"7.3-58", "7.3-51"}, versions)
+	suite.Equal([]string{"4.2.0/Recommended", "older"}, paths)
+}
+
+func (suite *RepoDbTestSuite) TestFetchPackages_RevalidatesCachedPackagesFile() {
+	suite.T().Setenv("XDG_CACHE_HOME", suite.T().TempDir())
+	suite.T().Setenv("R_AVAILABLE_PACKAGES_CACHE_CONTROL_MAX_AGE", "0")
+
+	etag := `"v1"`
+	packages := "Package: R6\nVersion: 2.5.1\n\n"
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path != "/src/contrib/PACKAGES.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		gzw := gzip.NewWriter(w)
+		gzw.Write([]byte(packages))
+		gzw.Close()
+	}))
+	defer server.Close()
+
+	repo := RepoURL{Name: "CRAN", URL: server.URL}
+	rv := RVersion{Major: 4, Minor: 2, Patch: 1}
+	fetcher := NewFetcher(FetchConfig{})
+	newDb := func() *RepoDb {
+		return &RepoDb{
+			Repo:                     repo,
+			DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{Source: {}},
+		}
+	}
+
+	rdb := newDb()
+	suite.Require().NoError(rdb.FetchPackages(rv, fetcher))
+	suite.Equal("2.5.1", rdb.DescriptionsBySourceType[Source]["R6"][0].Version)
+	suite.Equal(etag, rdb.Validators[Source].ETag)
+	cacheFile := rdb.GetRepoDbCacheFilePath(rv.ToFullString())
+	stale := time.Now().Add(-time.Hour)
+	suite.Require().NoError(os.Chtimes(cacheFile, stale, stale))
+
+	// unchanged, so the cached database is reused and only its age refreshed
+	rdb = newDb()
+	suite.Require().NoError(rdb.FetchPackages(rv, fetcher))
+	suite.Equal("2.5.1", rdb.DescriptionsBySourceType[Source]["R6"][0].Version)
+	fi, err := os.Stat(cacheFile)
+	suite.Require().NoError(err)
+	suite.True(fi.ModTime().After(stale))
+
+	// changed, so downloaded again
+	etag = `"v2"`
+	packages = "Package: R6\nVersion: 2.6.0\n\n"
+	rdb = newDb()
+	suite.Require().NoError(rdb.FetchPackages(rv, fetcher))
+	suite.Equal("2.6.0", rdb.DescriptionsBySourceType[Source]["R6"][0].Version)
+	suite.Equal(etag, rdb.Validators[Source].ETag)
+
+	suite.Equal([]string{"/src/contrib/PACKAGES.gz", "/src/contrib/PACKAGES.gz", "/src/contrib/PACKAGES.gz"}, requests)
+}
+
+func (suite *RepoDbTestSuite) TestFetchPackages_FallsBackToUncompressedPackagesFile() {
+	suite.T().Setenv("XDG_CACHE_HOME", suite.T().TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/src/contrib/PACKAGES" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("Package: R6\nVersion: 2.5.1\n\n"))
+	}))
+	defer server.Close()
+
+	rdb := &RepoDb{
+		Repo:                     RepoURL{Name: "CRAN", URL: server.URL},
+		DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{Source: {}},
+	}
+	suite.Require().NoError(rdb.FetchPackages(RVersion{Major: 4, Minor: 2, Patch: 1}, NewFetcher(FetchConfig{})))
+	suite.Len(rdb.DescriptionsBySourceType[Source]["R6"], 1)
+	suite.Equal(server.URL+"/src/contrib/PACKAGES", rdb.Validators[Source].URL)
+}
+
+func (suite *RepoDbTestSuite) TestFetchPackages_OfflineUsesCacheOfAnyAge() {
+	suite.T().Setenv("XDG_CACHE_HOME", suite.T().TempDir())
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		w.Write([]byte("Package: R6\nVersion: 2.5.1\n\n"))
+	}))
+	defer server.Close()
+
+	repo := RepoURL{Name: "CRAN", URL: server.URL}
+	rv := RVersion{Major: 4, Minor: 2, Patch: 1}
+	offline := NewFetcher(FetchConfig{Offline: true})
+	newDb := func() *RepoDb {
+		return &RepoDb{
+			Repo:                     repo,
+			DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{Source: {}},
+		}
+	}
+
+	// nothing cached, so the packages file that is needed is reported
+	rdb := newDb()
+	err := rdb.FetchPackages(rv, offline)
+	var offlineErr *OfflineError
+	suite.Require().ErrorAs(err, &offlineErr)
+	suite.Equal([]string{server.URL + "/src/contrib/PACKAGES"}, offlineErr.URLs)
+	cacheFile := rdb.GetRepoDbCacheFilePath(rv.ToFullString())
+	suite.NoFileExists(cacheFile)
+
+	suite.Require().NoError(newDb().FetchPackages(rv, NewFetcher(FetchConfig{})))
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	suite.Require().NoError(os.Chtimes(cacheFile, old, old))
+	requests = nil
+
+	rdb = newDb()
+	suite.Require().NoError(rdb.FetchPackages(rv, offline))
+	suite.Equal("2.5.1", rdb.DescriptionsBySourceType[Source]["R6"][0].Version)
+	suite.Empty(requests)
+}
+
+func (suite *RepoDbTestSuite) TestFetchPackages_ReadsFileURL() {
+	suite.T().Setenv("XDG_CACHE_HOME", suite.T().TempDir())
+	dir := suite.T().TempDir()
+	suite.Require().NoError(os.MkdirAll(filepath.Join(dir, "src", "contrib"), 0755))
+	suite.Require().NoError(os.WriteFile(filepath.Join(dir, "src", "contrib", "PACKAGES"), []byte("Package: R6\nVersion: 2.5.1\n\n"), 0644))
+
+	rdb := &RepoDb{
+		Repo:                     RepoURL{Name: "mirror", URL: "file://" + filepath.ToSlash(dir)},
+		DescriptionsBySourceType: map[SourceType]map[string][]desc.Desc{Source: {}},
+	}
+	suite.Require().NoError(rdb.FetchPackages(RVersion{Major: 4, Minor: 2, Patch: 1}, NewFetcher(FetchConfig{Offline: true})))
+	suite.Len(rdb.DescriptionsBySourceType[Source]["R6"], 1)
+}
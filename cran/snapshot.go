@@ -0,0 +1,46 @@
+package cran
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// snapshotDateLayout is the format of a snapshot date, eg 2024-03-01
+const snapshotDateLayout = "2006-01-02"
+
+// snapshotSegment matches the final path segment that selects the state of a
+// repository, either the latest state, a date, or a numeric RSPM snapshot id
+var snapshotSegment = regexp.MustCompile(`^(latest|[0-9]{4}-[0-9]{2}-[0-9]{2}|[0-9]+)$`)
+
+// SupportsSnapshot tells if a repository type serves dated snapshots
+func SupportsSnapshot(rt RepoType) bool {
+	return rt == RSPM || rt == MPN
+}
+
+// SnapshotURL rewrites the url of an RSPM or MPN repository to the endpoint serving
+// the repository as it was on the snapshot date. The final segment of the url is
+// replaced when it already selects a state of the repository, such as latest,
+// otherwise the date is appended. For example, with a snapshot of 2024-03-01
+//
+//	https://packagemanager.posit.co/cran/latest
+//	https://mpn.metworx.com/snapshots/stable/2023-06-29
+//
+// become
+//
+//	https://packagemanager.posit.co/cran/2024-03-01
+//	https://mpn.metworx.com/snapshots/stable/2024-03-01
+func SnapshotURL(url string, rt RepoType, snapshot string) (string, error) {
+	if !SupportsSnapshot(rt) {
+		return url, fmt.Errorf("snapshots are only available for RSPM and MPN repositories, not %s", rt)
+	}
+	if _, err := time.Parse(snapshotDateLayout, snapshot); err != nil {
+		return url, fmt.Errorf("invalid snapshot date %s, expected a date such as 2024-03-01", snapshot)
+	}
+	base := strings.TrimSuffix(url, "/")
+	if i := strings.LastIndex(base, "/"); i >= 0 && snapshotSegment.MatchString(base[i+1:]) {
+		base = base[:i]
+	}
+	return base + "/" + snapshot, nil
+}
@@ -0,0 +1,40 @@
+package cran
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		rt       RepoType
+		expected string
+	}{
+		{"https://packagemanager.posit.co/cran/latest", RSPM, "https://packagemanager.posit.co/cran/2024-03-01"},
+		{"https://packagemanager.posit.co/cran/__linux__/jammy/latest/", RSPM, "https://packagemanager.posit.co/cran/__linux__/jammy/2024-03-01"},
+		{"https://packagemanager.posit.co/cran/2023-01-15", RSPM, "https://packagemanager.posit.co/cran/2024-03-01"},
+		{"https://packagemanager.posit.co/cran/5473", RSPM, "https://packagemanager.posit.co/cran/2024-03-01"},
+		{"https://mpn.metworx.com/snapshots/stable/2023-06-29", MPN, "https://mpn.metworx.com/snapshots/stable/2024-03-01"},
+		{"https://mpn.metworx.com/snapshots/stable", MPN, "https://mpn.metworx.com/snapshots/stable/2024-03-01"},
+	}
+	for _, tt := range tests {
+		u, err := SnapshotURL(tt.url, tt.rt, "2024-03-01")
+		require.NoError(t, err, tt.url)
+		assert.Equal(t, tt.expected, u, tt.url)
+	}
+
+	_, err := SnapshotURL("https://cran.r-project.org", CRAN, "2024-03-01")
+	assert.Error(t, err)
+	_, err = SnapshotURL("https://packagemanager.posit.co/cran/latest", RSPM, "March 2024")
+	assert.Error(t, err)
+}
+
+func TestRepoDbHashIncludesSnapshot(t *testing.T) {
+	repo := RepoURL{Name: "RSPM", URL: "https://packagemanager.posit.co/cran/2024-03-01"}
+	rdb := RepoDb{Repo: repo}
+	snapshot := RepoDb{Repo: repo, Snapshot: "2024-03-01"}
+	assert.NotEqual(t, rdb.Hash("4.2.1"), snapshot.Hash("4.2.1"))
+}
@@ -3,6 +3,8 @@ package cran
 import (
 	"time"
 
+	"github.com/spf13/afero"
+
 	"github.com/metrumresearchgroup/pkgr/desc"
 )
 
@@ -14,21 +16,31 @@ type RepoURL struct {
 	URL    string
 	Name   string
 	Suffix string
+	// Mirrors are alternate URLs for the repository,
+	// tried in order when a file cannot be fetched from URL
+	Mirrors []string
 }
 
 // RepoDb represents a Db
+// DescriptionsBySourceType holds every available version of each package,
+// ordered from highest to lowest version
 type RepoDb struct {
-	DescriptionsBySourceType map[SourceType]map[string]desc.Desc
+	DescriptionsBySourceType map[SourceType]map[string][]desc.Desc
 	Time                     time.Time
 	Repo                     RepoURL
 	DefaultSourceType        SourceType
 	RepoSuffix               string
+	// Validators of the PACKAGES file fetched for each source type
+	Validators map[SourceType]Validator
+	// Snapshot is the date of the repository snapshot, if the url is for one
+	Snapshot string
 }
 
 // InstallConfig contains custom settings for a full install
 type InstallConfig struct {
-	Packages map[string]PkgConfig
-	Repos    map[string]RepoConfig
+	Packages    map[string]PkgConfig
+	Repos       map[string]RepoConfig
+	Constraints map[string]desc.Dep
 }
 
 // RepoConfig contains settings for a repo
@@ -36,6 +48,8 @@ type RepoConfig struct {
 	DefaultSourceType SourceType
 	RepoType          RepoType
 	RepoSuffix        string
+	// Snapshot is the date the repository url was rewritten to, see SnapshotURL
+	Snapshot string
 }
 
 //PkgConfig stores configuration information about a given package
@@ -49,6 +63,13 @@ type PkgNexus struct {
 	Db                []*RepoDb
 	Config            *InstallConfig
 	DefaultSourceType SourceType
+	// Fetcher retrieves every file from the repositories of the database
+	Fetcher *Fetcher
+	// Fs and CacheDir locate the package cache, where the tarballs read while
+	// searching the archive of a repository are kept. Nothing is kept when
+	// CacheDir is empty.
+	Fs       afero.Fs
+	CacheDir string
 }
 
 // Download provides information about the package download
@@ -57,6 +78,8 @@ type Download struct {
 	New      bool
 	Metadata PkgDl
 	Size     int64
+	// URL the package was downloaded from, which may be a repository mirror
+	URL string
 }
 
 func (d Download) GetMegabytes() float64 {
@@ -87,6 +110,9 @@ type OutdatedPackage struct {
 	Package    string
 	OldVersion string
 	NewVersion string
+	// Required is set when the installed version violates a version
+	// requirement, so the package must be replaced even if not updating
+	Required bool
 }
 
 type OsRelease struct {
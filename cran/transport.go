@@ -0,0 +1,182 @@
+package cran
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig contains the proxies used to reach repositories
+// NoProxy is a comma-separated list of hosts, domains (matching any subdomain),
+// IP addresses, or CIDR ranges that are connected to directly
+type ProxyConfig struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+}
+
+// IsSet reports whether any proxy setting is given
+func (p ProxyConfig) IsSet() bool {
+	return p.HTTP != "" || p.HTTPS != "" || p.NoProxy != ""
+}
+
+// TransportConfig contains the TLS and proxy settings for repository connections
+type TransportConfig struct {
+	// NoSecure will allow https fetching without validating the certificate chain.
+	// This occasionally is needed for repos that have self signed or certs not fully verifiable
+	// which will return errors such as x509: certificate signed by unknown authority
+	NoSecure bool
+	// CABundles are PEM files whose certificates are trusted in addition to the system pool
+	CABundles []string
+	// HostCABundles are PEM files whose certificates are trusted, in addition to
+	// the system pool and CABundles, only for connections to a host, keyed by
+	// the host name. They hold the bundles configured for a single repository,
+	// whose certificate authority is not trusted for other hosts.
+	HostCABundles map[string][]string
+	// Proxy overrides the proxy environment variables when set
+	Proxy ProxyConfig
+	// HostConnections is the number of idle connections kept open to each host,
+	// so that connections are reused by requests made at the same time
+	HostConnections int
+}
+
+// NewTransport creates the transport shared by every repository connection.
+// Connections to a host with bundles of its own are made by a transport of
+// their own, trusting those bundles as well.
+func NewTransport(tc TransportConfig) (http.RoundTripper, error) {
+	shared, err := newHostTransport(tc, tc.CABundles)
+	if err != nil {
+		return nil, err
+	}
+	if len(tc.HostCABundles) == 0 {
+		return shared, nil
+	}
+	ht := &hostTransport{shared: shared, hosts: make(map[string]*http.Transport)}
+	for host, bundles := range tc.HostCABundles {
+		tr, err := newHostTransport(tc, append(append([]string{}, tc.CABundles...), bundles...))
+		if err != nil {
+			return nil, err
+		}
+		ht.hosts[strings.ToLower(host)] = tr
+	}
+	return ht, nil
+}
+
+// newHostTransport creates a transport trusting the certificates of the CA
+// bundles in addition to the system pool
+func newHostTransport(tc TransportConfig, caBundles []string) (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: tc.NoSecure}
+	tr.MaxIdleConnsPerHost = tc.HostConnections
+	if tr.MaxIdleConnsPerHost < 1 {
+		tr.MaxIdleConnsPerHost = DefaultHostConnections
+	}
+	if len(caBundles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, bundle := range caBundles {
+			pem, err := ioutil.ReadFile(bundle)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA bundle: %s", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", bundle)
+			}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if tc.Proxy.IsSet() {
+		proxy, err := proxyFunc(tc.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = proxy
+	}
+	return tr, nil
+}
+
+// hostTransport sends the requests to each host with CA bundles of its own
+// through the transport trusting them, and all others through the shared one
+type hostTransport struct {
+	shared *http.Transport
+	hosts  map[string]*http.Transport
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, found := t.hosts[strings.ToLower(req.URL.Hostname())]; found {
+		return tr.RoundTrip(req)
+	}
+	return t.shared.RoundTrip(req)
+}
+
+// environmentProxy selects the proxy for a request from the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables
+var environmentProxy = http.ProxyFromEnvironment
+
+// proxyFunc selects the proxy for each request from the proxy settings. The
+// proxy for a scheme without one set is taken from the environment.
+func proxyFunc(pc ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	proxies := make(map[string]*url.URL)
+	for scheme, p := range map[string]string{"http": pc.HTTP, "https": pc.HTTPS} {
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "://") {
+			p = "http://" + p
+		}
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s proxy %s: %s", scheme, MaskURL(p), err)
+		}
+		proxies[scheme] = u
+	}
+	var noProxy []string
+	for _, np := range strings.Split(pc.NoProxy, ",") {
+		if np = strings.ToLower(strings.TrimSpace(np)); np != "" {
+			noProxy = append(noProxy, np)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		if p, found := proxies[req.URL.Scheme]; found {
+			return p, nil
+		}
+		return environmentProxy(req)
+	}, nil
+}
+
+// bypassProxy reports whether a url matches an entry of the no proxy list
+func bypassProxy(u *url.URL, noProxy []string) bool {
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+	for _, np := range noProxy {
+		if np == "*" {
+			return true
+		}
+		if h, port, err := net.SplitHostPort(np); err == nil {
+			if port != u.Port() {
+				continue
+			}
+			np = h
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(np); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		}
+		np = strings.TrimPrefix(strings.TrimPrefix(np, "*"), ".")
+		if host == np || strings.HasSuffix(host, "."+np) {
+			return true
+		}
+	}
+	return false
+}
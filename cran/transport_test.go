@@ -0,0 +1,148 @@
+package cran
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransportCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	t.Run("untrusted without the bundle", func(t *testing.T) {
+		tr, err := NewTransport(TransportConfig{})
+		require.NoError(t, err)
+		_, err = (&http.Client{Transport: tr}).Get(server.URL)
+		assert.Error(t, err)
+	})
+
+	t.Run("trusted with the bundle", func(t *testing.T) {
+		tr, err := NewTransport(TransportConfig{CABundles: []string{bundle}})
+		require.NoError(t, err)
+		res, err := (&http.Client{Transport: tr}).Get(server.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("host bundle trusted only for its host", func(t *testing.T) {
+		u, _ := url.Parse(server.URL)
+		tr, err := NewTransport(TransportConfig{HostCABundles: map[string][]string{u.Hostname(): {bundle}}})
+		require.NoError(t, err)
+		res, err := (&http.Client{Transport: tr}).Get(server.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		tr, err = NewTransport(TransportConfig{HostCABundles: map[string][]string{"pkgs.example.com": {bundle}}})
+		require.NoError(t, err)
+		_, err = (&http.Client{Transport: tr}).Get(server.URL)
+		assert.Error(t, err, "a repository's CA is not trusted for other hosts")
+	})
+
+	t.Run("invalid bundles", func(t *testing.T) {
+		_, err := NewTransport(TransportConfig{CABundles: []string{filepath.Join(dir, "missing.pem")}})
+		assert.Error(t, err)
+		notPem := filepath.Join(dir, "not.pem")
+		require.NoError(t, os.WriteFile(notPem, []byte("not a certificate"), 0644))
+		_, err = NewTransport(TransportConfig{CABundles: []string{notPem}})
+		assert.Error(t, err)
+		_, err = NewTransport(TransportConfig{HostCABundles: map[string][]string{"pkgs.example.com": {notPem}}})
+		assert.Error(t, err)
+	})
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer direct.Close()
+
+	tr, err := NewTransport(TransportConfig{Proxy: ProxyConfig{HTTP: proxy.URL, NoProxy: "127.0.0.1"}})
+	require.NoError(t, err)
+	client := &http.Client{Transport: tr}
+
+	res, err := client.Get("http://cran.example.com/src/contrib/PACKAGES")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "proxied http://cran.example.com/src/contrib/PACKAGES", string(body))
+
+	res, err = client.Get(direct.URL)
+	require.NoError(t, err)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "direct", string(body))
+}
+
+func TestProxyFuncFallsBackToEnvironment(t *testing.T) {
+	envProxy, _ := url.Parse("http://env-proxy.example.com:3128")
+	original := environmentProxy
+	environmentProxy = func(*http.Request) (*url.URL, error) { return envProxy, nil }
+	t.Cleanup(func() { environmentProxy = original })
+	configured, _ := url.Parse("http://https-proxy.example.com:3128")
+
+	tests := []struct {
+		name     string
+		config   ProxyConfig
+		url      string
+		expected *url.URL
+	}{
+		{"only no proxy set", ProxyConfig{NoProxy: "internal.example.com"}, "https://cran.example.com", envProxy},
+		{"only no proxy set, bypassed", ProxyConfig{NoProxy: "internal.example.com"}, "https://internal.example.com", nil},
+		{"scheme set", ProxyConfig{HTTPS: configured.String()}, "https://cran.example.com", configured},
+		{"other scheme set", ProxyConfig{HTTPS: configured.String()}, "http://cran.example.com", envProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := proxyFunc(tt.config)
+			require.NoError(t, err)
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			actual, err := proxy(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := []string{"internal.example.com", ".corp.example.com", "10.0.0.0/8", "localhost:8080"}
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://internal.example.com/cran", true},
+		{"https://pkgs.internal.example.com/cran", true},
+		{"https://corp.example.com/cran", true},
+		{"https://a.corp.example.com/cran", true},
+		{"https://example.com/cran", false},
+		{"http://10.1.2.3/cran", true},
+		{"http://192.168.1.1/cran", false},
+		{"http://localhost:8080/cran", true},
+		{"http://localhost:9090/cran", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		assert.Equal(t, tt.expected, bypassProxy(u, noProxy), tt.url)
+	}
+	u, _ := url.Parse("https://cran.r-project.org")
+	assert.True(t, bypassProxy(u, []string{"*"}))
+}
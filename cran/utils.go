@@ -8,8 +8,12 @@ import (
 	"github.com/spf13/viper"
 	"io"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
 )
 
 type BinaryUriType int
@@ -156,6 +160,22 @@ func cranBinaryURL(rv RVersion) string {
 	}
 }
 
+// driveLetterRegex matches the path of a file url to a drive on windows, eg /C:/repo
+var driveLetterRegex = regexp.MustCompile(`^/[A-Za-z]:`)
+
+// localPath provides the path of a repository, or a file in it, that is not served
+// over http, given either as a path or as a file:// url, expanding any leading ~
+func localPath(url string) string {
+	if p, found := strings.CutPrefix(url, "file://"); found {
+		url = p
+		if driveLetterRegex.MatchString(url) {
+			url = url[1:]
+		}
+	}
+	p, _ := homedir.Expand(url)
+	return filepath.Clean(filepath.FromSlash(p))
+}
+
 // RepoURLHash provides a hash of the repoURL
 // given the structure Name-<urlhash>
 func RepoURLHash(r RepoURL) string {
@@ -2,6 +2,7 @@ package cran
 
 import (
 	"fmt"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +43,9 @@ func TestUrlHash(t *testing.T) {
 
 	}
 }
+
+func TestLocalPath(t *testing.T) {
+	assert.Equal(t, filepath.FromSlash("/srv/mirror/src/contrib/PACKAGES"), localPath("file:///srv/mirror/src/contrib/PACKAGES"))
+	assert.Equal(t, filepath.FromSlash("/srv/mirror"), localPath("/srv/mirror/"))
+	assert.Equal(t, filepath.FromSlash("C:/mirror"), localPath("file:///C:/mirror"))
+}
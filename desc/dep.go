@@ -9,4 +9,28 @@ func (d Dep) ToString() string {
 	return fmt.Sprintf("%s (%s %s)", d.Name, d.Constraint.ToString(), d.Version.String)
 }
 
+// IsSatisfiedBy reports whether the given version fulfills the version
+// requirement of the dependency. A dependency without a constraint is
+// satisfied by any version.
+func (d Dep) IsSatisfiedBy(version string) bool {
+	if d.Constraint == None {
+		return true
+	}
+	cmp := CompareVersions(ParseVersion(version), d.Version)
+	switch d.Constraint {
+	case GT:
+		return cmp > 0
+	case GTE:
+		return cmp >= 0
+	case LT:
+		return cmp < 0
+	case LTE:
+		return cmp <= 0
+	case Equals:
+		return cmp == 0
+	default:
+		return false
+	}
+}
+
 // R (>= 3.6)
@@ -110,3 +110,23 @@ func (suite *DepTestSuite) TestDepToString_VersionContainsDev() {
 
 	suite.Equal(expected, actual)
 }
+
+func (suite *DepTestSuite) TestDepIsSatisfiedBy() {
+	tests := []struct {
+		dep      Dep
+		version  string
+		expected bool
+	}{
+		{Dep{Name: "dplyr"}, "0.0.1", true},
+		{Dep{Name: "dplyr", Constraint: Equals, Version: ParseVersion("1.0.10")}, "1.0.10", true},
+		{Dep{Name: "dplyr", Constraint: Equals, Version: ParseVersion("1.0.10")}, "1.1.0", false},
+		{Dep{Name: "data.table", Constraint: GTE, Version: ParseVersion("1.14")}, "1.14.0", true},
+		{Dep{Name: "data.table", Constraint: GTE, Version: ParseVersion("1.14")}, "1.13.6", false},
+		{Dep{Name: "rlang", Constraint: GT, Version: ParseVersion("1.0.0")}, "1.0.0", false},
+		{Dep{Name: "rlang", Constraint: LT, Version: ParseVersion("1.0.0")}, "0.4.12", true},
+		{Dep{Name: "rlang", Constraint: LTE, Version: ParseVersion("1.0.0")}, "1.0.1", false},
+	}
+	for _, tt := range tests {
+		suite.Equal(tt.expected, tt.dep.IsSatisfiedBy(tt.version), "%s %s", tt.dep.ToString(), tt.version)
+	}
+}
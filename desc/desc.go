@@ -55,9 +55,11 @@ func NewDesc(d desc) Desc {
 		Description:       d.Description,
 		License:           d.License,
 		MD5sum:            d.MD5sum,
+		SHA256:            d.SHA256,
 		Path:              d.Path,
 		Priority:          d.Priority,
 		Remotes:           d.Remotes,
+		RemoteSha:         d.RemoteSha,
 		Repository:        d.Repository,
 		Imports:           make(map[string]Dep),
 		Suggests:          make(map[string]Dep),
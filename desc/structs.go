@@ -63,10 +63,12 @@ type Desc struct {
 	Description        string
 	License            string
 	MD5sum             string
+	SHA256             string
 	NeedsCompilation   bool
 	Path               string
 	Priority           string
 	Remotes            []string
+	RemoteSha          string
 	OriginalRepository string
 	Repository         string
 	Imports            map[string]Dep
@@ -106,6 +108,9 @@ type desc struct {
 	Description        string
 	License            string
 	MD5sum             string
+	// SHA256 is not written by tools::write_PACKAGES but is
+	// provided by some repositories
+	SHA256             string
 	NeedsCompilation   string
 	// Path: 4.1.0/Recommended
 	// Path: older
@@ -113,6 +118,8 @@ type desc struct {
 	// Priority: recommended
 	Priority           string
 	Remotes            []string `delim:"," strip:"\n\r\t "`
+	// RemoteSha: the commit a package installed from a git remote was built from
+	RemoteSha          string
 	OriginalRepository string
 	Repository         string
 	Imports            []string `delim:"," strip:"\n\r\t "`
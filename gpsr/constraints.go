@@ -0,0 +1,177 @@
+package gpsr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+// UnsatisfiedDep is a version requirement that cannot be met by the version
+// of the dependency that would be present after installation
+type UnsatisfiedDep struct {
+	// Package declaring the requirement, empty for requirements from the configuration
+	Package   string
+	Version   string
+	Requires  desc.Dep
+	Available string
+	Repo      string
+}
+
+func (u UnsatisfiedDep) String() string {
+	requiredBy := "configuration"
+	if u.Package != "" {
+		requiredBy = fmt.Sprintf("%s %s", u.Package, u.Version)
+	}
+	if u.Available == "" {
+		return fmt.Sprintf("%s requires %s, but no version is available", requiredBy, u.Requires.ToString())
+	}
+	return fmt.Sprintf("%s requires %s, but only %s is available from %s", requiredBy, u.Requires.ToString(), u.Available, u.Repo)
+}
+
+// UnsatisfiedDepsError reports every unsatisfied version requirement in an installation plan
+type UnsatisfiedDepsError struct {
+	Deps []UnsatisfiedDep
+}
+
+func (e *UnsatisfiedDepsError) Error() string {
+	var reqs []string
+	for _, u := range e.Deps {
+		reqs = append(reqs, u.String())
+	}
+	return fmt.Sprintf("unsatisfied version requirements: %s", strings.Join(reqs, "; "))
+}
+
+// constraintChecker determines which version of each package will be present
+// once the plan is installed and checks the version requirements against them
+type constraintChecker struct {
+	pkgNexus  *cran.PkgNexus
+	installed map[string]desc.Desc
+	outdated  map[string]bool
+	update    bool
+	// installed packages that must be replaced to satisfy a requirement
+	required map[string]bool
+}
+
+// effective returns the description of the version of a package that will be
+// present after installation and, if it comes from a repository, which one
+func (cc *constraintChecker) effective(pkg string) (desc.Desc, string, bool) {
+	inst, isInstalled := cc.installed[pkg]
+	if isInstalled && !cc.required[pkg] && !(cc.update && cc.outdated[pkg]) {
+		return inst, "library", true
+	}
+	pd, cfg, found := cc.pkgNexus.GetPackage(pkg)
+	return pd, cfg.Repo.Name, found
+}
+
+// check verifies a single requirement, marking the dependency as required to
+// be replaced when the installed version violates it but the repository
+// version does not. It returns whether a new replacement was marked.
+func (cc *constraintChecker) check(pkg, version string, dep desc.Dep, unsatisfied *[]UnsatisfiedDep) bool {
+	dd, repo, found := cc.effective(dep.Name)
+	if found && dep.IsSatisfiedBy(dd.Version) {
+		return false
+	}
+	if _, isInstalled := cc.installed[dep.Name]; isInstalled && !cc.required[dep.Name] {
+		candidate, _, ok := cc.pkgNexus.GetPackage(dep.Name)
+		if ok && dep.IsSatisfiedBy(candidate.Version) {
+			cc.required[dep.Name] = true
+			return true
+		}
+	}
+	*unsatisfied = append(*unsatisfied, UnsatisfiedDep{
+		Package:   pkg,
+		Version:   version,
+		Requires:  dep,
+		Available: dd.Version,
+		Repo:      repo,
+	})
+	return false
+}
+
+// checkConstraints checks the version requirements of every package in the plan,
+// along with any requirements set in the package database configuration, against
+// the versions that will be present after installation. Installed packages that
+// violate a requirement, but can be replaced by a repository version that does not,
+// are added to the outdated packages as required updates.
+func checkConstraints(
+	pkgs []string,
+	preinstalledPkgs map[string]desc.Desc,
+	outdatedPackages []cran.OutdatedPackage,
+	pkgNexus *cran.PkgNexus,
+	update bool,
+) ([]cran.OutdatedPackage, []UnsatisfiedDep) {
+	cc := constraintChecker{
+		pkgNexus:  pkgNexus,
+		installed: preinstalledPkgs,
+		outdated:  make(map[string]bool),
+		update:    update,
+		required:  make(map[string]bool),
+	}
+	for _, op := range outdatedPackages {
+		cc.outdated[op.Package] = true
+	}
+	inPlan := make(map[string]bool)
+	for _, p := range pkgs {
+		inPlan[p] = true
+	}
+	pkgs = append([]string{}, pkgs...)
+	sort.Strings(pkgs)
+
+	var unsatisfied []UnsatisfiedDep
+	// replacing a package can change the requirements it declares,
+	// so keep checking until no further replacements are needed
+	for changed := true; changed; {
+		changed = false
+		unsatisfied = nil
+		for _, p := range pkgs {
+			if dep, exists := pkgNexus.Config.Constraints[p]; exists {
+				changed = cc.check("", "", dep, &unsatisfied) || changed
+			}
+			pd, _, found := cc.effective(p)
+			if !found {
+				continue
+			}
+			deps := make(map[string]desc.Dep)
+			for _, reqs := range []map[string]desc.Dep{pd.Depends, pd.Imports, pd.LinkingTo} {
+				for n, d := range reqs {
+					if inPlan[n] && d.Constraint != desc.None {
+						deps[n] = d
+					}
+				}
+			}
+			var names []string
+			for n := range deps {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				changed = cc.check(p, pd.Version, deps[n], &unsatisfied) || changed
+			}
+		}
+	}
+
+	for i, op := range outdatedPackages {
+		if cc.required[op.Package] {
+			outdatedPackages[i].Required = true
+			delete(cc.required, op.Package)
+		}
+	}
+	var required []string
+	for p := range cc.required {
+		required = append(required, p)
+	}
+	sort.Strings(required)
+	for _, p := range required {
+		candidate, _, _ := pkgNexus.GetPackage(p)
+		outdatedPackages = append(outdatedPackages, cran.OutdatedPackage{
+			Package:    p,
+			OldVersion: preinstalledPkgs[p].Version,
+			NewVersion: candidate.Version,
+			Required:   true,
+		})
+	}
+	return outdatedPackages, unsatisfied
+}
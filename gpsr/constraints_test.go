@@ -0,0 +1,87 @@
+package gpsr
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func newConstraintTestNexus(pkgs ...desc.Desc) *cran.PkgNexus {
+	descs := make(map[string][]desc.Desc)
+	for _, p := range pkgs {
+		descs[p.Package] = append(descs[p.Package], p)
+	}
+	return &cran.PkgNexus{
+		Db: []*cran.RepoDb{{
+			Repo:                     cran.RepoURL{Name: "CRAN", URL: "https://cran.example.com"},
+			DescriptionsBySourceType: map[cran.SourceType]map[string][]desc.Desc{cran.Source: descs},
+		}},
+		Config:            cran.NewInstallConfig(),
+		DefaultSourceType: cran.Source,
+	}
+}
+
+func TestResolveInstallationReqsConstraints(t *testing.T) {
+	dplyr := desc.Desc{
+		Package: "dplyr",
+		Version: "1.1.2",
+		Imports: map[string]desc.Dep{
+			"rlang":    desc.ParseDep("rlang (>= 1.1.0)"),
+			"vctrs":    desc.ParseDep("vctrs (>= 0.6.0)"),
+			"magrittr": desc.ParseDep("magrittr"),
+		},
+	}
+	rlang := desc.Desc{Package: "rlang", Version: "1.0.6"}
+	vctrs := desc.Desc{Package: "vctrs", Version: "0.6.3"}
+	magrittr := desc.Desc{Package: "magrittr", Version: "2.0.3"}
+
+	t.Run("reports every unsatisfied requirement", func(t *testing.T) {
+		nexus := newConstraintTestNexus(dplyr, rlang, desc.Desc{Package: "vctrs", Version: "0.5.2"}, magrittr)
+		_, err := ResolveInstallationReqs([]string{"dplyr"}, nil, NewDefaultInstallDeps(), nexus, true, true, false)
+		require.Error(t, err)
+		unsatisfied, ok := err.(*UnsatisfiedDepsError)
+		require.True(t, ok)
+		assert.Equal(t, []UnsatisfiedDep{
+			{Package: "dplyr", Version: "1.1.2", Requires: dplyr.Imports["rlang"], Available: "1.0.6", Repo: "CRAN"},
+			{Package: "dplyr", Version: "1.1.2", Requires: dplyr.Imports["vctrs"], Available: "0.5.2", Repo: "CRAN"},
+		}, unsatisfied.Deps)
+		assert.Contains(t, err.Error(), "dplyr 1.1.2 requires rlang (>= 1.1.0), but only 1.0.6 is available from CRAN")
+	})
+
+	t.Run("replaces installed packages that violate a requirement", func(t *testing.T) {
+		nexus := newConstraintTestNexus(dplyr, desc.Desc{Package: "rlang", Version: "1.1.1"}, vctrs, magrittr)
+		installed := map[string]desc.Desc{
+			"rlang": {Package: "rlang", Version: "1.0.6"},
+			"vctrs": {Package: "vctrs", Version: "0.6.1"},
+		}
+		// even when not updating, rlang must be replaced while vctrs can stay
+		ip, err := ResolveInstallationReqs([]string{"dplyr"}, installed, NewDefaultInstallDeps(), nexus, false, true, false)
+		require.NoError(t, err)
+		assert.Equal(t, []cran.OutdatedPackage{
+			{Package: "rlang", OldVersion: "1.0.6", NewVersion: "1.1.1", Required: true},
+			{Package: "vctrs", OldVersion: "0.6.1", NewVersion: "0.6.3"},
+		}, sortedOutdated(ip.OutdatedPackages))
+	})
+
+	t.Run("enforces requirements set on the package database", func(t *testing.T) {
+		nexus := newConstraintTestNexus(desc.Desc{Package: "magrittr", Version: "2.0.3"})
+		nexus.SetPackageConstraint("magrittr", desc.ParseDep("magrittr (<= 2.0.3)"))
+		installed := map[string]desc.Desc{"magrittr": {Package: "magrittr", Version: "2.1.0"}}
+		ip, err := ResolveInstallationReqs([]string{"magrittr"}, installed, NewDefaultInstallDeps(), nexus, true, true, false)
+		require.NoError(t, err)
+		assert.Equal(t, []cran.OutdatedPackage{
+			{Package: "magrittr", OldVersion: "2.1.0", NewVersion: "2.0.3", Required: true},
+		}, ip.OutdatedPackages)
+	})
+}
+
+func sortedOutdated(ops []cran.OutdatedPackage) []cran.OutdatedPackage {
+	sorted := append([]cran.OutdatedPackage{}, ops...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Package < sorted[j].Package })
+	return sorted
+}
@@ -125,6 +125,77 @@ func (ip *InstallPlan) InvertDependencies() map[string][]string {
 	return idb
 }
 
+// Prune removes packages from the plan, along with every package that depends on
+// them, so the rest of the plan can be installed without them. The names of all
+// the packages removed are returned.
+func (ip *InstallPlan) Prune(pkgs []string) []string {
+	iDeps := ip.InvertDependencies()
+	removed := make(map[string]bool)
+	queue := append([]string{}, pkgs...)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if removed[p] {
+			continue
+		}
+		removed[p] = true
+		queue = append(queue, iDeps[p]...)
+	}
+
+	var starting []string
+	for _, p := range ip.StartingPackages {
+		if !removed[p] {
+			starting = append(starting, p)
+		}
+	}
+	ip.StartingPackages = starting
+	for p := range removed {
+		delete(ip.DepDb, p)
+	}
+	var downloads []cran.PkgDl
+	for _, d := range ip.PackageDownloads {
+		if !removed[d.Package.Package] {
+			downloads = append(downloads, d)
+		}
+	}
+	ip.PackageDownloads = downloads
+	var outdated []cran.OutdatedPackage
+	for _, op := range ip.OutdatedPackages {
+		if !removed[op.Package] {
+			outdated = append(outdated, op)
+		}
+	}
+	ip.OutdatedPackages = outdated
+
+	names := make([]string, 0, len(removed))
+	for p := range removed {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DownloadOrder lists the packages to download in an order they can be installed
+// in, each after all of its dependencies, so that packages become ready to install
+// while the rest are downloaded. Packages with fewer dependencies come first.
+func (ip *InstallPlan) DownloadOrder() []cran.PkgDl {
+	seen := make(map[string]bool)
+	var downloads []cran.PkgDl
+	for _, d := range ip.PackageDownloads {
+		if seen[d.Package.Package] {
+			continue
+		}
+		seen[d.Package.Package] = true
+		downloads = append(downloads, d)
+	}
+	// DepDb holds every dependency of a package, not only the direct ones, so a
+	// package always has more than any of its dependencies
+	sort.SliceStable(downloads, func(i, j int) bool {
+		return len(ip.DepDb[downloads[i].Package.Package]) < len(ip.DepDb[downloads[j].Package.Package])
+	})
+	return downloads
+}
+
 func (ip *InstallPlan) Pack(pkgNexus *cran.PkgNexus) {
 	var toDl []cran.PkgDl
 	// starting packages
@@ -168,10 +239,51 @@ func (ip *InstallPlan) GetNumPackagesToInstall() int {
 	}
 	toUpdate := 0
 	// Everything in OutdatedPackages should be required, otherwise pkgr wouldn't have checked for an updated version.
-	if ip.Update {
-		toUpdate = len(ip.OutdatedPackages)
+	for _, op := range ip.OutdatedPackages {
+		if ip.Update || op.Required {
+			toUpdate++
+		}
 	}
 
 	return len(requiredPackages) - installedRequired + toUpdate
 
 }
+
+// ReplacedPackages lists the installed packages of the plan that another version
+// is installed of. Without updating, only packages that violate a version
+// requirement are replaced.
+func (ip *InstallPlan) ReplacedPackages() []cran.OutdatedPackage {
+	all := ip.GetAllPackages()
+	var replaced []cran.OutdatedPackage
+	for _, op := range ip.OutdatedPackages {
+		if !ip.Update && !op.Required {
+			continue
+		}
+		if funk.ContainsString(all, op.Package) {
+			replaced = append(replaced, op)
+		}
+	}
+	return replaced
+}
+
+// KeptPackages lists the installed packages of the plan that are kept as they
+// are rather than installed again, sorted by name
+func (ip *InstallPlan) KeptPackages() []string {
+	replaced := make(map[string]bool)
+	for _, op := range ip.ReplacedPackages() {
+		replaced[op.Package] = true
+	}
+	var kept []string
+	for _, p := range ip.GetAllPackages() {
+		if _, installed := ip.InstalledPackages[p]; !installed || replaced[p] {
+			continue
+		}
+		// additional packages are always installed, even if they are already
+		if _, additional := ip.AdditionalPackageSources[p]; additional {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	sort.Strings(kept)
+	return kept
+}
@@ -0,0 +1,91 @@
+package gpsr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+)
+
+func TestPrune(t *testing.T) {
+	dl := func(pkg string) cran.PkgDl {
+		return cran.PkgDl{Package: desc.Desc{Package: pkg}}
+	}
+	ip := InstallPlan{
+		StartingPackages: []string{"R6", "rlang", "glue"},
+		DepDb: map[string][]string{
+			"cli":       {"glue"},
+			"lifecycle": {"cli", "glue", "rlang"},
+			"vctrs":     {"cli", "glue", "lifecycle", "rlang"},
+			"withr":     {"R6"},
+		},
+		PackageDownloads: []cran.PkgDl{dl("R6"), dl("rlang"), dl("glue"), dl("cli"), dl("lifecycle"), dl("vctrs"), dl("withr")},
+		OutdatedPackages: []cran.OutdatedPackage{{Package: "vctrs"}, {Package: "withr"}},
+	}
+
+	removed := ip.Prune([]string{"cli"})
+	assert.Equal(t, []string{"cli", "lifecycle", "vctrs"}, removed)
+	assert.Equal(t, []string{"R6", "rlang", "glue"}, ip.StartingPackages)
+	assert.Equal(t, map[string][]string{"withr": {"R6"}}, ip.DepDb)
+	assert.Equal(t, []cran.PkgDl{dl("R6"), dl("rlang"), dl("glue"), dl("withr")}, ip.PackageDownloads)
+	assert.Equal(t, []cran.OutdatedPackage{{Package: "withr"}}, ip.OutdatedPackages)
+
+	assert.Equal(t, []string{"R6", "withr"}, ip.Prune([]string{"R6"}), "a starting package is removed with its dependents")
+	assert.Equal(t, []string{"rlang", "glue"}, ip.StartingPackages)
+	assert.Empty(t, ip.DepDb)
+}
+
+func TestDownloadOrder(t *testing.T) {
+	dl := func(pkg string) cran.PkgDl {
+		return cran.PkgDl{Package: desc.Desc{Package: pkg}}
+	}
+	ip := InstallPlan{
+		StartingPackages: []string{"vctrs", "R6"},
+		DepDb: map[string][]string{
+			"cli":       {"glue"},
+			"glue":      {},
+			"lifecycle": {"cli", "glue", "rlang"},
+			"rlang":     {},
+			"vctrs":     {"cli", "glue", "lifecycle", "rlang"},
+		},
+		PackageDownloads: []cran.PkgDl{dl("vctrs"), dl("R6"), dl("vctrs"), dl("lifecycle"), dl("cli"), dl("glue"), dl("rlang")},
+	}
+
+	var order []string
+	for _, d := range ip.DownloadOrder() {
+		order = append(order, d.Package.Package)
+	}
+	assert.Equal(t, []string{"R6", "glue", "rlang", "cli", "lifecycle", "vctrs"}, order)
+}
+
+func TestKeptPackages(t *testing.T) {
+	ip := InstallPlan{
+		StartingPackages: []string{"R6", "rlang", "glue"},
+		DepDb: map[string][]string{
+			"cli":   {"glue"},
+			"withr": {"R6"},
+		},
+		InstalledPackages: map[string]desc.Desc{
+			"R6":    {Package: "R6", Version: "2.5.0"},
+			"rlang": {Package: "rlang", Version: "1.0.0"},
+			"glue":  {Package: "glue", Version: "1.6.2"},
+			"withr": {Package: "withr", Version: "2.5.0"},
+			"other": {Package: "other", Version: "1.0.0"},
+		},
+		OutdatedPackages: []cran.OutdatedPackage{
+			{Package: "R6", OldVersion: "2.5.0", NewVersion: "2.5.1"},
+			{Package: "rlang", OldVersion: "1.0.0", NewVersion: "1.1.0", Required: true},
+			{Package: "other", OldVersion: "1.0.0", NewVersion: "1.1.0"},
+		},
+		AdditionalPackageSources: map[string]AdditionalPkg{"withr": {}},
+	}
+
+	assert.Equal(t, []cran.OutdatedPackage{{Package: "rlang", OldVersion: "1.0.0", NewVersion: "1.1.0", Required: true}}, ip.ReplacedPackages())
+	assert.Equal(t, []string{"R6", "glue"}, ip.KeptPackages(), "without updating only required versions are replaced")
+
+	ip.Update = true
+	assert.Len(t, ip.ReplacedPackages(), 2, "packages outside of the plan are not replaced")
+	assert.Equal(t, []string{"glue"}, ip.KeptPackages())
+}
@@ -82,6 +82,12 @@ func ResolveInstallationReqs(
 
 	outdatedPackages := pacman.GetOutdatedPackages(preinstalledPkgs, pkgNexus.GetPackages(extractNamesFromDesc(preinstalledPkgs)).Packages)
 
+	var planPkgs []string
+	for _, layer := range resolved {
+		planPkgs = append(planPkgs, layer...)
+	}
+	outdatedPackages, unsatisfied := checkConstraints(planPkgs, preinstalledPkgs, outdatedPackages, pkgNexus, update)
+
 	installPlan := InstallPlan{
 		StartingPackages:  resolved[0],
 		DepDb:             depDb,
@@ -91,6 +97,9 @@ func ResolveInstallationReqs(
 		Update:            update,
 	}
 	installPlan.Pack(pkgNexus)
+	if len(unsatisfied) > 0 {
+		return installPlan, &UnsatisfiedDepsError{Deps: unsatisfied}
+	}
 	return installPlan, nil
 }
 
@@ -0,0 +1,56 @@
+// Package fsutil provides helpers for writing files shared by the commands
+// and packages of pkgr.
+package fsutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// WriteFileAtomic writes a file with the content provided by write, writing to
+// a temporary file alongside it first and renaming that into place, so a
+// partial file is never left under the name of the destination. The directory
+// of the file is created if it does not exist.
+//
+// If write returns an error, the temporary file is removed and the destination
+// is left as it was.
+func WriteFileAtomic(fs afero.Fs, path string, perm os.FileMode, write func(w io.Writer) error) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := afero.TempFile(fs, filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	err = write(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = fs.Rename(tmp, path)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+	}
+	return err
+}
+
+// CopyFileAtomic copies a file as WriteFileAtomic writes one
+func CopyFileAtomic(fs afero.Fs, src string, dest string, perm os.FileMode) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return WriteFileAtomic(fs, dest, perm, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,57 @@
+package fsutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := filepath.Join("dir", "sub", "file")
+
+	err := WriteFileAtomic(fs, path, 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("content"))
+		return err
+	})
+	require.NoError(t, err)
+	b, err := afero.ReadFile(fs, path)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(b))
+	fi, err := fs.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	failed := errors.New("failed")
+	err = WriteFileAtomic(fs, path, 0644, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	b, err = afero.ReadFile(fs, path)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(b), "destination is left as it was")
+	entries, err := afero.ReadDir(fs, filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary file is removed")
+}
+
+func TestCopyFileAtomic(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "src", []byte("content"), 0600))
+
+	require.NoError(t, CopyFileAtomic(fs, "src", filepath.Join("dest", "file"), 0644))
+	b, err := afero.ReadFile(fs, filepath.Join("dest", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(b))
+
+	assert.Error(t, CopyFileAtomic(fs, "missing", filepath.Join("dest", "other"), 0644))
+	exists, _ := afero.Exists(fs, filepath.Join("dest", "other"))
+	assert.False(t, exists)
+}
@@ -0,0 +1,145 @@
+package lockfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/gpsr"
+)
+
+// New creates a Lockfile from a resolved InstallPlan
+func New(ip gpsr.InstallPlan, rv cran.RVersion, pkgrVersion string) Lockfile {
+	lf := Lockfile{
+		Version:     CurrentVersion,
+		PkgrVersion: pkgrVersion,
+		RVersion:    rv.ToFullString(),
+	}
+	repos := make(map[string]LockedRepo)
+	for _, pd := range ip.PackageDownloads {
+		repo := pd.Config.Repo
+		// credentials in a URL are kept out of the lockfile, which is meant to be committed
+		repos[repo.Name] = LockedRepo{Name: repo.Name, URL: cran.MaskURL(repo.URL), Suffix: repo.Suffix}
+		var requires []string
+		if deps := ip.DepDb[pd.Package.Package]; len(deps) > 0 {
+			requires = append(requires, deps...)
+			sort.Strings(requires)
+		}
+		lf.Packages = append(lf.Packages, LockedPackage{
+			Package:   pd.Package.Package,
+			Version:   pd.Package.Version,
+			Repo:      repo.Name,
+			RepoURL:   cran.MaskURL(repo.URL),
+			Type:      pd.Config.Type.String(),
+			Path:      pd.Package.Path,
+			MD5sum:    pd.Package.MD5sum,
+			RemoteSha: pd.Package.RemoteSha,
+			Requires:  requires,
+		})
+	}
+	for _, r := range repos {
+		lf.Repos = append(lf.Repos, r)
+	}
+	sort.Slice(lf.Repos, func(i, j int) bool { return lf.Repos[i].Name < lf.Repos[j].Name })
+	sort.Slice(lf.Packages, func(i, j int) bool { return lf.Packages[i].Package < lf.Packages[j].Package })
+	return lf
+}
+
+// Write writes the lockfile to the given path
+func (lf Lockfile) Write(fs afero.Fs, path string) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(lf)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, buffer.Bytes(), 0644)
+}
+
+// Read reads a lockfile from the given path
+func Read(fs afero.Fs, path string) (Lockfile, error) {
+	var lf Lockfile
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return lf, err
+	}
+	err = json.Unmarshal(b, &lf)
+	if err != nil {
+		return lf, fmt.Errorf("could not parse lockfile %s: %w", path, err)
+	}
+	if lf.Version > CurrentVersion {
+		return lf, fmt.Errorf("lockfile %s has version %d, but this version of pkgr only supports up to version %d", path, lf.Version, CurrentVersion)
+	}
+	return lf, nil
+}
+
+// InstallPlan rebuilds the InstallPlan recorded in the lockfile, using the
+// package database only to confirm that every locked package is still
+// available with the exact same version and checksum. No dependency
+// resolution takes place.
+func (lf Lockfile) InstallPlan(
+	pkgNexus *cran.PkgNexus,
+	installed map[string]desc.Desc,
+	libraryExists bool,
+) (gpsr.InstallPlan, error) {
+	ip := gpsr.InstallPlan{
+		DepDb:             make(map[string][]string),
+		InstalledPackages: installed,
+		CreateLibrary:     !libraryExists,
+		Update:            true,
+	}
+	var unavailable []string
+	for _, lp := range lf.Packages {
+		pd, pc, ok := pkgNexus.GetPackageVersion(lp.Package, lp.Version, lp.Repo, parseSourceType(lp.Type))
+		if !ok {
+			unavailable = append(unavailable, fmt.Sprintf("%s %s (%s) from %s", lp.Package, lp.Version, lp.Type, lp.Repo))
+			continue
+		}
+		if lp.RemoteSha != "" {
+			// tarballs built from a remote are compared by the commit they were built from
+			if lp.RemoteSha != pd.RemoteSha {
+				unavailable = append(unavailable, fmt.Sprintf("%s %s from %s: RemoteSha changed from %s to %s", lp.Package, lp.Version, lp.Repo, lp.RemoteSha, pd.RemoteSha))
+				continue
+			}
+		} else if lp.MD5sum != "" && pd.MD5sum != "" && !strings.EqualFold(lp.MD5sum, pd.MD5sum) {
+			unavailable = append(unavailable, fmt.Sprintf("%s %s (%s) from %s: MD5sum changed from %s to %s", lp.Package, lp.Version, lp.Type, lp.Repo, lp.MD5sum, pd.MD5sum))
+			continue
+		}
+		ip.PackageDownloads = append(ip.PackageDownloads, cran.PkgDl{Package: pd, Config: pc})
+		if len(lp.Requires) == 0 {
+			ip.StartingPackages = append(ip.StartingPackages, lp.Package)
+		} else {
+			ip.DepDb[lp.Package] = lp.Requires
+		}
+		if inst, found := installed[lp.Package]; found && inst.Version != lp.Version {
+			ip.OutdatedPackages = append(ip.OutdatedPackages, cran.OutdatedPackage{
+				Package:    lp.Package,
+				OldVersion: inst.Version,
+				NewVersion: lp.Version,
+			})
+		}
+	}
+	if len(unavailable) > 0 {
+		for _, u := range unavailable {
+			log.WithField("package", u).Error("locked package not available")
+		}
+		return gpsr.InstallPlan{}, fmt.Errorf("repositories can no longer satisfy the lockfile, unavailable: %s", strings.Join(unavailable, "; "))
+	}
+	return ip, nil
+}
+
+func parseSourceType(t string) cran.SourceType {
+	if strings.EqualFold(t, "binary") {
+		return cran.Binary
+	}
+	return cran.Source
+}
@@ -0,0 +1,43 @@
+package lockfile
+
+// CurrentVersion is the version of the lockfile format written by pkgr
+const CurrentVersion = 1
+
+// DefaultName is the file name pkgr reads and writes lockfiles as
+const DefaultName = "pkgr.lock"
+
+// Lockfile records a fully resolved installation plan so that the
+// same library can be recreated without resolving against the
+// repositories again
+type Lockfile struct {
+	Version     int             `json:"Version"`
+	PkgrVersion string          `json:"PkgrVersion"`
+	RVersion    string          `json:"RVersion"`
+	Repos       []LockedRepo    `json:"Repos"`
+	Packages    []LockedPackage `json:"Packages"`
+}
+
+// LockedRepo is a repository referenced by at least one locked package
+type LockedRepo struct {
+	Name   string `json:"Name"`
+	URL    string `json:"URL"`
+	Suffix string `json:"Suffix,omitempty"`
+}
+
+// LockedPackage is a single package pinned by the lockfile.
+// Requires holds every package that must be installed before this one,
+// mirroring the InstallPlan DepDb entry for the package.
+// Path is set for versions that are not in the repository index,
+// such as those retrieved from the repository archive.
+// RemoteSha is the commit of a package built from a git remote.
+type LockedPackage struct {
+	Package   string   `json:"Package"`
+	Version   string   `json:"Version"`
+	Repo      string   `json:"Repo"`
+	RepoURL   string   `json:"RepoURL"`
+	Type      string   `json:"Type"`
+	Path      string   `json:"Path,omitempty"`
+	MD5sum    string   `json:"MD5sum,omitempty"`
+	RemoteSha string   `json:"RemoteSha,omitempty"`
+	Requires  []string `json:"Requires,omitempty"`
+}
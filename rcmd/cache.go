@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
 )
 
 //NewPackageCache provides a PackageCache, optionally forcing that
@@ -22,3 +24,24 @@ func NewPackageCache(dir string, mustWork bool) PackageCache {
 	}
 	return PackageCache{BaseDir: dir}
 }
+
+// BinaryPath provides the location in the cache of the binary built for a
+// package, in a directory for the platform it is built on
+func (pc PackageCache) BinaryPath(d cran.PkgDl, rs RSettings) string {
+	return filepath.Join(
+		pc.BaseDir,
+		cran.RepoURLHash(d.Config.Repo),
+		"binary",
+		rs.Version.ToString(),
+		pc.platform(rs).Key(),
+		binaryName(d.Package.Package, d.Package.Version, rs.Platform),
+	)
+}
+
+// platform provides the platform binaries are built on
+func (pc PackageCache) platform(rs RSettings) cran.BinaryPlatform {
+	if pc.Platform.OS != "" {
+		return pc.Platform
+	}
+	return cran.CurrentBinaryPlatform(rs.Platform)
+}
@@ -11,7 +11,6 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -20,6 +19,7 @@ import (
 	"github.com/fatih/structtag"
 	"github.com/metrumresearchgroup/pkgr/cran"
 	"github.com/metrumresearchgroup/pkgr/gpsr"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	funk "github.com/thoas/go-funk"
@@ -228,17 +228,8 @@ func isInCache(
 	ir InstallRequest,
 	pc PackageCache) (bool, InstallRequest) {
 	// if not in cache just pass back
-	meta := ir.Metadata
 	pkg := ir.Metadata.Metadata.Package
-
-	repoHash := cran.RepoURLHash(meta.Metadata.Config.Repo)
-	bpath := filepath.Join(
-		pc.BaseDir,
-		repoHash,
-		"binary",
-		ir.RSettings.Version.ToString(),
-		binaryName(pkg.Package, pkg.Version, ir.RSettings.Platform),
-	)
+	bpath := pc.BinaryPath(ir.Metadata.Metadata, ir.RSettings)
 	exists, err := goutils.Exists(fs, bpath)
 	if !exists || err != nil {
 		log.WithFields(log.Fields{
@@ -247,10 +238,23 @@ func isInCache(
 		}).Trace("not found in cache")
 		return false, ir
 	}
+	// a binary is only used on the platform it was built on, which is checked
+	// as well as its place in the cache, as cache directories are shared
+	built, err := cran.ReadPlatformFile(fs, bpath)
+	if platform := pc.platform(ir.RSettings); err != nil || built != platform {
+		log.WithFields(log.Fields{
+			"path":     bpath,
+			"package":  pkg.Package,
+			"built":    built.Key(),
+			"platform": platform.Key(),
+		}).Debug("cached binary not built on this platform")
+		return false, ir
+	}
 	log.WithFields(log.Fields{
 		"path":    bpath,
 		"package": pkg.Package,
 	}).Trace("found in cache")
+	pc.Index.Touch(bpath)
 	ir.Metadata.Path = bpath
 	ir.Metadata.Metadata.Config.Type = cran.Binary
 	return true, ir
@@ -261,8 +265,9 @@ func isInCache(
 // a tmp dir, then installs the binary to the desired
 // library location
 // In addition to returning the CmdResult and any errors
-// the path to the binary is also provided for
-// additional handling of the binary such as caching
+// the path the built binary is cached at is also provided.
+// Processes sharing the cache build a package one at a time,
+// and any waiting install the binary the first cached
 func InstallThroughBinary(
 	fs afero.Fs,
 	ir InstallRequest,
@@ -279,26 +284,30 @@ func InstallThroughBinary(
 		}, "", nil
 	}
 
-	inCache, ir := isInCache(fs, ir, pc)
-	if inCache {
-		// don't need to build since already a binary
-		ir.InstallArgs.Build = false
-		res, err := Install(fs,
-			ir.Package,
-			ir.Metadata.Path,
-			ir.InstallArgs,
-			ir.RSettings,
-			ir.ExecSettings,
-			ir)
-		// don't pass binaryball path back since already in cache
-		return res, "", err
+	// binaries from a repository are installed as they are
+	if ir.Metadata.Metadata.Config.Type == cran.Binary {
+		return installCached(fs, ir)
+	}
+	if inCache, cached := isInCache(fs, ir, pc); inCache {
+		return installCached(fs, cached)
+	}
+	lock, err := cran.LockFile(fs, pc.BinaryPath(ir.Metadata.Metadata, ir.RSettings))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": ir.Package,
+			"error":   err,
+		}).Debug("could not lock binary in cache, building without a lock")
+	}
+	defer lock.Unlock()
+	if inCache, cached := isInCache(fs, ir, pc); inCache {
+		return installCached(fs, cached)
 	}
 
 	tmpdir := filepath.Join(
 		os.TempDir(),
 		randomString(12),
 	)
-	err := fs.MkdirAll(tmpdir, 0777)
+	err = fs.MkdirAll(tmpdir, 0777)
 	if err != nil {
 		log.Fatalf("could not make tmpdir at: %s to install package", tmpdir)
 	}
@@ -386,34 +395,75 @@ func InstallThroughBinary(
 			ir.RSettings,
 			ir.ExecSettings,
 			ir)
-		return res, binaryBall, err
+		if err != nil {
+			return res, "", err
+		}
+		// cached while the lock is held, so any process waiting on it installs it
+		return res, keepBinary(fs, binaryBall, pc.BinaryPath(ir.Metadata.Metadata, ir.RSettings), pc.platform(ir.RSettings)), nil
 	}
 	return res, "", err
 }
 
-// InstallPackagePlan installs a set of packages by layer
+// installCached installs a package from its binary in the cache
+func installCached(fs afero.Fs, ir InstallRequest) (CmdResult, string, error) {
+	// don't need to build since already a binary
+	ir.InstallArgs.Build = false
+	res, err := Install(fs,
+		ir.Package,
+		ir.Metadata.Path,
+		ir.InstallArgs,
+		ir.RSettings,
+		ir.ExecSettings,
+		ir)
+	// don't pass binaryball path back since already in cache
+	return res, "", err
+}
+
+// InstallPackagePlan installs a set of packages as they are downloaded, each once
+// it and all of its dependencies are available. When a package cannot be
+// downloaded no further packages are installed, unless keepGoing is set, when
+// only the packages that depend on it are left out. The error returned for
+// packages that could not be downloaded is that of the DownloadQueue.
 func InstallPackagePlan(
 	fs afero.Fs,
 	plan gpsr.InstallPlan,
-	dl *cran.PkgMap,
+	downloads *cran.DownloadQueue,
 	pc PackageCache,
 	args InstallArgs,
 	rs RSettings,
 	es ExecSettings,
 	ncpu int,
+	keepGoing bool,
 ) error {
 
-	//var successCounter uint64
-	wg := sync.WaitGroup{}
-
 	startTime := time.Now()
 
-	// for now this will only be updated in the Update function
-	// however if it may be concurrently accessed should consider a syncmap implementation
+	dl := cran.NewPkgMap()
 	installedPkgs := make(map[string]bool)
-	// if packages ID'd as ready to install signal so can push them only the queue
-	shouldInstall := make(chan string)
+	requestedPkgs := make(map[string]bool)
+	// packages without a download, such as those of the frozen plan already in the
+	// cache, are available from the start
+	downloaded := make(map[string]bool)
+	for pkg := range plan.DepDb {
+		downloaded[pkg] = true
+	}
+	for _, p := range plan.StartingPackages {
+		downloaded[p] = true
+	}
+	for _, d := range plan.PackageDownloads {
+		downloaded[d.Package.Package] = false
+	}
+	// installed packages that are kept are not installed again, as packages may
+	// be installed to a library staging them rather than the library they are in
+	for _, p := range plan.KeptPackages() {
+		installedPkgs[p] = true
+		requestedPkgs[p] = true
+	}
+	// stopping is set once a package fails, so no more are installed
+	stopping := false
 	anyFailed := false
+	downloadFailed := false
+	inFlight := 0
 
 	packagesNeeded := plan.GetNumPackagesToInstall()
 
@@ -421,119 +471,110 @@ func InstallPackagePlan(
 
 	failedPkgs := []string{}
 
+	// updates are handled below, along with the downloads, rather than by the queue
+	updates := make(chan InstallUpdate)
 	installQueue := NewInstallQueue(
 		ncpu,
 		InstallThroughBinary,
 		func(iu InstallUpdate) {
+			updates <- iu
+		},
+	)
+
+	// queueInstall pushes a package to the install queue once it has been
+	// downloaded and all of its dependencies are installed
+	queueInstall := func(p string) {
+		if stopping || requestedPkgs[p] || !downloaded[p] {
+			return
+		}
+		for _, d := range plan.DepDb[p] {
+			if !installedPkgs[d] {
+				return
+			}
+		}
+		// should only need to request a package once to install
+		requestedPkgs[p] = true
+		inFlight++
+		pkg, _ := dl.Get(p)
+		log.WithField("package", p).Trace("pushing installation to queue")
+		installQueue.Push(InstallRequest{
+			Package:      p,
+			Metadata:     pkg,
+			Cache:        pc,
+			InstallArgs:  args,
+			RSettings:    rs,
+			ExecSettings: es,
+		})
+	}
+
+	log.Info("starting initial install")
+
+	for _, p := range plan.StartingPackages {
+		queueInstall(p)
+	}
+	results := downloads.Results
+	for (results != nil && !stopping) || inFlight > 0 {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			if r.Err != nil {
+				downloadFailed = true
+				if !keepGoing {
+					stopping = true
+					downloads.Stop()
+				}
+				continue
+			}
+			dl.Put(r.Package, r.Download)
+			downloaded[r.Package] = true
+			queueInstall(r.Package)
+		case iu := <-updates:
+			inFlight--
 			if iu.Err != nil {
 				log.WithField("err", iu.Err).Warn("error installing")
 				anyFailed = true
+				stopping = true
+				downloads.Stop()
 				failedPkgs = append(failedPkgs, iu.Package)
-			} else {
-				// set that the package is installed,
-				// then check if any of the inverse dependencies are
-				// ready to be installed, and if so, signal they should
-				// be installed
-				pkg, _ := dl.Get(iu.Package)
-				log.WithFields(log.Fields{"binary": iu.BinaryPath, "src": pkg.Path}).Debug(iu.Package)
-
-				if iu.Result.ExitCode != -999 {
-					packagesNeeded = packagesNeeded - 1
-					log.WithFields(log.Fields{
-						"package":   iu.Package,
-						"version":   pkg.Metadata.Package.Version,
-						"repo":      pkg.Metadata.Config.Repo.Name,
-						"remaining": packagesNeeded,
-					}).Info("Successfully Installed.")
-				}
-				installedPkgs[iu.Package] = true
-				deps, exists := iDeps[iu.Package]
-				if exists {
-					for _, maybeInstall := range deps {
-						needDeps := plan.DepDb[maybeInstall]
-						allInstalled := true
-						for _, d := range needDeps {
-							_, installed := installedPkgs[d]
-							if !installed {
-								allInstalled = false
-							}
-						}
-						if allInstalled && !anyFailed {
-							wg.Add(1)
-							log.WithFields(log.Fields{
-								"from":      iu.Package,
-								"suggested": maybeInstall,
-							}).Trace("suggesting installation")
-							shouldInstall <- maybeInstall
-						}
-					}
-				}
-				if iu.BinaryPath != "" {
-					bdir := filepath.Join(
-						filepath.Dir(filepath.Dir(pkg.Path)),
-						"binary",
-					)
-					os.Mkdir(bdir, 0777)
-					bpath := filepath.Join(
-						bdir,
-						rs.Version.ToString(),
-						filepath.Base(iu.BinaryPath),
-					)
-					_, err := goutils.Copy(iu.BinaryPath, bpath)
-					log.WithFields(log.Fields{"from": iu.BinaryPath, "to": bpath}).Trace("copied binary")
-					if err != nil {
-						log.WithFields(log.Fields{"from": iu.BinaryPath, "to": bpath}).Error("error copying binary")
-						return
-					}
-					// want to delete binaries from the existing tmpdir
-					// so do not carry around two copies. This is especially
-					// relevant for containerized environment where layers get snapshotted
-					// before tmp dirs are cleaned up, which can result in very large
-					// images
-					fs.Remove(iu.BinaryPath)
-
-				}
-			}
-			wg.Done()
-		}, // End anonymous function
-	) // End NewInstallQueue
-	go func(c chan string) {
-		requestedPkgs := make(map[string]bool)
-		for p := range c {
-			if anyFailed {
-				// stop trying to install any more
 				continue
 			}
-
-			// wg added from updater before pushing here
-			// wg.Add(1)
-			_, seen := requestedPkgs[p]
-			if seen {
-				// should only need to request a package once to install
-				continue
-			} else {
-				requestedPkgs[p] = true
+			// set that the package is installed,
+			// then check if any of the inverse dependencies are
+			// ready to be installed
+			pkg, _ := dl.Get(iu.Package)
+			log.WithFields(log.Fields{"binary": iu.BinaryPath, "src": pkg.Path}).Debug(iu.Package)
+
+			if iu.Result.ExitCode != -999 {
+				packagesNeeded = packagesNeeded - 1
+				log.WithFields(log.Fields{
+					"package":   iu.Package,
+					"version":   pkg.Metadata.Package.Version,
+					"repo":      pkg.Metadata.Config.Repo.Name,
+					"remaining": packagesNeeded,
+				}).Info("Successfully Installed.")
+			}
+			installedPkgs[iu.Package] = true
+			for _, maybeInstall := range iDeps[iu.Package] {
+				log.WithFields(log.Fields{
+					"from":      iu.Package,
+					"suggested": maybeInstall,
+				}).Trace("suggesting installation")
+				queueInstall(maybeInstall)
+			}
+			if iu.BinaryPath != "" {
+				pc.Index.Record(iu.BinaryPath, cran.OriginBuilt)
 			}
-			pkg, _ := dl.Get(p)
-			log.WithField("package", p).Trace("pushing installation to queue")
-			installQueue.Push(InstallRequest{
-				Package:      p,
-				Metadata:     pkg,
-				Cache:        pc,
-				InstallArgs:  args,
-				RSettings:    rs,
-				ExecSettings: es,
-			})
 		}
-	}(shouldInstall)
-
-	log.Info("starting initial install")
-
-	for _, p := range plan.StartingPackages {
-		wg.Add(1)
-		shouldInstall <- p
 	}
-	wg.Wait()
+	// downloads started before stopping still write to the cache
+	downloads.Stop()
+	downloadErr := downloads.Wait()
+	if err := pc.Index.Save(); err != nil {
+		log.WithField("error", err).Warn("could not save cache index")
+	}
 
 	log.WithField("duration", time.Since(startTime)).Debug("user package install time")
 	for pkg := range plan.DepDb {
@@ -547,16 +588,44 @@ func InstallPackagePlan(
 		log.Errorf("installation failed for packages: %s", strings.Join(failedPkgs, ", "))
 		return fmt.Errorf("failed installation for packages: %s", strings.Join(failedPkgs, ", "))
 	}
+	if downloadFailed {
+		return downloadErr
+	}
 	return nil
 }
 
+// keepBinary moves a binary built while installing a source package to its
+// place in the cache, recording the platform it was built on alongside it, and
+// returns the path, or an empty path when it could not be copied. The binary is
+// copied alongside its place in the cache and renamed, so no process finds part
+// of it.
+func keepBinary(fs afero.Fs, binaryPath string, bpath string, platform cran.BinaryPlatform) string {
+	fs.MkdirAll(filepath.Dir(bpath), 0777)
+	err := fsutil.CopyFileAtomic(fs, binaryPath, bpath, 0644)
+	if err == nil {
+		err = cran.WritePlatformFile(fs, bpath, platform)
+	}
+	log.WithFields(log.Fields{"from": binaryPath, "to": bpath}).Trace("copied binary")
+	if err != nil {
+		log.WithFields(log.Fields{"from": binaryPath, "to": bpath, "error": err}).Error("error copying binary")
+		return ""
+	}
+	// want to delete binaries from the existing tmpdir
+	// so do not carry around two copies. This is especially
+	// relevant for containerized environment where layers get snapshotted
+	// before tmp dirs are cleaned up, which can result in very large
+	// images
+	fs.Remove(binaryPath)
+	return bpath
+}
+
 func writeDescriptionInfo(fs afero.Fs, ir InstallRequest, ia InstallArgs) {
 	_, err := updateDescriptionInfo(
 		fs,
 		filepath.Join(ia.Library, ir.Package, "DESCRIPTION"),
 		ir.ExecSettings.PkgrVersion,
 		ir.Metadata.Metadata.Config.Type.String(),
-		ir.Metadata.Metadata.Config.Repo.URL,
+		cran.MaskURL(ir.Metadata.Metadata.Config.Repo.URL),
 		ir.Metadata.Metadata.Config.Repo.Name)
 
 	if err != nil {
@@ -2,8 +2,15 @@ package rcmd
 
 import (
 	"fmt"
-	"github.com/stretchr/testify/assert"
+	"path/filepath"
 	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
 )
 
 func TestInstallArgs(t *testing.T) {
@@ -142,3 +149,60 @@ func TestUpdateDescriptionInfoByLines_RepoTheSame(t *testing.T) {
 
 	}
 }
+
+func TestKeepBinary(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	built := filepath.Join("/tmp", "build", "R6_2.5.1_R_x86_64-pc-linux-gnu.tar.gz")
+	bpath := filepath.Join("/cache", "CRAN-abc", "binary", "4.3", "ubuntu-22.04_x86_64-pc-linux-gnu", "R6_2.5.1_R_x86_64-pc-linux-gnu.tar.gz")
+	platform := cran.NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", cran.OsRelease{Id: "ubuntu", VersionId: "22.04"})
+	require.NoError(t, afero.WriteFile(fs, built, []byte("binary"), 0644))
+
+	assert.Equal(t, bpath, keepBinary(fs, built, bpath, platform))
+	content, err := afero.ReadFile(fs, bpath)
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(content))
+	recorded, err := cran.ReadPlatformFile(fs, bpath)
+	require.NoError(t, err)
+	assert.Equal(t, platform, recorded)
+	exists, _ := afero.Exists(fs, built)
+	assert.False(t, exists, "the built binary is moved rather than copied")
+	files, _ := afero.ReadDir(fs, filepath.Dir(bpath))
+	assert.Len(t, files, 2, "no temporary file is left alongside the binary")
+
+	assert.Equal(t, "", keepBinary(fs, built, bpath, platform))
+}
+
+func TestIsInCache(t *testing.T) {
+	ubuntu := cran.NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", cran.OsRelease{Id: "ubuntu", VersionId: "20.04"})
+	rocky := cran.NewBinaryPlatform("linux", "amd64", "x86_64-pc-linux-gnu", cran.OsRelease{Id: "rocky", VersionId: "9.2"})
+	rs := RSettings{Version: cran.RVersion{Major: 4, Minor: 3, Patch: 1}, Platform: "x86_64-pc-linux-gnu"}
+	d := cran.PkgDl{
+		Package: desc.Desc{Package: "R6", Version: "2.5.1"},
+		Config:  cran.PkgConfig{Repo: cran.RepoURL{Name: "CRAN", URL: "https://cran.example.com"}, Type: cran.Source},
+	}
+	ir := InstallRequest{Package: "R6", Metadata: cran.Download{Path: "/cache/src/R6_2.5.1.tar.gz", Metadata: d}, RSettings: rs}
+
+	fs := afero.NewMemMapFs()
+	onUbuntu := PackageCache{BaseDir: "/cache", Platform: ubuntu}
+	onRocky := PackageCache{BaseDir: "/cache", Platform: rocky}
+	assert.NotEqual(t, onUbuntu.BinaryPath(d, rs), onRocky.BinaryPath(d, rs), "binaries are kept apart by platform")
+
+	found, _ := isInCache(fs, ir, onUbuntu)
+	assert.False(t, found)
+
+	bpath := onUbuntu.BinaryPath(d, rs)
+	require.NoError(t, afero.WriteFile(fs, bpath, []byte("binary"), 0644))
+	found, _ = isInCache(fs, ir, onUbuntu)
+	assert.False(t, found, "a binary with no record of its platform is not used")
+
+	require.NoError(t, cran.WritePlatformFile(fs, bpath, ubuntu))
+	found, cached := isInCache(fs, ir, onUbuntu)
+	assert.True(t, found)
+	assert.Equal(t, bpath, cached.Metadata.Path)
+	assert.Equal(t, cran.Binary, cached.Metadata.Metadata.Config.Type)
+
+	// a binary copied into the wrong platform's place is still not used
+	require.NoError(t, cran.WritePlatformFile(fs, bpath, rocky))
+	found, _ = isInCache(fs, ir, onUbuntu)
+	assert.False(t, found)
+}
@@ -53,6 +53,11 @@ type InstallArgs struct {
 // with separate folders for binary and source packages
 type PackageCache struct {
 	BaseDir string
+	// Index records when cached binaries are used, if set
+	Index *cran.CacheIndex
+	// Platform is the platform binaries are built on, if set, rather than the
+	// platform of the R in use
+	Platform cran.BinaryPlatform
 }
 
 // InstallRequest provides information about the installation request
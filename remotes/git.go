@@ -0,0 +1,212 @@
+package remotes
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// Package is a remote checked out at a commit and built into a source tarball
+type Package struct {
+	Remote Remote
+	SHA    string
+	Desc   desc.Desc
+	// RepoDir is laid out as a CRAN-like repository holding only the tarball,
+	// under src/contrib, so the package can be installed like any repository package
+	RepoDir string
+	Tarball string
+}
+
+// Repo provides the repository holding the package, named for the package so
+// that the directory of the cache its downloads go to is a valid file name. The
+// remote is only for display, as a git remote holds characters such as ':'.
+func (p Package) Repo() cran.RepoURL {
+	return cran.RepoURL{Name: "remote-" + p.Desc.Package, URL: p.RepoDir}
+}
+
+// Build resolves a remote to a commit and builds a source tarball of the package at
+// that commit, under the cache directory. The repository is cloned into the cache
+// once, and fetched again for each build unless offline. Fields describing the remote,
+// including the commit as RemoteSha, are added to the DESCRIPTION in the tarball,
+// so they are also recorded in the DESCRIPTION of the installed package.
+func Build(r Remote, cacheDir string, offline bool) (Package, error) {
+	pkg := Package{Remote: r}
+	clone := filepath.Join(cacheDir, "remotes", "git", urlHash(r.URL))
+	if _, err := os.Stat(clone); os.IsNotExist(err) {
+		if offline {
+			return pkg, fmt.Errorf("running offline and %s has not been cloned into the cache", r)
+		}
+		log.WithFields(log.Fields{
+			"remote": r.String(),
+			"dir":    clone,
+		}).Debug("cloning remote")
+		if err := os.MkdirAll(filepath.Dir(clone), 0755); err != nil {
+			return pkg, err
+		}
+		if _, err := runGit(r, "", "clone", "--mirror", "--quiet", r.URL, clone); err != nil {
+			os.RemoveAll(clone)
+			return pkg, err
+		}
+	} else if !offline {
+		if _, err := runGit(r, clone, "fetch", "--quiet", "--prune", "--force", "origin"); err != nil {
+			return pkg, err
+		}
+	}
+
+	ref := r.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := runGit(r, clone, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return pkg, fmt.Errorf("could not find ref %s of %s", ref, r)
+	}
+	pkg.SHA = strings.TrimSpace(string(out))
+
+	description, err := runGit(r, clone, "show", pkg.SHA+":DESCRIPTION")
+	if err != nil {
+		return pkg, fmt.Errorf("no DESCRIPTION file at the top level of %s", r)
+	}
+	description = withRemoteFields(description, r, pkg.SHA)
+	pkg.Desc, err = desc.ParseDesc(bytes.NewReader(description))
+	if err != nil {
+		return pkg, fmt.Errorf("could not parse the DESCRIPTION file of %s: %s", r, err)
+	}
+
+	pkg.RepoDir = filepath.Join(cacheDir, "remotes", pkg.SHA)
+	contrib := filepath.Join(pkg.RepoDir, "src", "contrib")
+	pkg.Tarball = filepath.Join(contrib, fmt.Sprintf("%s_%s.tar.gz", pkg.Desc.Package, pkg.Desc.Version))
+	if _, err := os.Stat(pkg.Tarball); os.IsNotExist(err) {
+		if err := os.MkdirAll(contrib, 0755); err != nil {
+			return pkg, err
+		}
+		archive, err := runGit(r, clone, "archive", "--format=tar", "--prefix="+pkg.Desc.Package+"/", pkg.SHA)
+		if err != nil {
+			return pkg, err
+		}
+		if err := writeTarball(pkg.Tarball, archive, pkg.Desc.Package+"/DESCRIPTION", description); err != nil {
+			return pkg, fmt.Errorf("could not build a tarball of %s: %s", r, err)
+		}
+	}
+	tarball, err := os.ReadFile(pkg.Tarball)
+	if err != nil {
+		return pkg, err
+	}
+	pkg.Desc.MD5sum = fmt.Sprintf("%x", md5.Sum(tarball))
+	log.WithFields(log.Fields{
+		"remote":  r.String(),
+		"package": pkg.Desc.Package,
+		"version": pkg.Desc.Version,
+		"sha":     pkg.SHA,
+	}).Debug("built remote package")
+	return pkg, nil
+}
+
+// runGit runs a git command, in a directory if given, and provides its output
+func runGit(r Remote, dir string, args ...string) ([]byte, error) {
+	subcommand := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	// never wait on a prompt for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.Replace(strings.TrimSpace(stderr.String()), r.URL, cran.MaskURL(r.URL), -1)
+		return out, fmt.Errorf("git %s failed for %s: %s: %s", subcommand, r, err, msg)
+	}
+	return out, nil
+}
+
+// urlHash names the clone of a repository in the cache
+func urlHash(url string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(url)))[:12]
+}
+
+// withRemoteFields replaces any fields describing a remote in a DESCRIPTION file
+// with those for the remote and commit, as the remotes R package records them
+func withRemoteFields(description []byte, r Remote, sha string) []byte {
+	var kept []string
+	skipping := false
+	for _, line := range strings.Split(strings.TrimRight(string(description), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			// continuation of the previous field
+			if !skipping {
+				kept = append(kept, line)
+			}
+			continue
+		}
+		field := strings.SplitN(line, ":", 2)[0]
+		skipping = strings.HasPrefix(field, "Remote") && field != "Remotes"
+		if !skipping {
+			kept = append(kept, line)
+		}
+	}
+	fields := []string{"RemoteType: " + r.Type}
+	switch r.Type {
+	case GitHub:
+		fields = append(fields,
+			"RemoteHost: api.github.com",
+			"RemoteUsername: "+r.Username,
+			"RemoteRepo: "+r.Repo)
+	default:
+		fields = append(fields, "RemoteUrl: "+cran.MaskURL(r.URL))
+	}
+	if r.Ref != "" {
+		fields = append(fields, "RemoteRef: "+r.Ref)
+	}
+	fields = append(fields, "RemoteSha: "+sha)
+	return []byte(strings.Join(append(kept, fields...), "\n") + "\n")
+}
+
+// writeTarball compresses a tar archive into a tarball, replacing the content of one file.
+// The tarball is written atomically so a partial one is never left behind.
+func writeTarball(path string, archive []byte, replace string, content []byte) error {
+	return fsutil.WriteFileAtomic(afero.NewOsFs(), path, 0644, func(w io.Writer) error {
+		gzw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gzw)
+		tr := tar.NewReader(bytes.NewReader(archive))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			var body io.Reader = tr
+			if hdr.Name == replace {
+				hdr.Size = int64(len(content))
+				body = bytes.NewReader(content)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, body); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gzw.Close()
+	})
+}
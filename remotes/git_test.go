@@ -0,0 +1,124 @@
+package remotes
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+// git runs a git command in a directory, failing the test on error
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// newBareRepo creates a bare repository holding a package, with a v1.0.0 tag
+// and a later commit on main, returning its path and the two commits
+func newBareRepo(t *testing.T) (string, string, string) {
+	t.Setenv("GIT_AUTHOR_NAME", "pkgr")
+	t.Setenv("GIT_AUTHOR_EMAIL", "pkgr@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "pkgr")
+	t.Setenv("GIT_COMMITTER_EMAIL", "pkgr@example.com")
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	require.NoError(t, os.MkdirAll(filepath.Join(work, "R"), 0755))
+	git(t, work, "init", "--quiet", "-b", "main")
+	description := "Package: tool\nVersion: 1.0.0\nImports: R6\nRemotes: org/helper\nRemoteType: local\nRemoteUrl:\n    /old/path\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "DESCRIPTION"), []byte(description), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "R", "tool.R"), []byte("tool <- function() 1\n"), 0644))
+	git(t, work, "add", ".")
+	git(t, work, "commit", "--quiet", "-m", "first")
+	git(t, work, "tag", "v1.0.0")
+	tagged := git(t, work, "rev-parse", "HEAD")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, "DESCRIPTION"), []byte(strings.Replace(description, "1.0.0", "1.1.0.9000", 1)), 0644))
+	git(t, work, "commit", "--quiet", "-am", "second")
+	head := git(t, work, "rev-parse", "HEAD")
+	bare := filepath.Join(dir, "tool.git")
+	git(t, dir, "clone", "--quiet", "--bare", work, bare)
+	return bare, tagged, head
+}
+
+// tarballDescription reads the DESCRIPTION file of a package tarball
+func tarballDescription(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		if hdr.Name == "tool/DESCRIPTION" {
+			b, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			return string(b)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	bare, tagged, head := newBareRepo(t)
+	cache := t.TempDir()
+
+	r, err := Parse("git::" + bare + "@v1.0.0")
+	require.NoError(t, err)
+	pkg, err := Build(r, cache, false)
+	require.NoError(t, err)
+	assert.Equal(t, tagged, pkg.SHA)
+	assert.Equal(t, "tool", pkg.Desc.Package)
+	assert.Equal(t, "1.0.0", pkg.Desc.Version)
+	assert.Equal(t, tagged, pkg.Desc.RemoteSha)
+	assert.Equal(t, []string{"org/helper"}, pkg.Desc.Remotes)
+	assert.Contains(t, pkg.Desc.Imports, "R6")
+	assert.Equal(t, filepath.Join(cache, "remotes", tagged, "src", "contrib", "tool_1.0.0.tar.gz"), pkg.Tarball)
+	assert.NotEmpty(t, pkg.Desc.MD5sum)
+	// the cache directory of the repository is a single valid file name
+	assert.Equal(t, cran.RepoURL{Name: "remote-tool", URL: pkg.RepoDir}, pkg.Repo())
+	assert.Regexp(t, `^remote-tool-[0-9a-f]{12}$`, cran.RepoURLHash(pkg.Repo()))
+
+	description := tarballDescription(t, pkg.Tarball)
+	assert.Contains(t, description, "RemoteType: git\nRemoteUrl: "+bare+"\nRemoteRef: v1.0.0\nRemoteSha: "+tagged+"\n")
+	assert.NotContains(t, description, "/old/path")
+	assert.Contains(t, description, "Remotes: org/helper\n")
+
+	// the default branch is used without a ref
+	r, _ = Parse("git::" + bare)
+	pkg, err = Build(r, cache, false)
+	require.NoError(t, err)
+	assert.Equal(t, head, pkg.SHA)
+	assert.Equal(t, "1.1.0.9000", pkg.Desc.Version)
+
+	r, _ = Parse("git::" + bare + "@no-such-ref")
+	_, err = Build(r, cache, false)
+	assert.Error(t, err)
+}
+
+func TestBuildOffline(t *testing.T) {
+	bare, tagged, _ := newBareRepo(t)
+	cache := t.TempDir()
+	r, _ := Parse("git::" + bare + "@v1.0.0")
+
+	_, err := Build(r, cache, true)
+	assert.Error(t, err)
+
+	_, err = Build(r, cache, false)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(bare))
+	pkg, err := Build(r, cache, true)
+	require.NoError(t, err)
+	assert.Equal(t, tagged, pkg.SHA)
+}
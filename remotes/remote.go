@@ -0,0 +1,129 @@
+package remotes
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+// Remote types
+const (
+	Git    = "git"
+	GitHub = "github"
+	Local  = "local"
+	URL    = "url"
+)
+
+// Remote is a package source outside of the repositories, written in the
+// notation of the remotes R package, eg git::https://host/org/repo.git@v1.2.0,
+// github::org/repo@main, local::path/to/pkg or url::https://host/pkg_1.0.tar.gz
+type Remote struct {
+	Type string
+	// URL of the git repository to clone, or of the tarball to download,
+	// or the path to a package directory or tarball for a local remote
+	URL string
+	// Ref is the branch, tag, or commit to use, the default branch if empty
+	Ref string
+	// Username and Repo identify a GitHub repository
+	Username string
+	Repo     string
+	// SHA256 is the expected checksum of the tarball of a url remote, if given
+	SHA256 string
+	// Spec is the remote as it was given
+	Spec string
+}
+
+// githubRepoRegex matches the org/repo[@ref] form used by GitHub remotes
+var githubRepoRegex = regexp.MustCompile(`^([A-Za-z0-9_.-]+)/([A-Za-z0-9_.-]+)(@(.+))?$`)
+
+// sha256Regex matches the checksum given for a url remote, as in #sha256=<hex>
+var sha256Regex = regexp.MustCompile(`^sha256=([0-9a-fA-F]{64})$`)
+
+// IsSpec tells if a Packages entry is a remote rather than a package name
+func IsSpec(s string) bool {
+	return strings.Contains(s, "::")
+}
+
+// Parse parses a remote. As in the Remotes field of a DESCRIPTION file,
+// a remote without a type, such as org/repo, is taken to be on GitHub.
+func Parse(spec string) (Remote, error) {
+	spec = strings.TrimSpace(spec)
+	remoteType, location := GitHub, spec
+	if i := strings.Index(spec, "::"); i >= 0 {
+		remoteType, location = strings.ToLower(spec[:i]), spec[i+2:]
+	}
+	r := Remote{Type: remoteType, Spec: spec}
+	switch remoteType {
+	case Git:
+		r.URL, r.Ref = splitRef(location)
+		if r.URL == "" {
+			return r, fmt.Errorf("no repository given for remote %s", r)
+		}
+	case GitHub:
+		m := githubRepoRegex.FindStringSubmatch(location)
+		if m == nil {
+			return r, fmt.Errorf("invalid GitHub remote %s, expected a form like github::org/repo@ref", r)
+		}
+		r.Username, r.Repo, r.Ref = m[1], strings.TrimSuffix(m[2], ".git"), m[4]
+		r.URL = fmt.Sprintf("https://github.com/%s/%s.git", r.Username, r.Repo)
+	case Local:
+		r.URL = location
+		if r.URL == "" {
+			return r, fmt.Errorf("no path given for remote %s", r)
+		}
+	case URL:
+		location, fragment, found := strings.Cut(location, "#")
+		r.URL = location
+		if found {
+			m := sha256Regex.FindStringSubmatch(fragment)
+			if m == nil {
+				return r, fmt.Errorf("invalid checksum for remote %s, expected a form like #sha256=<hex digest>", r)
+			}
+			r.SHA256 = strings.ToLower(m[1])
+		}
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return r, fmt.Errorf("invalid url for remote %s, expected an http(s) url to a package tarball", r)
+		}
+	default:
+		return r, fmt.Errorf("unsupported remote type %s in %s", remoteType, r)
+	}
+	return r, nil
+}
+
+// splitRef separates the ref from a git url. Only an @ in the path of the
+// url starts the ref, as one before the host separates the user.
+func splitRef(location string) (string, string) {
+	path := 0
+	if i := strings.Index(location, "://"); i >= 0 {
+		if j := strings.Index(location[i+3:], "/"); j >= 0 {
+			path = i + 3 + j
+		} else {
+			path = len(location)
+		}
+	} else if i := strings.Index(location, ":"); i >= 0 {
+		// scp-like syntax, eg git@host:org/repo.git
+		path = i
+	}
+	at := strings.LastIndex(location[path:], "@")
+	if at < 0 {
+		return location, ""
+	}
+	return location[:path+at], location[path+at+1:]
+}
+
+// String provides the remote as it was given, without any password in its url
+func (r Remote) String() string {
+	if (r.Type == Git || r.Type == URL) && r.URL != "" {
+		return strings.Replace(r.Spec, r.URL, cran.MaskURL(r.URL), 1)
+	}
+	return r.Spec
+}
+
+// Key identifies the repository and ref of a remote, however it was written
+func (r Remote) Key() string {
+	return r.URL + "@" + r.Ref
+}
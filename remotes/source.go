@@ -0,0 +1,102 @@
+package remotes
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// Source provides the package directory or tarball of a local or url remote.
+// A local remote is used where it is, while a url remote is downloaded into
+// the cache once, and again only when it does not match its checksum.
+func Source(r Remote, cacheDir string, fetcher *cran.Fetcher) (string, error) {
+	switch r.Type {
+	case Local:
+		if _, err := os.Stat(r.URL); err != nil {
+			return "", fmt.Errorf("could not find the package for remote %s: %s", r, err)
+		}
+		return r.URL, nil
+	case URL:
+		return download(r, cacheDir, fetcher)
+	default:
+		return "", fmt.Errorf("remote %s is not a local or url remote", r)
+	}
+}
+
+// download fetches the tarball of a url remote into the cache, verifying its checksum
+func download(r Remote, cacheDir string, fetcher *cran.Fetcher) (string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(cacheDir, "remotes", "url", urlHash(r.URL), path.Base(u.Path))
+	if _, err := os.Stat(dest); err == nil {
+		sum, err := fileSHA256(dest)
+		if err != nil {
+			return "", err
+		}
+		if r.SHA256 == "" || sum == r.SHA256 {
+			log.WithFields(log.Fields{
+				"remote": r.String(),
+				"file":   dest,
+			}).Debug("using cached download of remote")
+			return dest, nil
+		}
+		log.WithFields(log.Fields{
+			"remote": r.String(),
+			"file":   dest,
+		}).Warn("cached download of remote does not match its checksum, downloading again")
+	}
+	if fetcher.Offline() {
+		return "", &cran.OfflineError{Packages: []string{r.String()}, URLs: []string{cran.MaskURL(r.URL)}}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	log.WithField("remote", r.String()).Info("downloading remote")
+	res, _, err := fetcher.Get(cran.RepoURL{Name: r.String(), URL: r.URL}, r.URL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// written atomically so a partial or corrupt download is never left in the cache
+	err = fsutil.WriteFileAtomic(afero.NewOsFs(), dest, 0644, func(w io.Writer) error {
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, hash), res.Body); err != nil {
+			return fmt.Errorf("could not download remote %s: %s", r, err)
+		}
+		if sum := fmt.Sprintf("%x", hash.Sum(nil)); r.SHA256 != "" && sum != r.SHA256 {
+			return fmt.Errorf("checksum mismatch for remote %s: expected sha256 %s, got %s", r, r.SHA256, sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// fileSHA256 provides the sha256 checksum of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
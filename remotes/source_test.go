@@ -0,0 +1,76 @@
+package remotes
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/metrumresearchgroup/pkgr/cran"
+)
+
+func TestSourceLocal(t *testing.T) {
+	dir := t.TempDir()
+	r, _ := Parse("local::" + dir)
+	source, err := Source(r, t.TempDir(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, dir, source)
+
+	r, _ = Parse("local::" + filepath.Join(dir, "missing"))
+	_, err = Source(r, t.TempDir(), nil)
+	assert.Error(t, err)
+}
+
+func TestSourceURL(t *testing.T) {
+	tarball := []byte("not really a tarball")
+	sum := fmt.Sprintf("%x", sha256.Sum256(tarball))
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	fetcher := cran.NewFetcher(cran.FetchConfig{})
+	cache := t.TempDir()
+
+	r, err := Parse("url::" + server.URL + "/src/tool_1.0.0.tar.gz#sha256=" + sum)
+	require.NoError(t, err)
+	source, err := Source(r, cache, fetcher)
+	require.NoError(t, err)
+	assert.Equal(t, "tool_1.0.0.tar.gz", filepath.Base(source))
+	content, err := os.ReadFile(source)
+	require.NoError(t, err)
+	assert.Equal(t, tarball, content)
+
+	// the cached download is used, also when offline
+	_, err = Source(r, cache, fetcher)
+	require.NoError(t, err)
+	_, err = Source(r, cache, cran.NewFetcher(cran.FetchConfig{Offline: true}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	// a cached download that does not match is fetched again
+	require.NoError(t, os.WriteFile(source, []byte("corrupt"), 0644))
+	_, err = Source(r, cache, fetcher)
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	mismatch, _ := Parse("url::" + server.URL + "/src/other_1.0.0.tar.gz#sha256=" + fmt.Sprintf("%064d", 0))
+	_, err = Source(mismatch, cache, fetcher)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	assert.NoFileExists(t, filepath.Join(cache, "remotes", "url", urlHash(mismatch.URL), "other_1.0.0.tar.gz"))
+
+	uncached, _ := Parse("url::" + server.URL + "/src/new_1.0.0.tar.gz")
+	_, err = Source(uncached, cache, cran.NewFetcher(cran.FetchConfig{Offline: true}))
+	var offlineErr *cran.OfflineError
+	require.True(t, errors.As(err, &offlineErr))
+	assert.Equal(t, []string{uncached.String()}, offlineErr.Packages)
+}
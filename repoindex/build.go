@@ -0,0 +1,313 @@
+package repoindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"pault.ag/go/debian/control"
+
+	"github.com/metrumresearchgroup/pkgr/desc"
+	"github.com/metrumresearchgroup/pkgr/internal/archive"
+	"github.com/metrumresearchgroup/pkgr/internal/fsutil"
+)
+
+// fields are written to the index in this order, as tools::write_PACKAGES does
+var fields = []string{
+	"Package",
+	"Version",
+	"Priority",
+	"Depends",
+	"Imports",
+	"LinkingTo",
+	"Suggests",
+	"Enhances",
+	"License",
+	"License_is_FOSS",
+	"License_restricts_use",
+	"OS_type",
+	"Archs",
+	"MD5sum",
+	"NeedsCompilation",
+	"Built",
+}
+
+// packageFileRegex matches package files named <package>_<version>.<ext>, and linux
+// binaries named <package>_<version>_R_<platform>.tar.gz
+var packageFileRegex = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9.]*)_([0-9]+(?:[.-][0-9]+)+)(_R_[A-Za-z0-9_.-]+)?\.(tar\.gz|tgz|zip)$`)
+
+// rVersionRegex matches the directories holding binaries for a version of R
+var rVersionRegex = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// Index describes the PACKAGES index written for one directory of a repository
+type Index struct {
+	Dir      string
+	Packages int
+	// Archived lists the superseded package files moved to the Archive directory
+	Archived []string
+}
+
+// Options control how the indexes of a repository are built
+type Options struct {
+	// Archive moves superseded versions of packages to the Archive directory
+	Archive bool
+	// AllVersions indexes every version of a package, rather than only the newest,
+	// so a version can be selected for each version of R. It takes precedence over Archive.
+	AllVersions bool
+}
+
+// entry is a package file found in a directory of the repository
+type entry struct {
+	file   string
+	desc   desc.Desc
+	fields map[string]string
+}
+
+// Build writes the PACKAGES and PACKAGES.gz indexes of a CRAN-like repository in dir,
+// for the source packages in src/contrib and the binaries in each
+// bin/<platform>/contrib/<R version> directory. Only the newest version of each
+// package is indexed, unless AllVersions is set, and with Archive the older versions
+// are moved to the Archive directory of each, eg src/contrib/Archive/<package>,
+// where pkgr and R look for older source versions.
+func Build(dir string, opts Options) ([]Index, error) {
+	contribDirs, err := findContribDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(contribDirs) == 0 {
+		return nil, fmt.Errorf("no src/contrib or bin/<platform>/contrib/<R version> directories in %s", dir)
+	}
+	var indexes []Index
+	for _, cd := range contribDirs {
+		idx, err := buildIndex(cd, opts)
+		if err != nil {
+			return indexes, err
+		}
+		indexes = append(indexes, idx)
+	}
+	return indexes, nil
+}
+
+// findContribDirs lists the directories of a repository that hold packages
+func findContribDirs(dir string) ([]string, error) {
+	var dirs []string
+	src := filepath.Join(dir, "src", "contrib")
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		dirs = append(dirs, src)
+	}
+	bin := filepath.Join(dir, "bin")
+	if _, err := os.Stat(bin); os.IsNotExist(err) {
+		return dirs, nil
+	}
+	err := filepath.Walk(bin, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && rVersionRegex.MatchString(info.Name()) && filepath.Base(filepath.Dir(path)) == "contrib" {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// buildIndex indexes the package files of one directory
+func buildIndex(dir string, opts Options) (Index, error) {
+	idx := Index{Dir: dir}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return idx, err
+	}
+	source := filepath.Base(dir) == "contrib"
+	latest := make(map[string]entry)
+	var superseded []entry
+	for _, f := range files {
+		m := packageFileRegex.FindStringSubmatch(f.Name())
+		if f.IsDir() || m == nil || (source && (m[3] != "" || m[4] != "tar.gz")) {
+			continue
+		}
+		e, err := readPackage(filepath.Join(dir, f.Name()), m[1], source)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  f.Name(),
+				"error": err,
+			}).Warn("skipping package file")
+			continue
+		}
+		if e.desc.Package != m[1] || e.desc.Version != m[2] {
+			log.WithFields(log.Fields{
+				"file":    f.Name(),
+				"package": e.desc.Package,
+				"version": e.desc.Version,
+			}).Warn("skipping package file not named for the package and version in its DESCRIPTION")
+			continue
+		}
+		if prev, found := latest[m[1]]; found {
+			if desc.CompareVersionStrings(e.desc.Version, prev.desc.Version) > 0 {
+				superseded = append(superseded, prev)
+				latest[m[1]] = e
+			} else {
+				superseded = append(superseded, e)
+			}
+			continue
+		}
+		latest[m[1]] = e
+	}
+
+	indexed := make([]entry, 0, len(latest))
+	for _, e := range latest {
+		indexed = append(indexed, e)
+	}
+	if opts.AllVersions {
+		indexed = append(indexed, superseded...)
+	} else if opts.Archive {
+		for _, e := range superseded {
+			archived := filepath.Join(dir, "Archive", e.desc.Package, filepath.Base(e.file))
+			if err := os.MkdirAll(filepath.Dir(archived), 0755); err != nil {
+				return idx, err
+			}
+			if err := os.Rename(e.file, archived); err != nil {
+				return idx, err
+			}
+			idx.Archived = append(idx.Archived, archived)
+		}
+	}
+
+	sort.Slice(indexed, func(i, j int) bool {
+		if indexed[i].desc.Package != indexed[j].desc.Package {
+			return indexed[i].desc.Package < indexed[j].desc.Package
+		}
+		return desc.CompareVersionStrings(indexed[i].desc.Version, indexed[j].desc.Version) > 0
+	})
+	var packages bytes.Buffer
+	for _, e := range indexed {
+		writeEntry(&packages, e.fields)
+	}
+	idx.Packages = len(latest)
+
+	if err := writeIndexes(dir, packages.Bytes()); err != nil {
+		return idx, err
+	}
+	// R prefers PACKAGES.rds over PACKAGES, so an old one would hide the new index
+	rds := filepath.Join(dir, "PACKAGES.rds")
+	if _, err := os.Stat(rds); err == nil {
+		log.WithField("file", rds).Warn("removing PACKAGES.rds, which would be used in place of the new index")
+		if err := os.Remove(rds); err != nil {
+			return idx, err
+		}
+	}
+	return idx, nil
+}
+
+// readPackage extracts a package file to read its DESCRIPTION, and records the
+// fields of the index entry along with the MD5sum of the file
+func readPackage(path string, pkg string, source bool) (entry, error) {
+	e := entry{file: path}
+	tmp, err := os.MkdirTemp("", "pkgr-repo-")
+	if err != nil {
+		return e, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := archive.Extract(path, tmp); err != nil {
+		return e, err
+	}
+	description, err := os.ReadFile(filepath.Join(tmp, pkg, "DESCRIPTION"))
+	if err != nil {
+		return e, fmt.Errorf("no DESCRIPTION file for package %s", pkg)
+	}
+	e.desc, err = desc.ParseDesc(bytes.NewReader(description))
+	if err != nil {
+		return e, err
+	}
+	reader, err := control.NewParagraphReader(bytes.NewReader(description), nil)
+	if err != nil {
+		return e, err
+	}
+	paragraph, err := reader.Next()
+	if err != nil {
+		return e, err
+	}
+	e.fields = make(map[string]string)
+	for _, field := range fields {
+		if value, found := paragraph.Values[field]; found {
+			// fields are written on one line, as continuation lines are joined
+			e.fields[field] = strings.Join(strings.Fields(value), " ")
+		}
+	}
+	if _, found := e.fields["NeedsCompilation"]; !found && source {
+		// as R CMD build would record it
+		e.fields["NeedsCompilation"] = "no"
+		if fi, err := os.Stat(filepath.Join(tmp, pkg, "src")); err == nil && fi.IsDir() {
+			e.fields["NeedsCompilation"] = "yes"
+		}
+	}
+	if source {
+		delete(e.fields, "Built")
+	}
+	md5sum, err := fileMD5(path)
+	if err != nil {
+		return e, err
+	}
+	e.fields["MD5sum"] = md5sum
+	return e, nil
+}
+
+// writeEntry writes the fields of a package as one paragraph of the index
+func writeEntry(w io.Writer, values map[string]string) {
+	for _, field := range fields {
+		if value, found := values[field]; found && value != "" {
+			fmt.Fprintf(w, "%s: %s\n", field, value)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// writeIndexes writes PACKAGES and PACKAGES.gz, each replacing the previous
+// index only once it is complete
+func writeIndexes(dir string, packages []byte) error {
+	if err := writeFile(filepath.Join(dir, "PACKAGES"), packages); err != nil {
+		return err
+	}
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	if _, err := gzw.Write(packages); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "PACKAGES.gz"), gz.Bytes())
+}
+
+// writeFile writes a file atomically, so a repository being served is never
+// seen with a partial index
+func writeFile(path string, content []byte) error {
+	return fsutil.WriteFileAtomic(afero.NewOsFs(), path, 0644, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// fileMD5 provides the md5 checksum of a file
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
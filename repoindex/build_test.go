@@ -0,0 +1,145 @@
+package repoindex
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePackage writes a package file holding the given files under a
+// directory named for the package, as a gzipped tarball or a zip file
+func writePackage(t *testing.T, path string, pkg string, files map[string]string) string {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	if filepath.Ext(path) == ".zip" {
+		zw := zip.NewWriter(f)
+		for name, content := range files {
+			w, err := zw.Create(pkg + "/" + name)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+	} else {
+		gzw := gzip.NewWriter(f)
+		tw := tar.NewWriter(gzw)
+		for name, content := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: pkg + "/" + name, Mode: 0644, Size: int64(len(content))}))
+			_, err = io.WriteString(tw, content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, gzw.Close())
+	}
+	require.NoError(t, f.Close())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return fmt.Sprintf("%x", md5.Sum(b))
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "contrib")
+	toolOld := writePackage(t, filepath.Join(src, "tool_1.0.0.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.0.0\nLicense: MIT\n",
+	})
+	toolNew := writePackage(t, filepath.Join(src, "tool_1.10.0.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.10.0\nDepends: R (>= 4.0)\nImports: R6,\n    rlang (>= 1.0.0)\nLicense: MIT\nAuthor: someone\n",
+		"src/tool.c":  "",
+	})
+	helper := writePackage(t, filepath.Join(src, "helper_0.2.tar.gz"), "helper", map[string]string{
+		"DESCRIPTION": "Package: helper\nVersion: 0.2\nLicense: GPL-3\nNeedsCompilation: no\n",
+	})
+	writePackage(t, filepath.Join(src, "misnamed_0.1.tar.gz"), "misnamed", map[string]string{
+		"DESCRIPTION": "Package: misnamed\nVersion: 0.2\n",
+	})
+	require.NoError(t, os.WriteFile(filepath.Join(src, "PACKAGES.rds"), []byte("stale"), 0644))
+	bin := filepath.Join(dir, "bin", "windows", "contrib", "4.3")
+	toolBin := writePackage(t, filepath.Join(bin, "tool_1.10.0.zip"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.10.0\nLicense: MIT\nNeedsCompilation: yes\nBuilt: R 4.3.1; x86_64-w64-mingw32; 2023-07-01 00:00:00 UTC; windows\n",
+	})
+
+	indexes, err := Build(dir, Options{})
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	assert.Equal(t, Index{Dir: src, Packages: 2}, indexes[0])
+	assert.Equal(t, Index{Dir: bin, Packages: 1}, indexes[1])
+
+	expected := "Package: helper\nVersion: 0.2\nLicense: GPL-3\nMD5sum: " + helper + "\nNeedsCompilation: no\n\n" +
+		"Package: tool\nVersion: 1.10.0\nDepends: R (>= 4.0)\nImports: R6, rlang (>= 1.0.0)\nLicense: MIT\nMD5sum: " + toolNew + "\nNeedsCompilation: yes\n\n"
+	assert.Equal(t, expected, readFile(t, filepath.Join(src, "PACKAGES")))
+	f, err := os.Open(filepath.Join(src, "PACKAGES.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	gz, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(gz))
+	assert.NoFileExists(t, filepath.Join(src, "PACKAGES.rds"))
+	assert.FileExists(t, filepath.Join(src, "tool_1.0.0.tar.gz"))
+
+	assert.Equal(t, "Package: tool\nVersion: 1.10.0\nLicense: MIT\nMD5sum: "+toolBin+"\nNeedsCompilation: yes\nBuilt: R 4.3.1; x86_64-w64-mingw32; 2023-07-01 00:00:00 UTC; windows\n\n",
+		readFile(t, filepath.Join(bin, "PACKAGES")))
+
+	indexes, err = Build(dir, Options{Archive: true})
+	require.NoError(t, err)
+	archived := filepath.Join(src, "Archive", "tool", "tool_1.0.0.tar.gz")
+	assert.Equal(t, []string{archived}, indexes[0].Archived)
+	assert.NoFileExists(t, filepath.Join(src, "tool_1.0.0.tar.gz"))
+	b, err := os.ReadFile(archived)
+	require.NoError(t, err)
+	assert.Equal(t, toolOld, fmt.Sprintf("%x", md5.Sum(b)))
+	assert.Equal(t, expected, readFile(t, filepath.Join(src, "PACKAGES")))
+}
+
+func TestBuildAllVersions(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "contrib")
+	toolOld := writePackage(t, filepath.Join(src, "tool_1.0.0.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.0.0\nNeedsCompilation: no\n",
+	})
+	toolNew := writePackage(t, filepath.Join(src, "tool_1.10.0.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.10.0\nDepends: R (>= 4.3)\nNeedsCompilation: no\n",
+	})
+	// a linux binary is only indexed in a binary directory
+	writePackage(t, filepath.Join(src, "tool_1.10.0_R_x86_64-pc-linux-gnu.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.10.0\n",
+	})
+	bin := filepath.Join(dir, "bin", "linux", "jammy", "contrib", "4.3")
+	toolBin := writePackage(t, filepath.Join(bin, "tool_1.10.0_R_x86_64-pc-linux-gnu.tar.gz"), "tool", map[string]string{
+		"DESCRIPTION": "Package: tool\nVersion: 1.10.0\nNeedsCompilation: no\nBuilt: R 4.3.1; ; 2023-07-01 00:00:00 UTC; unix\n",
+	})
+
+	indexes, err := Build(dir, Options{Archive: true, AllVersions: true})
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	assert.Equal(t, Index{Dir: src, Packages: 1}, indexes[0])
+	assert.FileExists(t, filepath.Join(src, "tool_1.0.0.tar.gz"))
+	assert.Equal(t, "Package: tool\nVersion: 1.10.0\nDepends: R (>= 4.3)\nMD5sum: "+toolNew+"\nNeedsCompilation: no\n\n"+
+		"Package: tool\nVersion: 1.0.0\nMD5sum: "+toolOld+"\nNeedsCompilation: no\n\n",
+		readFile(t, filepath.Join(src, "PACKAGES")))
+	assert.Equal(t, "Package: tool\nVersion: 1.10.0\nMD5sum: "+toolBin+"\nNeedsCompilation: no\nBuilt: R 4.3.1; ; 2023-07-01 00:00:00 UTC; unix\n\n",
+		readFile(t, filepath.Join(bin, "PACKAGES")))
+}
+
+func TestBuildEmpty(t *testing.T) {
+	_, err := Build(t.TempDir(), Options{})
+	assert.Error(t, err)
+}
@@ -170,3 +170,27 @@ func (suite *OperationsTestSuite) TestRollbackUpdatePackages_OverwritesFreshInst
 	suite.False(afero.Exists(suite.FileSystem, filepath.Join(suite.FilePrefix, "test-library", "__OLD__CatsAndOranges", "DESCRIPTION")))
 
 }
+
+func (suite *OperationsTestSuite) TestRestorePackages_RestoresOnlyGivenPackages() {
+	library := filepath.Join(suite.FilePrefix, "test-library")
+	var attempts []UpdateAttempt
+	for _, pkg := range []string{"CatsAndOranges", "DogsAndApples"} {
+		_ = suite.FileSystem.MkdirAll(filepath.Join(library, "__OLD__"+pkg), 0755)
+		attempts = append(attempts, UpdateAttempt{
+			Package:                pkg,
+			BackupPackageDirectory: filepath.Join(library, "__OLD__"+pkg),
+			ActivePackageDirectory: filepath.Join(library, pkg),
+			NewVersion:             "2",
+			OldVersion:             "1",
+		})
+	}
+	rp := RollbackPlan{UpdateRollbacks: attempts}
+
+	err := rp.RestorePackages(suite.FileSystem, []string{"DogsAndApples"})
+
+	suite.NoError(err)
+	suite.True(afero.DirExists(suite.FileSystem, filepath.Join(library, "DogsAndApples")))
+	suite.False(afero.DirExists(suite.FileSystem, filepath.Join(library, "__OLD__DogsAndApples")))
+	suite.True(afero.DirExists(suite.FileSystem, filepath.Join(library, "__OLD__CatsAndOranges")))
+	suite.Equal([]UpdateAttempt{attempts[0]}, rp.UpdateRollbacks)
+}
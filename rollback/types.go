@@ -39,14 +39,8 @@ func CreateRollbackPlan(library string, installPlan gpsr.InstallPlan, preinstall
 func (rp *RollbackPlan) PreparePackagesForUpdate(fs afero.Fs, library string) {
 
 	//InstallPlan is aware of _all_ preinstalled packages, even if they're not in pkgr.yml. We don't want to touch
-	//preinstalled packages that weren't in pkgr.yml, so we just want to take the active packages from the install plan.
-	outdatedPackages := rp.InstallPlan.OutdatedPackages
-	var opFiltered []cran.OutdatedPackage
-	for _, op := range outdatedPackages {
-		if funk.Contains(rp.AllPackages, op.Package) {
-			opFiltered = append(opFiltered, op)
-		}
-	}
+	//preinstalled packages that weren't in pkgr.yml, so we just want to take the packages the install plan replaces.
+	opFiltered := rp.InstallPlan.ReplacedPackages()
 
 	// Wrap this function for now until we're ready to move it over.
 	updateAttempts := createUpdateBackupFolders(fs, library, opFiltered)
@@ -82,6 +76,21 @@ func (rp *RollbackPlan) DeleteBackupPackageFolders(fs afero.Fs) []error {
 	return errSlice
 }
 
+// RestorePackages puts back the installations of packages that were staged for
+// update but will not be installed, such as those that could not be downloaded.
+func (rp *RollbackPlan) RestorePackages(fs afero.Fs, pkgs []string) error {
+	var restore, staged []UpdateAttempt
+	for _, ua := range rp.UpdateRollbacks {
+		if funk.ContainsString(pkgs, ua.Package) {
+			restore = append(restore, ua)
+		} else {
+			staged = append(staged, ua)
+		}
+	}
+	rp.UpdateRollbacks = staged
+	return rollbackChangedPackages(fs, restore)
+}
+
 // Helper function to determine which packages out of a list are not already installed. Used to determine which packages pkgr specifically will be installing fresh.
 func discernNewPackages(toInstallPackageNames []string, preinstalledPackages map[string]desc.Desc) []string {
 	var newPackages []string